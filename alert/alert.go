@@ -0,0 +1,332 @@
+/*
+Copyright © 2020 Anton Kramarev
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+package alert
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/dakaraj/gatling-to-influxdb/assertion"
+	l "github.com/dakaraj/gatling-to-influxdb/logger"
+	"github.com/dakaraj/gatling-to-influxdb/stats"
+	"github.com/spf13/cobra"
+)
+
+const (
+	statusFiring   = "firing"
+	statusResolved = "resolved"
+)
+
+// testInfo describes a test in alert notifications
+type testInfo struct {
+	testID         string
+	simulationName string
+	nodeName       string
+}
+
+// ruleState keeps track of notifications already sent for a rule,
+// so the same alert is not posted on every evaluation
+type ruleState struct {
+	rule     assertion.Rule
+	firing   bool
+	notified time.Time
+}
+
+var (
+	states      []*ruleState
+	windowLen   int64
+	interval    time.Duration
+	repeatAfter time.Duration
+	minSamples  uint64
+	abortPID    int
+	abortSignal os.Signal
+	aborted     bool
+
+	// infoMu guards test information, which is set by parser and read by evaluator
+	infoMu sync.Mutex
+	info   testInfo
+
+	win = &window{buckets: make(map[int64]*bucket)}
+)
+
+// bucket contains statistics for a single second of a test
+type bucket struct {
+	global   *stats.Summary
+	requests map[string]*stats.Summary
+	groups   map[string]*stats.Summary
+}
+
+func newBucket() *bucket {
+	return &bucket{
+		global:   stats.NewSummary(),
+		requests: make(map[string]*stats.Summary),
+		groups:   make(map[string]*stats.Summary),
+	}
+}
+
+// window is a sliding window of per second buckets based on log timestamps
+type window struct {
+	mu      sync.Mutex
+	buckets map[int64]*bucket
+	latest  int64
+}
+
+func (w *window) get(t time.Time) *bucket {
+	sec := t.Unix()
+	// Events that are older than the window are of no use anymore
+	if sec <= w.latest-windowLen {
+		return nil
+	}
+	if sec > w.latest {
+		w.latest = sec
+		for s := range w.buckets {
+			if s <= w.latest-windowLen {
+				delete(w.buckets, s)
+			}
+		}
+	}
+	b, found := w.buckets[sec]
+	if !found {
+		b = newBucket()
+		w.buckets[sec] = b
+	}
+
+	return b
+}
+
+func addTo(m map[string]*stats.Summary, name string, duration int, ok bool) {
+	s, found := m[name]
+	if !found {
+		s = stats.NewSummary()
+		m[name] = s
+	}
+	s.Add(duration, ok)
+}
+
+func (w *window) snapshot() stats.Snapshot {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	snap := stats.Snapshot{
+		Global:   stats.NewSummary(),
+		Requests: make(map[string]*stats.Summary),
+		Groups:   make(map[string]*stats.Summary),
+		Start:    time.Unix(w.latest-windowLen+1, 0),
+		End:      time.Unix(w.latest+1, 0),
+	}
+	for _, b := range w.buckets {
+		snap.Global.Merge(b.global)
+		for k, v := range b.requests {
+			if _, found := snap.Requests[k]; !found {
+				snap.Requests[k] = stats.NewSummary()
+			}
+			snap.Requests[k].Merge(v)
+		}
+		for k, v := range b.groups {
+			if _, found := snap.Groups[k]; !found {
+				snap.Groups[k] = stats.NewSummary()
+			}
+			snap.Groups[k].Merge(v)
+		}
+	}
+
+	return snap
+}
+
+// Enabled reports if there is at least one alerting rule configured
+func Enabled() bool {
+	return len(states) > 0
+}
+
+// AddRequest registers data from a single REQUEST line in the sliding window
+func AddRequest(name string, duration int, ok bool, t time.Time) {
+	if !Enabled() {
+		return
+	}
+	win.mu.Lock()
+	defer win.mu.Unlock()
+
+	if b := win.get(t); b != nil {
+		addTo(b.requests, name, duration, ok)
+		b.global.Add(duration, ok)
+	}
+}
+
+// AddGroup registers data from a single GROUP line in the sliding window
+func AddGroup(name string, duration int, ok bool, t time.Time) {
+	if !Enabled() {
+		return
+	}
+	win.mu.Lock()
+	defer win.mu.Unlock()
+
+	if b := win.get(t); b != nil {
+		addTo(b.groups, name, duration, ok)
+	}
+}
+
+// SetTestInfo sets test information used in alert notifications
+func SetTestInfo(id, simulation, node string) {
+	infoMu.Lock()
+	info = testInfo{id, simulation, node}
+	infoMu.Unlock()
+}
+
+func currentTestInfo() testInfo {
+	infoMu.Lock()
+	defer infoMu.Unlock()
+
+	return info
+}
+
+func evaluate(now time.Time) {
+	snap := win.snapshot()
+	for _, s := range states {
+		sum := s.rule.Summary(snap)
+		// Not enough data in the window to make a decision, keep the previous state
+		if sum == nil || sum.Count() < minSamples {
+			continue
+		}
+		res := s.rule.Check(snap)
+
+		switch {
+		case !res.Passed && !s.firing:
+			s.firing = true
+			s.notified = now
+			notify(statusFiring, res, now)
+			abortTest(res)
+		case !res.Passed && repeatAfter > 0 && now.Sub(s.notified) >= repeatAfter:
+			s.notified = now
+			notify(statusFiring, res, now)
+		case res.Passed && s.firing:
+			s.firing = false
+			s.notified = now
+			notify(statusResolved, res, now)
+		}
+	}
+}
+
+func abortTest(res assertion.Result) {
+	if abortPID == 0 || aborted {
+		return
+	}
+	aborted = true
+
+	p, err := os.FindProcess(abortPID)
+	if err == nil {
+		err = p.Signal(abortSignal)
+	}
+	if err != nil {
+		l.Errorf("Failed to send %v to process %d: %v\n", abortSignal, abortPID, err)
+		return
+	}
+	l.Infof("Sent %v to process %d because alert %q fired\n", abortSignal, abortPID, res.Rule.Text)
+}
+
+// Start evaluates alerting rules periodically until context is cancelled
+func Start(ctx context.Context, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	if !Enabled() {
+		return
+	}
+	l.Infof("Starting alerting with %d rule(s)\n", len(states))
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			l.Infoln("Alerting stopped")
+			return
+		case now := <-ticker.C:
+			evaluate(now)
+		}
+	}
+}
+
+func parseSignal(name string) (os.Signal, error) {
+	switch name {
+	case "INT", "SIGINT":
+		return syscall.SIGINT, nil
+	case "TERM", "SIGTERM":
+		return syscall.SIGTERM, nil
+	case "KILL", "SIGKILL":
+		return os.Kill, nil
+	}
+
+	return nil, fmt.Errorf("Unsupported signal %q, expected one of: INT, TERM, KILL", name)
+}
+
+// Init parses alerting rules and notification settings provided with flags
+func Init(cmd *cobra.Command) error {
+	texts, _ := cmd.Flags().GetStringArray("alert")
+	if path, _ := cmd.Flags().GetString("alerts-file"); path != "" {
+		fromFile, err := assertion.ReadRulesFile(path)
+		if err != nil {
+			return err
+		}
+		texts = append(texts, fromFile...)
+	}
+
+	states = make([]*ruleState, 0, len(texts))
+	for _, t := range texts {
+		r, err := assertion.Parse(t)
+		if err != nil {
+			return err
+		}
+		if r.Scope == "users" {
+			return fmt.Errorf("Alert %q is invalid: users scope is not supported for alerts", t)
+		}
+		states = append(states, &ruleState{rule: r})
+	}
+	if !Enabled() {
+		return nil
+	}
+
+	w, _ := cmd.Flags().GetUint("alert-window")
+	windowLen = int64(w)
+	i, _ := cmd.Flags().GetUint("alert-interval")
+	interval = time.Duration(i) * time.Second
+	r, _ := cmd.Flags().GetUint("alert-repeat")
+	repeatAfter = time.Duration(r) * time.Second
+	m, _ := cmd.Flags().GetUint("alert-min-samples")
+	minSamples = uint64(m)
+	if windowLen == 0 || interval == 0 {
+		return fmt.Errorf("Alert window and interval must be greater than zero")
+	}
+
+	abortPID, _ = cmd.Flags().GetInt("alert-abort-pid")
+	sig, _ := cmd.Flags().GetString("alert-abort-signal")
+	var err error
+	abortSignal, err = parseSignal(sig)
+	if err != nil {
+		return err
+	}
+
+	return initWebhook(cmd)
+}
@@ -0,0 +1,263 @@
+/*
+Copyright © 2020 Anton Kramarev
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+package alert
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/dakaraj/gatling-to-influxdb/flags"
+	"github.com/spf13/cobra"
+)
+
+// fakeWebhook records bodies of posted alerts
+type fakeWebhook struct {
+	*httptest.Server
+	mu     sync.Mutex
+	bodies [][]byte
+}
+
+func newFakeWebhook() *fakeWebhook {
+	h := &fakeWebhook{}
+	h.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		h.mu.Lock()
+		h.bodies = append(h.bodies, body)
+		h.mu.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	return h
+}
+
+// alerts returns generic payloads posted so far
+func (h *fakeWebhook) alerts(t *testing.T) []Alert {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	alerts := make([]Alert, 0, len(h.bodies))
+	for _, b := range h.bodies {
+		var a Alert
+		if err := json.Unmarshal(b, &a); err != nil {
+			t.Fatalf("Failed to decode alert %s: %v", b, err)
+		}
+		alerts = append(alerts, a)
+	}
+
+	return alerts
+}
+
+func (h *fakeWebhook) last() []byte {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(h.bodies) == 0 {
+		return nil
+	}
+
+	return h.bodies[len(h.bodies)-1]
+}
+
+// setUp initializes alerting with flags parsed from args posting to a fake webhook,
+// returned function forgets rules and collected requests
+func setUp(t *testing.T, args ...string) (*fakeWebhook, func()) {
+	h := newFakeWebhook()
+	cmd := &cobra.Command{Use: "test"}
+	flags.AddAlerting(cmd.Flags())
+	if err := cmd.ParseFlags(append([]string{"--alert-webhook", h.URL}, args...)); err != nil {
+		t.Fatalf("Failed to parse flags: %v", err)
+	}
+	if err := Init(cmd); err != nil {
+		h.Close()
+		t.Fatal(err)
+	}
+	win = &window{buckets: make(map[int64]*bucket)}
+	aborted = false
+	SetTestInfo("test1", "shop", "node1")
+
+	return h, func() {
+		h.Close()
+		states = nil
+		abortPID = 0
+		aborted = false
+		win = &window{buckets: make(map[int64]*bucket)}
+		SetTestInfo("", "", "")
+	}
+}
+
+// addRequests adds ok and ko requests of Home within a second
+func addRequests(at time.Time, ok, ko int) {
+	for i := 0; i < ok; i++ {
+		AddRequest("Home", 100, true, at)
+	}
+	for i := 0; i < ko; i++ {
+		AddRequest("Home", 100, false, at)
+	}
+}
+
+func TestEvaluateFiresRepeatsAndResolves(t *testing.T) {
+	h, restore := setUp(t, "--alert", `request "Home".errorRate < 10%`,
+		"--alert-window", "10", "--alert-repeat", "60", "--alert-min-samples", "5")
+	defer restore()
+	start := time.Unix(1790000000, 0)
+	now := time.Unix(1800000000, 0)
+
+	// Not enough samples to decide
+	addRequests(start, 1, 3)
+	evaluate(now)
+	if n := len(h.alerts(t)); n != 0 {
+		t.Fatalf("Expected no alerts below min samples, got %d", n)
+	}
+
+	addRequests(start.Add(time.Second), 5, 1)
+	evaluate(now)
+	// Still firing, but repeat interval has not passed yet
+	evaluate(now.Add(30 * time.Second))
+	// Repeated notification
+	evaluate(now.Add(60 * time.Second))
+	// Old requests leave the window, only OK ones are left
+	addRequests(start.Add(20*time.Second), 10, 0)
+	evaluate(now.Add(70 * time.Second))
+	// Resolved alert is not repeated
+	evaluate(now.Add(200 * time.Second))
+
+	want := []Alert{
+		{Status: statusFiring, Actual: 40, Time: now.UTC()},
+		{Status: statusFiring, Actual: 40, Time: now.Add(60 * time.Second).UTC()},
+		{Status: statusResolved, Actual: 0, Time: now.Add(70 * time.Second).UTC()},
+	}
+	got := h.alerts(t)
+	if len(got) != len(want) {
+		t.Fatalf("Expected %d alerts, got %d: %+v", len(want), len(got), got)
+	}
+	for i, w := range want {
+		w.Rule = `request "Home".errorRate < 10%`
+		w.Scope, w.Name, w.Metric, w.Threshold, w.Window = "request", "Home", "errorRate", 10, "10s"
+		w.TestID, w.Simulation, w.NodeName = "test1", "shop", "node1"
+		if got[i] != w {
+			t.Errorf("Alert %d: expected %+v, got %+v", i, w, got[i])
+		}
+	}
+}
+
+func TestEvaluateWithoutRepeat(t *testing.T) {
+	h, restore := setUp(t, "--alert", "global.p50 < 50ms", "--alert-min-samples", "1")
+	defer restore()
+	now := time.Unix(1800000000, 0)
+
+	addRequests(time.Unix(1790000000, 0), 1, 0)
+	for i := 0; i < 5; i++ {
+		evaluate(now.Add(time.Duration(i) * time.Hour))
+	}
+	if alerts := h.alerts(t); len(alerts) != 1 || alerts[0].Status != statusFiring || alerts[0].Actual != 100 {
+		t.Errorf("Expected a single firing alert, got %+v", alerts)
+	}
+}
+
+func TestPayloadFormats(t *testing.T) {
+	dir, err := ioutil.TempDir("", "g2i-alert-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tmplFile := filepath.Join(dir, "payload.tmpl")
+	ioutil.WriteFile(tmplFile, []byte(`{"msg": {{json .Summary}}, "test": "{{.TestID}}"}`), 0644)
+
+	tests := []struct {
+		args []string
+		key  string
+		want string
+	}{
+		{args: []string{"--alert-format", "slack"}, key: "text",
+			want: `FIRING: global.errorRate < 1% is violated (actual: 100.00 over last 1m0s) in test test1`},
+		{args: []string{"--alert-format", "teams"}, key: "summary",
+			want: `FIRING: global.errorRate < 1% is violated (actual: 100.00 over last 1m0s) in test test1`},
+		{args: []string{"--alert-template", tmplFile}, key: "test", want: "test1"},
+	}
+	for _, tt := range tests {
+		h, restore := setUp(t, append([]string{"--alert", "global.errorRate < 1%", "--alert-min-samples", "1"}, tt.args...)...)
+		addRequests(time.Unix(1790000000, 0), 0, 1)
+		evaluate(time.Unix(1800000000, 0))
+
+		var body map[string]interface{}
+		if err := json.Unmarshal(h.last(), &body); err != nil {
+			t.Errorf("%v: failed to decode payload %s: %v", tt.args, h.last(), err)
+		} else if body[tt.key] != tt.want {
+			t.Errorf("%v: expected %s %q, got %v", tt.args, tt.key, tt.want, body[tt.key])
+		}
+		restore()
+	}
+}
+
+func TestAbortTestSignalsOnce(t *testing.T) {
+	sigs := make(chan os.Signal, 2)
+	signal.Notify(sigs, syscall.SIGUSR1)
+	defer signal.Stop(sigs)
+	_, restore := setUp(t, "--alert", "global.errorRate < 1%", "--alert", "global.max < 50ms",
+		"--alert-min-samples", "1")
+	defer restore()
+	// Test process signals itself with a signal that is safe to receive
+	abortPID, abortSignal = os.Getpid(), syscall.SIGUSR1
+
+	addRequests(time.Unix(1790000000, 0), 0, 1)
+	// Both rules fire, but the test is aborted once
+	evaluate(time.Unix(1800000000, 0))
+
+	select {
+	case <-sigs:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected process to be signalled")
+	}
+	select {
+	case s := <-sigs:
+		t.Errorf("Expected a single signal, got another %v", s)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestInitRejectsInvalidSettings(t *testing.T) {
+	tests := [][]string{
+		{"--alert", "users.max < 10"},
+		{"--alert", "global.p95 < 800ms", "--alert-window", "0"},
+		{"--alert", "global.p95 < 800ms", "--alert-format", "email"},
+		{"--alert", "global.p95 < 800ms", "--alert-abort-signal", "HUP"},
+	}
+	for _, args := range tests {
+		cmd := &cobra.Command{Use: "test"}
+		flags.AddAlerting(cmd.Flags())
+		if err := cmd.ParseFlags(args); err != nil {
+			t.Fatal(err)
+		}
+		if err := Init(cmd); err == nil {
+			t.Errorf("%v: expected an error", args)
+		}
+	}
+	states = nil
+}
@@ -0,0 +1,192 @@
+/*
+Copyright © 2020 Anton Kramarev
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+package alert
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"text/template"
+	"time"
+
+	"github.com/dakaraj/gatling-to-influxdb/assertion"
+	l "github.com/dakaraj/gatling-to-influxdb/logger"
+	"github.com/spf13/cobra"
+)
+
+// Alert is a notification about a rule changing its state.
+// It is also a data passed to custom payload templates
+type Alert struct {
+	Status     string    `json:"status"`
+	Rule       string    `json:"rule"`
+	Scope      string    `json:"scope"`
+	Name       string    `json:"name,omitempty"`
+	Metric     string    `json:"metric"`
+	Actual     float64   `json:"actual"`
+	Threshold  float64   `json:"threshold"`
+	Window     string    `json:"window"`
+	TestID     string    `json:"testId"`
+	Simulation string    `json:"simulation"`
+	NodeName   string    `json:"nodeName"`
+	Time       time.Time `json:"time"`
+}
+
+// Summary returns a short human readable description of the alert
+func (a Alert) Summary() string {
+	if a.Status == statusResolved {
+		return fmt.Sprintf("RESOLVED: %s (actual: %.2f) in test %s", a.Rule, a.Actual, a.TestID)
+	}
+	return fmt.Sprintf("FIRING: %s is violated (actual: %.2f over last %s) in test %s", a.Rule, a.Actual, a.Window, a.TestID)
+}
+
+var (
+	webhookURLs []string
+	payload     func(Alert) ([]byte, error)
+	httpClient  = &http.Client{Timeout: 10 * time.Second}
+)
+
+func genericPayload(a Alert) ([]byte, error) {
+	return json.Marshal(a)
+}
+
+func slackPayload(a Alert) ([]byte, error) {
+	return json.Marshal(map[string]string{"text": a.Summary()})
+}
+
+func teamsPayload(a Alert) ([]byte, error) {
+	color := "D63232"
+	if a.Status == statusResolved {
+		color = "2EB886"
+	}
+	return json.Marshal(map[string]interface{}{
+		"@type":      "MessageCard",
+		"@context":   "http://schema.org/extensions",
+		"themeColor": color,
+		"summary":    a.Summary(),
+		"title":      fmt.Sprintf("g2i alert %s: %s", a.Status, a.TestID),
+		"sections": []map[string]interface{}{{
+			"activityTitle": a.Rule,
+			"facts": []map[string]string{
+				{"name": "Status", "value": a.Status},
+				{"name": "Actual", "value": fmt.Sprintf("%.2f", a.Actual)},
+				{"name": "Window", "value": a.Window},
+				{"name": "Simulation", "value": a.Simulation},
+				{"name": "Node", "value": a.NodeName},
+			},
+		}},
+	})
+}
+
+func templatePayload(path string) (func(Alert) ([]byte, error), error) {
+	t, err := template.New("payload").Funcs(template.FuncMap{
+		"json": func(v interface{}) (string, error) {
+			b, err := json.Marshal(v)
+			return string(b), err
+		},
+	}).ParseFiles(path)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse alert template: %w", err)
+	}
+	t = t.Templates()[0]
+
+	return func(a Alert) ([]byte, error) {
+		buf := new(bytes.Buffer)
+		err := t.Execute(buf, a)
+		return buf.Bytes(), err
+	}, nil
+}
+
+func initWebhook(cmd *cobra.Command) error {
+	webhookURLs, _ = cmd.Flags().GetStringArray("alert-webhook")
+	format, _ := cmd.Flags().GetString("alert-format")
+	tmpl, _ := cmd.Flags().GetString("alert-template")
+
+	if tmpl != "" {
+		var err error
+		payload, err = templatePayload(tmpl)
+		return err
+	}
+	switch format {
+	case "generic":
+		payload = genericPayload
+	case "slack":
+		payload = slackPayload
+	case "teams":
+		payload = teamsPayload
+	default:
+		return fmt.Errorf("Unknown alert format %q, expected one of: generic, slack, teams", format)
+	}
+
+	return nil
+}
+
+func post(url string, body []byte) error {
+	resp, err := httpClient.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("Webhook responded with %s: %s", resp.Status, msg)
+	}
+
+	return nil
+}
+
+func notify(status string, res assertion.Result, now time.Time) {
+	ti := currentTestInfo()
+	a := Alert{
+		Status:     status,
+		Rule:       res.Rule.Text,
+		Scope:      res.Rule.Scope,
+		Name:       res.Rule.Name,
+		Metric:     res.Rule.Metric,
+		Actual:     res.Actual,
+		Threshold:  res.Rule.Value,
+		Window:     (time.Duration(windowLen) * time.Second).String(),
+		TestID:     ti.testID,
+		Simulation: ti.simulationName,
+		NodeName:   ti.nodeName,
+		Time:       now.UTC(),
+	}
+	if status == statusFiring {
+		l.Errorln("Alert " + a.Summary())
+	} else {
+		l.Infoln("Alert " + a.Summary())
+	}
+
+	body, err := payload(a)
+	if err != nil {
+		l.Errorf("Failed to build alert payload: %v\n", err)
+		return
+	}
+	for _, u := range webhookURLs {
+		if err := post(u, body); err != nil {
+			l.Errorf("Failed to post alert to webhook: %v\n", err)
+		}
+	}
+}
@@ -0,0 +1,352 @@
+/*
+Copyright © 2020 Anton Kramarev
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+package assertion
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dakaraj/gatling-to-influxdb/influx"
+	l "github.com/dakaraj/gatling-to-influxdb/logger"
+	"github.com/dakaraj/gatling-to-influxdb/stats"
+	infc "github.com/influxdata/influxdb1-client/v2"
+	"github.com/spf13/cobra"
+)
+
+const (
+	kindDuration = iota
+	kindPercent
+	kindPlain
+)
+
+var (
+	// ErrFailed is returned when at least one of assertions did not pass
+	ErrFailed = errors.New("Assertions failed")
+
+	rulePattern = regexp.MustCompile(
+		`^\s*(global|users|(?:request|group)\s+"([^"]+)")\.([A-Za-z]+[0-9]*(?:\.[0-9]+)?)\s*(<=|>=|==|!=|<|>)\s*(-?[0-9]+(?:\.[0-9]+)?)\s*(ms|s|%)?\s*$`,
+	)
+	percentileMetric = regexp.MustCompile(`^p([0-9]+(?:\.[0-9]+)?)$`)
+
+	rules []Rule
+)
+
+// Rule is a single parsed assertion like `global.p95 < 800ms`
+type Rule struct {
+	Text   string
+	Scope  string
+	Name   string
+	Metric string
+	Op     string
+	Value  float64
+}
+
+// Result contains outcome of a single rule evaluation
+type Result struct {
+	Rule   Rule
+	Actual float64
+	Found  bool
+	Passed bool
+}
+
+func metricKind(scope, metric string) (int, error) {
+	if scope == "users" {
+		switch metric {
+		case "max", "total":
+			return kindPlain, nil
+		}
+		return 0, fmt.Errorf("Unknown users metric %q, expected one of: max, total", metric)
+	}
+
+	switch metric {
+	case "min", "max", "mean":
+		return kindDuration, nil
+	case "errorRate":
+		return kindPercent, nil
+	case "count", "ok", "ko", "rps":
+		return kindPlain, nil
+	}
+	if m := percentileMetric.FindStringSubmatch(metric); m != nil {
+		p, _ := strconv.ParseFloat(m[1], 64)
+		if p <= 0 || p > 100 {
+			return 0, fmt.Errorf("Percentile %q is out of range", metric)
+		}
+		return kindDuration, nil
+	}
+
+	return 0, fmt.Errorf("Unknown metric %q", metric)
+}
+
+// Parse builds a rule from its text representation
+func Parse(text string) (Rule, error) {
+	m := rulePattern.FindStringSubmatch(text)
+	if m == nil {
+		return Rule{}, fmt.Errorf("Assertion %q does not match format '<scope>.<metric> <operator> <value>'", text)
+	}
+
+	r := Rule{
+		Text:   strings.TrimSpace(text),
+		Scope:  strings.Fields(m[1])[0],
+		Name:   m[2],
+		Metric: m[3],
+		Op:     m[4],
+	}
+	kind, err := metricKind(r.Scope, r.Metric)
+	if err != nil {
+		return Rule{}, fmt.Errorf("Assertion %q is invalid: %w", text, err)
+	}
+	r.Value, _ = strconv.ParseFloat(m[5], 64)
+
+	unit := m[6]
+	switch {
+	case unit == "":
+	case kind == kindDuration && unit == "ms":
+	case kind == kindDuration && unit == "s":
+		r.Value *= 1000
+	case kind == kindPercent && unit == "%":
+	default:
+		return Rule{}, fmt.Errorf("Assertion %q is invalid: unit %q can't be used with metric %q", text, unit, r.Metric)
+	}
+
+	return r, nil
+}
+
+func summaryMetric(snap stats.Snapshot, s *stats.Summary, metric string) float64 {
+	switch metric {
+	case "min":
+		return float64(s.Min())
+	case "max":
+		return float64(s.Max())
+	case "mean":
+		return s.Mean()
+	case "errorRate":
+		return s.ErrorRate()
+	case "count":
+		return float64(s.Count())
+	case "ok":
+		return float64(s.OK())
+	case "ko":
+		return float64(s.KO())
+	case "rps":
+		return snap.RPS(s)
+	}
+	p, _ := strconv.ParseFloat(percentileMetric.FindStringSubmatch(metric)[1], 64)
+
+	return float64(s.Percentile(p))
+}
+
+func compare(actual float64, op string, expected float64) bool {
+	switch op {
+	case "<":
+		return actual < expected
+	case "<=":
+		return actual <= expected
+	case ">":
+		return actual > expected
+	case ">=":
+		return actual >= expected
+	case "==":
+		return actual == expected
+	case "!=":
+		return actual != expected
+	}
+
+	return false
+}
+
+// Summary returns statistics of requests or groups the rule refers to, or nil
+// if the rule is about users or there is no such data
+func (r Rule) Summary(snap stats.Snapshot) *stats.Summary {
+	switch r.Scope {
+	case "global":
+		return snap.Global
+	case "request":
+		return snap.Requests[r.Name]
+	case "group":
+		return snap.Groups[r.Name]
+	}
+
+	return nil
+}
+
+// Check evaluates a single rule against provided statistics
+func (r Rule) Check(snap stats.Snapshot) Result {
+	res := Result{Rule: r}
+
+	if r.Scope == "users" {
+		res.Found = true
+		switch r.Metric {
+		case "max":
+			res.Actual = float64(snap.Users.Max)
+		case "total":
+			res.Actual = float64(snap.Users.Started)
+		}
+		res.Passed = compare(res.Actual, r.Op, r.Value)
+		return res
+	}
+
+	// Assertion against missing data can never pass
+	s := r.Summary(snap)
+	if s == nil || s.Count() == 0 {
+		return res
+	}
+	res.Found = true
+	res.Actual = summaryMetric(snap, s, r.Metric)
+	res.Passed = compare(res.Actual, r.Op, r.Value)
+
+	return res
+}
+
+// ReadRulesFile reads rules from a file, one per line, skipping empty lines
+// and lines starting with #
+func ReadRulesFile(path string) ([]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to open rules file: %w", err)
+	}
+	defer file.Close()
+
+	var lines []string
+	s := bufio.NewScanner(file)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		lines = append(lines, line)
+	}
+	if err := s.Err(); err != nil {
+		return nil, fmt.Errorf("Failed to read rules file: %w", err)
+	}
+
+	return lines, nil
+}
+
+// Init parses all assertions provided with flags, so syntax errors are reported
+// before the test starts
+func Init(cmd *cobra.Command) error {
+	texts, _ := cmd.Flags().GetStringArray("assert")
+	if path, _ := cmd.Flags().GetString("assertions-file"); path != "" {
+		fromFile, err := ReadRulesFile(path)
+		if err != nil {
+			return err
+		}
+		texts = append(texts, fromFile...)
+	}
+
+	rules = make([]Rule, 0, len(texts))
+	for _, t := range texts {
+		r, err := Parse(t)
+		if err != nil {
+			return err
+		}
+		rules = append(rules, r)
+	}
+
+	return nil
+}
+
+// Enabled reports if there is at least one assertion to evaluate
+func Enabled() bool {
+	return len(rules) > 0
+}
+
+// Evaluate checks all configured rules against provided statistics
+func Evaluate(snap stats.Snapshot) []Result {
+	results := make([]Result, 0, len(rules))
+	for _, r := range rules {
+		results = append(results, r.Check(snap))
+	}
+
+	return results
+}
+
+// Report logs every result and returns an error wrapping ErrFailed
+// if any of assertions did not pass
+func Report(results []Result) error {
+	var failed int
+	for _, r := range results {
+		switch {
+		case !r.Found:
+			failed++
+			l.Errorf("Assertion failed: %s (no data found)\n", r.Rule.Text)
+		case !r.Passed:
+			failed++
+			l.Errorf("Assertion failed: %s (actual: %.2f)\n", r.Rule.Text, r.Actual)
+		default:
+			l.Infof("Assertion passed: %s (actual: %.2f)\n", r.Rule.Text, r.Actual)
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d assertions did not pass: %w", failed, len(results), ErrFailed)
+	}
+
+	return nil
+}
+
+// Points converts results to points of 'assertions' measurement
+func Points(results []Result, tags map[string]string, t time.Time) ([]*infc.Point, error) {
+	points := make([]*infc.Point, 0, len(results))
+	for _, r := range results {
+		result := "OK"
+		if !r.Passed {
+			result = "KO"
+		}
+		pt := map[string]string{
+			"scope":  r.Rule.Scope,
+			"metric": r.Rule.Metric,
+			"result": result,
+		}
+		if r.Rule.Name != "" {
+			pt["name"] = r.Rule.Name
+		}
+		for k, v := range tags {
+			pt[k] = v
+		}
+
+		p, err := influx.NewPoint(
+			"assertions",
+			pt,
+			map[string]interface{}{
+				"assertion": r.Rule.Text,
+				"operator":  r.Rule.Op,
+				"expected":  r.Rule.Value,
+				"actual":    r.Actual,
+				"found":     r.Found,
+			},
+			t,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("Error creating new point with assertion data: %w", err)
+		}
+		points = append(points, p)
+	}
+
+	return points, nil
+}
@@ -0,0 +1,182 @@
+/*
+Copyright © 2020 Anton Kramarev
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+package assertion
+
+import (
+	"errors"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/dakaraj/gatling-to-influxdb/stats"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		text string
+		want Rule
+	}{
+		{text: "global.p95 < 800ms", want: Rule{Scope: "global", Metric: "p95", Op: "<", Value: 800}},
+		{text: "  global.mean<=1.5s ", want: Rule{Scope: "global", Metric: "mean", Op: "<=", Value: 1500}},
+		{text: "global.p99.9 < 2s", want: Rule{Scope: "global", Metric: "p99.9", Op: "<", Value: 2000}},
+		{text: "global.max < 3000", want: Rule{Scope: "global", Metric: "max", Op: "<", Value: 3000}},
+		{text: `request "Home".errorRate < 5%`, want: Rule{Scope: "request", Name: "Home", Metric: "errorRate", Op: "<", Value: 5}},
+		{text: `group "Visit / Catalog".count >= 10`, want: Rule{Scope: "group", Name: "Visit / Catalog", Metric: "count", Op: ">=", Value: 10}},
+		{text: "global.rps != 0", want: Rule{Scope: "global", Metric: "rps", Op: "!=", Value: 0}},
+		{text: "global.ko == 0", want: Rule{Scope: "global", Metric: "ko", Op: "==", Value: 0}},
+		{text: "global.min > -1", want: Rule{Scope: "global", Metric: "min", Op: ">", Value: -1}},
+		{text: "users.max > 100", want: Rule{Scope: "users", Metric: "max", Op: ">", Value: 100}},
+		{text: "users.total >= 1000", want: Rule{Scope: "users", Metric: "total", Op: ">=", Value: 1000}},
+	}
+	for _, tt := range tests {
+		got, err := Parse(tt.text)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tt.text, err)
+			continue
+		}
+		tt.want.Text = got.Text
+		if got != tt.want {
+			t.Errorf("%s: expected %+v, got %+v", tt.text, tt.want, got)
+		}
+	}
+
+	if r, _ := Parse("  global.ok > 1 "); r.Text != "global.ok > 1" {
+		t.Errorf("Expected rule text to be trimmed, got %q", r.Text)
+	}
+}
+
+func TestParseRejectsInvalidRules(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+	}{
+		{name: "empty", text: ""},
+		{name: "no operator", text: "global.p95 800ms"},
+		{name: "no value", text: "global.p95 <"},
+		{name: "unknown scope", text: "node.p95 < 800ms"},
+		{name: "unquoted name", text: "request Home.p95 < 800ms"},
+		{name: "unknown metric", text: "global.median < 800ms"},
+		{name: "unknown users metric", text: "users.mean < 10"},
+		{name: "zero percentile", text: "global.p0 < 800ms"},
+		{name: "percentile over 100", text: "global.p101 < 800ms"},
+		{name: "unknown unit", text: "global.p95 < 800us"},
+		{name: "time unit of plain metric", text: "global.count > 10s"},
+		{name: "percent unit of plain metric", text: "global.rps > 10%"},
+		{name: "unit of users metric", text: "users.max < 100ms"},
+		{name: "time unit of error rate", text: "global.errorRate < 5ms"},
+		{name: "percent unit of duration", text: "global.p95 < 5%"},
+	}
+	for _, tt := range tests {
+		if r, err := Parse(tt.text); err == nil {
+			t.Errorf("%s: expected %q to be rejected, got %+v", tt.name, tt.text, r)
+		}
+	}
+}
+
+// testSnapshot returns statistics of a 10 seconds test: 10 Home requests of 10..100ms
+// with the slowest one failed, a single Pay request and a group
+func testSnapshot() stats.Snapshot {
+	start := time.Unix(1790000000, 0)
+	snap := stats.Snapshot{
+		Global:   stats.NewSummary(),
+		Requests: map[string]*stats.Summary{"Home": stats.NewSummary(), "Pay": stats.NewSummary(), "Empty": stats.NewSummary()},
+		Groups:   map[string]*stats.Summary{"Visit": stats.NewSummary()},
+		Users:    stats.Users{Max: 8, Started: 20},
+		Start:    start,
+		End:      start.Add(10 * time.Second),
+	}
+	for i := 1; i <= 10; i++ {
+		snap.Requests["Home"].Add(i*10, i < 10)
+	}
+	snap.Requests["Pay"].Add(500, true)
+	snap.Global.Merge(snap.Requests["Home"])
+	snap.Global.Merge(snap.Requests["Pay"])
+	snap.Groups["Visit"].Add(2000, true)
+
+	return snap
+}
+
+func TestCheck(t *testing.T) {
+	snap := testSnapshot()
+
+	tests := []struct {
+		text   string
+		actual float64
+		found  bool
+		passed bool
+	}{
+		{text: "global.count == 11", actual: 11, found: true, passed: true},
+		{text: "global.ok == 10", actual: 10, found: true, passed: true},
+		{text: "global.ko > 0", actual: 1, found: true, passed: true},
+		{text: "global.max < 0.5s", actual: 500, found: true, passed: false},
+		{text: "global.max <= 0.5s", actual: 500, found: true, passed: true},
+		{text: "global.rps >= 1.1", actual: 1.1, found: true, passed: true},
+		{text: `request "Home".min == 10`, actual: 10, found: true, passed: true},
+		{text: `request "Home".mean < 50ms`, actual: 55, found: true, passed: false},
+		{text: `request "Home".p50 <= 50ms`, actual: 50, found: true, passed: true},
+		{text: `request "Home".p90 < 90ms`, actual: 90, found: true, passed: false},
+		{text: `request "Home".p95 > 90`, actual: 100, found: true, passed: true},
+		{text: `request "Home".errorRate < 10%`, actual: 10, found: true, passed: false},
+		{text: `request "Home".errorRate != 0%`, actual: 10, found: true, passed: true},
+		{text: `group "Visit".p99 < 3s`, actual: 2000, found: true, passed: true},
+		{text: "users.max <= 8", actual: 8, found: true, passed: true},
+		{text: "users.total > 20", actual: 20, found: true, passed: false},
+		// Assertions against missing data never pass, whatever the condition is
+		{text: `request "Login".count == 0`},
+		{text: `request "Empty".count == 0`},
+		{text: `group "Home".count >= 0`},
+	}
+	for _, tt := range tests {
+		r, err := Parse(tt.text)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.text, err)
+		}
+		res := r.Check(snap)
+		if res.Found != tt.found || res.Passed != tt.passed || math.Abs(res.Actual-tt.actual) > 1e-9 {
+			t.Errorf("%s: expected found %v, passed %v, actual %v, got %v, %v, %v",
+				tt.text, tt.found, tt.passed, tt.actual, res.Found, res.Passed, res.Actual)
+		}
+	}
+}
+
+func TestReport(t *testing.T) {
+	snap := testSnapshot()
+	check := func(texts ...string) []Result {
+		var results []Result
+		for _, text := range texts {
+			r, err := Parse(text)
+			if err != nil {
+				t.Fatal(err)
+			}
+			results = append(results, r.Check(snap))
+		}
+		return results
+	}
+
+	if err := Report(check("global.count > 0", "users.max > 0")); err != nil {
+		t.Errorf("Expected passed assertions to report no error, got %v", err)
+	}
+	if err := Report(check("global.count > 0", `request "Login".count == 0`)); !errors.Is(err, ErrFailed) {
+		t.Errorf("Expected assertion without data to fail, got %v", err)
+	}
+}
@@ -0,0 +1,149 @@
+/*
+Copyright © 2020 Anton Kramarev
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/dakaraj/gatling-to-influxdb/compare"
+	"github.com/dakaraj/gatling-to-influxdb/influx"
+	"github.com/spf13/cobra"
+)
+
+// exitRegressionsFound is an exit code returned by compare command when candidate
+// test regressed against baseline and failing on regressions is requested
+const exitRegressionsFound = 3
+
+// errRegressionsFound is returned by compare command to exit with exitRegressionsFound
+// after deferred functions are done, so the report is fully written
+var errRegressionsFound = errors.New("Regressions found")
+
+// writeReportFile writes report to a file, closing errors are reported as write errors
+func writeReportFile(path string, writeReport func(io.Writer, compare.Report) error, report compare.Report) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("Failed to create output file: %w", err)
+	}
+	err = writeReport(file, report)
+	if cErr := file.Close(); err == nil {
+		err = cErr
+	}
+
+	return err
+}
+
+func runCompare(cmd *cobra.Command, args []string) error {
+	defer influx.CloseDBConnection()
+
+	baseline, _ := cmd.Flags().GetString("baseline")
+	candidate, _ := cmd.Flags().GetString("candidate")
+	format, _ := cmd.Flags().GetString("format")
+	output, _ := cmd.Flags().GetString("output")
+	write, _ := cmd.Flags().GetBool("write")
+	failOnRegression, _ := cmd.Flags().GetBool("fail-on-regression")
+
+	var t compare.Thresholds
+	t.LatencyIncrease, _ = cmd.Flags().GetFloat64("max-latency-increase")
+	t.ErrorRateIncrease, _ = cmd.Flags().GetFloat64("max-error-rate-increase")
+	t.ThroughputDecrease, _ = cmd.Flags().GetFloat64("max-throughput-decrease")
+
+	var writeReport func(io.Writer, compare.Report) error
+	switch format {
+	case "text":
+		writeReport = compare.WriteText
+	case "json":
+		writeReport = compare.WriteJSON
+	case "markdown":
+		writeReport = compare.WriteMarkdown
+	default:
+		return fmt.Errorf("Unknown output format %q, expected one of: text, json, markdown", format)
+	}
+
+	report, err := compare.Run(baseline, candidate, t)
+	if err != nil {
+		return err
+	}
+
+	if output != "" {
+		err = writeReportFile(output, writeReport, report)
+	} else {
+		err = writeReport(cmd.OutOrStdout(), report)
+	}
+	if err != nil {
+		return fmt.Errorf("Failed to write comparison report: %w", err)
+	}
+
+	if write {
+		points, err := compare.Points(report, time.Now())
+		if err != nil {
+			return err
+		}
+		influx.WritePoints(points)
+	}
+
+	if n := report.Regressions(); n > 0 && failOnRegression {
+		return fmt.Errorf("Candidate test %s has %d regression(s) against baseline %s: %w", candidate, n, baseline, errRegressionsFound)
+	}
+
+	return nil
+}
+
+var compareCmd = &cobra.Command{
+	Use: "compare",
+	Example: `g2i compare --baseline "MySimulation-41" --candidate "MySimulation-42" -f markdown -o report.md
+
+Will query statistics of both tests from InfluxDB, print a per-request diff
+to report.md and mark requests exceeding regression thresholds.`,
+	Short: "Compare results of two tests stored in InfluxDB",
+	Long: `Queries stored requests and groups data of baseline and candidate tests
+and produces a per-request diff of percentiles, throughput and error rates.`,
+	Args:         cobra.NoArgs,
+	SilenceUsage: true,
+	PreRunE: func(cmd *cobra.Command, args []string) error {
+		if err := influx.InitInfluxConnection(cmd); err != nil {
+			return fmt.Errorf("Failed to establish successful database connection: %w", err)
+		}
+		return nil
+	},
+	RunE: runCompare,
+}
+
+func init() {
+	compareCmd.Flags().String("baseline", "", "Test identifier of a baseline test")
+	compareCmd.Flags().String("candidate", "", "Test identifier of a candidate test")
+	compareCmd.Flags().StringP("format", "f", "text", "Output format: text, json or markdown")
+	compareCmd.Flags().StringP("output", "o", "", "File path to write report to instead of STDOUT")
+	compareCmd.Flags().Bool("write", false, "Write comparison results to 'comparisons' measurement")
+	compareCmd.Flags().Bool("fail-on-regression", false, "Exit with code 3 if any regression is found")
+	compareCmd.Flags().Float64("max-latency-increase", 10, "Allowed increase (%) of mean and percentiles")
+	compareCmd.Flags().Float64("max-error-rate-increase", 1, "Allowed increase (percentage points) of error rate")
+	compareCmd.Flags().Float64("max-throughput-decrease", 10, "Allowed decrease (%) of throughput")
+	compareCmd.MarkFlagRequired("baseline")
+	compareCmd.MarkFlagRequired("candidate")
+
+	rootCmd.AddCommand(compareCmd)
+}
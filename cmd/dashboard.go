@@ -0,0 +1,88 @@
+/*
+Copyright © 2020 Anton Kramarev
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/dakaraj/gatling-to-influxdb/dashboard"
+	"github.com/dakaraj/gatling-to-influxdb/influx"
+	"github.com/spf13/cobra"
+)
+
+func runDashboard(cmd *cobra.Command, args []string) error {
+	influx.InitSchema(cmd)
+
+	var conf dashboard.Config
+	conf.Title, _ = cmd.Flags().GetString("title")
+	conf.Language, _ = cmd.Flags().GetString("language")
+	conf.Bucket, _ = cmd.Flags().GetString("bucket")
+	conf.Datasource, _ = cmd.Flags().GetString("datasource")
+	output, _ := cmd.Flags().GetString("output")
+	if conf.Bucket == "" {
+		db, _ := cmd.Flags().GetString("database")
+		conf.Bucket = db + "/autogen"
+	}
+
+	w := cmd.OutOrStdout()
+	if output != "" {
+		file, err := os.Create(output)
+		if err != nil {
+			return fmt.Errorf("Failed to create output file: %w", err)
+		}
+		defer file.Close()
+		w = file
+	}
+
+	if err := dashboard.Write(w, conf); err != nil {
+		return fmt.Errorf("Failed to generate dashboard: %w", err)
+	}
+
+	return nil
+}
+
+var dashboardCmd = &cobra.Command{
+	Use: "dashboard",
+	Example: `g2i dashboard --language flux --bucket "gatling/autogen" -o g2i-dashboard.json
+
+Will write Grafana dashboard using Flux queries to g2i-dashboard.json,
+ready to be imported in Grafana.`,
+	Short: "Generate Grafana dashboard JSON for g2i data",
+	Long: `Generates Grafana dashboard with a test selector, test start / end annotations,
+response times, throughput, group durations, active users and errors panels
+based on measurements written by g2i.`,
+	Args:         cobra.NoArgs,
+	SilenceUsage: true,
+	RunE:         runDashboard,
+}
+
+func init() {
+	dashboardCmd.Flags().String("title", "Gatling (g2i)", "Dashboard title")
+	dashboardCmd.Flags().String("language", dashboard.LanguageInfluxQL, "Query language of Grafana data source: influxql or flux")
+	dashboardCmd.Flags().String("bucket", "", `Bucket for Flux queries (default "<database>/autogen")`)
+	dashboardCmd.Flags().String("datasource", "", "Grafana data source name, if not set it is requested on dashboard import")
+	dashboardCmd.Flags().StringP("output", "o", "", "File path to write dashboard to instead of STDOUT")
+
+	rootCmd.AddCommand(dashboardCmd)
+}
@@ -0,0 +1,224 @@
+/*
+Copyright © 2020 Anton Kramarev
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/dakaraj/gatling-to-influxdb/generator"
+	l "github.com/dakaraj/gatling-to-influxdb/logger"
+	"github.com/spf13/cobra"
+)
+
+// genConfig reads simulation configuration from a file and applies flags set explicitly on top of it
+func genConfig(cmd *cobra.Command) (generator.Config, error) {
+	cfg := generator.DefaultConfig()
+	if path, _ := cmd.Flags().GetString("config"); path != "" {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return cfg, fmt.Errorf("Failed to read simulation config: %w", err)
+		}
+		cfg = generator.Config{}
+		if err := json.Unmarshal(data, &cfg); err != nil {
+			return cfg, fmt.Errorf("Failed to parse simulation config: %w", err)
+		}
+	}
+
+	fs := cmd.Flags()
+	if fs.Changed("simulation") {
+		cfg.Simulation, _ = fs.GetString("simulation")
+	}
+	if fs.Changed("users") {
+		cfg.Users, _ = fs.GetInt("users")
+	}
+	if fs.Changed("iterations") {
+		iterations, _ := fs.GetInt("iterations")
+		cfg.SetIterations(iterations)
+	}
+	if fs.Changed("ko-rate") {
+		koRate, _ := fs.GetFloat64("ko-rate")
+		cfg.SetKORate(koRate)
+	}
+	if fs.Changed("ramp") {
+		cfg.Ramp.Profile, _ = fs.GetString("ramp")
+	}
+	if fs.Changed("ramp-duration") {
+		d, _ := fs.GetUint("ramp-duration")
+		cfg.Ramp.Duration.Duration = time.Duration(d) * time.Second
+	}
+	if fs.Changed("ramp-steps") {
+		cfg.Ramp.Steps, _ = fs.GetInt("ramp-steps")
+	}
+	if fs.Changed("seed") {
+		cfg.Seed, _ = fs.GetInt64("seed")
+	}
+	if cfg.Ramp.Profile == "" {
+		cfg.Ramp.Profile = generator.RampLinear
+	}
+	cfg.RealTime, _ = fs.GetBool("real-time")
+	if start, _ := fs.GetString("start"); start != "" {
+		t, err := time.Parse(time.RFC3339, start)
+		if err != nil {
+			return cfg, fmt.Errorf("Invalid start time, expected RFC3339 format: %w", err)
+		}
+		cfg.Start = t
+	}
+
+	return cfg, cfg.Validate()
+}
+
+// genResultsDir creates a directory named like Gatling names its results directories,
+// so live mode of g2i finds a log written to it
+func genResultsDir(root string, cfg generator.Config) (string, error) {
+	name := cfg.Simulation
+	if i := strings.LastIndex(name, "."); i >= 0 {
+		name = name[i+1:]
+	}
+	if name == "" {
+		name = "simulation"
+	}
+	start := cfg.Start
+	if cfg.RealTime || start.IsZero() {
+		start = time.Now()
+	}
+	dir := filepath.Join(root, fmt.Sprintf("%s-%s%03d", strings.ToLower(name), start.UTC().Format("20060102150405"), start.Nanosecond()/int(time.Millisecond)))
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", fmt.Errorf("Failed to create results directory: %w", err)
+	}
+
+	return filepath.Join(dir, "simulation.log"), nil
+}
+
+func runGen(cmd *cobra.Command, args []string) error {
+	cfg, err := genConfig(cmd)
+	if err != nil {
+		return err
+	}
+	if p, _ := cmd.Flags().GetBool("print-config"); p {
+		data, err := json.MarshalIndent(cfg, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintln(cmd.OutOrStdout(), string(data))
+		return err
+	}
+
+	output, _ := cmd.Flags().GetString("output")
+	resultsDir, _ := cmd.Flags().GetString("results-dir")
+	if output != "" && resultsDir != "" {
+		return errors.New("Only one of output and results-dir can be set")
+	}
+	if resultsDir != "" {
+		if output, err = genResultsDir(resultsDir, cfg); err != nil {
+			return err
+		}
+	}
+
+	var w io.Writer = cmd.OutOrStdout()
+	if output != "" {
+		file, err := os.Create(output)
+		if err != nil {
+			return fmt.Errorf("Failed to create output file: %w", err)
+		}
+		defer file.Close()
+		// Live mode only reads logs with permissions Gatling creates them with
+		if err := file.Chmod(0644); err != nil {
+			return fmt.Errorf("Failed to set output file permissions: %w", err)
+		}
+		w = file
+		l.Infof("Writing simulation log to %s\n", output)
+	}
+	if cfg.RealTime {
+		catchSignals()
+	}
+
+	res, err := generator.Write(ctx, w, cfg)
+	if errors.Is(err, context.Canceled) {
+		err = nil
+	}
+	if err != nil {
+		return fmt.Errorf("Failed to generate log: %w", err)
+	}
+	summary := fmt.Sprintf("Generated log of %d lines (%d users, %d requests, %d groups, %d errors) ending at %v\n",
+		res.Lines, res.Users, res.Requests, res.Groups, res.Errors, res.End.Format(time.RFC3339))
+	// Application log is written to STDOUT too, so it must not be mixed with a generated log
+	if output == "" {
+		fmt.Fprint(cmd.ErrOrStderr(), summary)
+	} else {
+		l.Infof("%s", summary)
+	}
+
+	return nil
+}
+
+var genCmd = &cobra.Command{
+	Use: "gen",
+	Example: `g2i gen --config shop.json --results-dir ./target/gatling --real-time
+
+Will create a results directory like Gatling does and write a simulation log
+described in shop.json to it, with every line written at the moment the event
+happens. It can be processed by g2i in live mode as a real test.
+
+g2i gen --print-config > shop.json
+
+Will write configuration of the default simulation, to be used as a start.`,
+	Short: "Generate synthetic Gatling simulation logs",
+	Long: `Writes a synthetic simulation.log in Gatling format. Simulation consists of
+scenarios with their own share of users, iterations, weighted request mix with
+response time ranges and error rates, and nested groups wrapping each iteration.
+Users are started according to a ramp profile: linear, instant, steps or random.
+The same seed always produces the same log, unless it is written in real time.
+
+Logs are written in Gatling 3.3 format, the only one g2i reads.`,
+	Args:         cobra.NoArgs,
+	SilenceUsage: true,
+	RunE:         runGen,
+}
+
+func init() {
+	genCmd.Flags().String("config", "", "JSON file describing simulation, see --print-config for its format")
+	genCmd.Flags().Bool("print-config", false, "Print simulation configuration as JSON instead of generating a log")
+	genCmd.Flags().StringP("output", "o", "", "File path to write log to instead of STDOUT")
+	genCmd.Flags().String("results-dir", "", "Create a Gatling like results directory here and write simulation.log to it")
+	genCmd.Flags().Bool("real-time", false, "Write every line when its event happens, simulating a running test")
+	genCmd.Flags().String("start", "", "Test start time in RFC3339 format, current time if empty. Ignored in real time mode")
+	genCmd.Flags().String("simulation", "", "Simulation class name, overrides configuration")
+	genCmd.Flags().Int("users", 100, "Amount of users, overrides configuration")
+	genCmd.Flags().Int("iterations", 10, "Amount of iterations of every scenario, overrides configuration")
+	genCmd.Flags().Float64("ko-rate", 0.02, "Share of failed requests of every request, overrides configuration")
+	genCmd.Flags().String("ramp", generator.RampLinear, "Ramp profile: linear, instant, steps or random, overrides configuration")
+	genCmd.Flags().Uint("ramp-duration", 60, "Time (seconds) all users are started within, overrides configuration")
+	genCmd.Flags().Int("ramp-steps", 5, "Amount of user batches of steps ramp profile, overrides configuration")
+	genCmd.Flags().Int64("seed", 1, "Seed of random values, overrides configuration")
+
+	rootCmd.AddCommand(genCmd)
+}
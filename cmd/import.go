@@ -0,0 +1,76 @@
+/*
+Copyright © 2020 Anton Kramarev
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/dakaraj/gatling-to-influxdb/flags"
+	"github.com/dakaraj/gatling-to-influxdb/influx"
+	l "github.com/dakaraj/gatling-to-influxdb/logger"
+	"github.com/dakaraj/gatling-to-influxdb/parser"
+	"github.com/spf13/cobra"
+)
+
+var importCmd = &cobra.Command{
+	Use: "import [path/to/logs...]",
+	Example: `g2i import ./node1/simulation.log ./node2/simulation.log -t "distributed-test-42"
+
+Will read both logs and write them to InfluxDB as a single test, ordering
+lines of all logs by time. Each log is tagged with its own nodeName, while
+users data is additionally combined across all nodes.`,
+	Short: "Write complete Gatling logs of one or several load generators to InfluxDB",
+	Long: `Imports already finished simulation logs. When several logs or directories
+containing simulation.log files are provided they are merged into a single test,
+which is useful for tests distributed across several load generators.`,
+	Args:         cobra.MinimumNArgs(1),
+	SilenceUsage: true,
+	PreRunE: func(cmd *cobra.Command, args []string) error {
+		if err := initProcessing(cmd); err != nil {
+			return err
+		}
+		if err := parser.InitWorkers(cmd); err != nil {
+			return err
+		}
+		if err := influx.InitInfluxConnection(cmd); err != nil {
+			return fmt.Errorf("Failed to establish successful database connection: %w", err)
+		}
+		catchSignals()
+		l.Infoln("Starting import...")
+
+		return nil
+	},
+	RunE: func(cmd *cobra.Command, args []string) error {
+		err := parser.RunImport(cmd, args)
+		exitOnFailedAssertions(err)
+
+		return err
+	},
+}
+
+func init() {
+	flags.AddProcessing(importCmd.Flags())
+	flags.AddImport(importCmd.Flags())
+
+	rootCmd.AddCommand(importCmd)
+}
@@ -0,0 +1,69 @@
+/*
+Copyright © 2020 Anton Kramarev
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/dakaraj/gatling-to-influxdb/flags"
+	"github.com/dakaraj/gatling-to-influxdb/influx"
+	"github.com/dakaraj/gatling-to-influxdb/relay"
+	"github.com/spf13/cobra"
+)
+
+var relayCmd = &cobra.Command{
+	Use: "relay",
+	Example: `g2i relay --listen :8087 -a http://influxdb:8086 -b gatling
+
+Will accept points from g2i agents started with '-a http://relay-host:8087'
+and write them to InfluxDB together with users merged across all agents.`,
+	Short: "Receive points from remote g2i agents and write them to InfluxDB",
+	Long: `Starts a server speaking InfluxDB HTTP API, so g2i agents that can't reach
+the database directly can use it as their InfluxDB address. Received points
+are forwarded to the database, users of all agents are merged into 'AllNodes'
+series and aggregated requests statistics are written to 'aggregates' measurement.`,
+	Args:         cobra.NoArgs,
+	SilenceUsage: true,
+	PreRunE: func(cmd *cobra.Command, args []string) error {
+		if err := relay.Init(cmd); err != nil {
+			return fmt.Errorf("Invalid relay settings: %w", err)
+		}
+		if err := influx.InitInfluxConnection(cmd); err != nil {
+			return fmt.Errorf("Failed to establish successful database connection: %w", err)
+		}
+		catchSignals()
+
+		return nil
+	},
+	RunE: func(cmd *cobra.Command, args []string) error {
+		defer influx.CloseDBConnection()
+
+		return relay.Run(cmd.Context())
+	},
+}
+
+func init() {
+	flags.AddRelay(relayCmd.Flags())
+
+	rootCmd.AddCommand(relayCmd)
+}
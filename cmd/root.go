@@ -24,6 +24,7 @@ package cmd
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
 	"os"
@@ -31,12 +32,20 @@ import (
 	"os/signal"
 	"syscall"
 
+	"github.com/dakaraj/gatling-to-influxdb/alert"
+	"github.com/dakaraj/gatling-to-influxdb/assertion"
+	"github.com/dakaraj/gatling-to-influxdb/flags"
+	"github.com/dakaraj/gatling-to-influxdb/grafana"
 	"github.com/dakaraj/gatling-to-influxdb/influx"
 	l "github.com/dakaraj/gatling-to-influxdb/logger"
 	"github.com/dakaraj/gatling-to-influxdb/parser"
 	"github.com/spf13/cobra"
 )
 
+// exitAssertionsFailed is an exit code returned when test results did not pass assertions,
+// so CI pipelines can distinguish SLA breaches from application errors
+const exitAssertionsFailed = 2
+
 var (
 	ctx    context.Context
 	cancel context.CancelFunc
@@ -51,6 +60,14 @@ func preRunSetup(cmd *cobra.Command, args []string) error {
 	// }
 	// // End of workaround
 
+	// Validate settings before waiting for a test to start
+	if err := initProcessing(cmd); err != nil {
+		return err
+	}
+	if err := alert.Init(cmd); err != nil {
+		return fmt.Errorf("Failed to set up alerting: %w", err)
+	}
+
 	// Check if InfluxDB connection is successfull before going to detached mode
 	err := influx.InitInfluxConnection(cmd)
 	if err != nil {
@@ -77,7 +94,39 @@ func preRunSetup(cmd *cobra.Command, args []string) error {
 		os.Exit(0)
 	}
 
-	// catcher of SIGINT SIGTERM signals
+	catchSignals()
+	l.Infoln("Starting application...")
+
+	return nil
+}
+
+// initProcessing validates settings shared by all commands that parse logs
+func initProcessing(cmd *cobra.Command) error {
+	if err := assertion.Init(cmd); err != nil {
+		return fmt.Errorf("Failed to parse assertions: %w", err)
+	}
+	if err := grafana.Init(cmd); err != nil {
+		return fmt.Errorf("Failed to set up Grafana integration: %w", err)
+	}
+	if err := parser.InitSampling(cmd); err != nil {
+		return fmt.Errorf("Invalid sampling settings: %w", err)
+	}
+	if err := parser.InitNormalization(cmd); err != nil {
+		return fmt.Errorf("Invalid name normalization settings: %w", err)
+	}
+	parser.InitGroups(cmd)
+	if err := parser.InitErrorClasses(cmd); err != nil {
+		return fmt.Errorf("Invalid error classification settings: %w", err)
+	}
+	if err := influx.InitProcessing(cmd); err != nil {
+		return fmt.Errorf("Invalid processing settings: %w", err)
+	}
+
+	return nil
+}
+
+// catchSignals cancels global context on SIGINT or SIGTERM, so all work left is finished safely
+func catchSignals() {
 	go func() {
 		c := make(chan os.Signal, 1)
 		signal.Notify(c, syscall.SIGINT, syscall.SIGTERM)
@@ -85,10 +134,14 @@ func preRunSetup(cmd *cobra.Command, args []string) error {
 		l.Infof("Received signal %v. Stopping application...\n", sig)
 		cancel()
 	}()
+}
 
-	l.Infoln("Starting application...")
-
-	return nil
+// exitOnFailedAssertions exits with a dedicated code if test results did not pass assertions
+func exitOnFailedAssertions(err error) {
+	if errors.Is(err, assertion.ErrFailed) {
+		l.Errorln(err)
+		os.Exit(exitAssertionsFailed)
+	}
 }
 
 // rootCmd represents the base command when called without any subcommands
@@ -107,7 +160,7 @@ complications of Graphite protocol.`,
 	PreRunE: preRunSetup,
 	Args:    cobra.ExactArgs(1),
 	Run: func(cmd *cobra.Command, args []string) {
-		parser.RunMain(cmd, args[0])
+		exitOnFailedAssertions(parser.RunMain(cmd, args[0]))
 	},
 }
 
@@ -115,7 +168,7 @@ complications of Graphite protocol.`,
 // This is called by main.main(). It only needs to happen once to the rootCmd.
 func Execute() {
 	// Initiating logger before any other processes start
-	logPath, _ := rootCmd.Flags().GetString("log")
+	logPath, _ := rootCmd.PersistentFlags().GetString("log")
 	err := l.InitLogger(logPath)
 	if err != nil {
 		log.Fatalf("Failed to init application logger: %v\n", err)
@@ -123,6 +176,9 @@ func Execute() {
 
 	if err := rootCmd.ExecuteContext(ctx); err != nil {
 		l.Errorln(err)
+		if errors.Is(err, errRegressionsFound) {
+			os.Exit(exitRegressionsFound)
+		}
 		os.Exit(1)
 	}
 }
@@ -131,14 +187,11 @@ func init() {
 	rootCmd.Flags().BoolP("help", "h", false, "Display this help for g2i application")
 	rootCmd.Flags().BoolP("version", "v", false, "Display current g2i application version")
 	rootCmd.Flags().BoolP("detached", "d", false, "Run application in background. Returns [PID] on start")
-	rootCmd.Flags().StringP("address", "a", "http://localhost:8086", "HTTP address and port of InfluxDB instance")
-	rootCmd.Flags().StringP("username", "u", "", "Username credential for InfluxDB instance")
-	rootCmd.Flags().StringP("password", "p", "", "Password credential for InfluxDB instance")
-	rootCmd.Flags().StringP("database", "b", "gatling", "Database name in InfluxDB")
-	rootCmd.Flags().StringP("log", "l", "./log/g2i.log", "File path to application log file")
-	rootCmd.Flags().StringP("test-id", "t", "", "Unique test identifier")
+	flags.AddConnection(rootCmd.PersistentFlags())
+	rootCmd.PersistentFlags().StringP("log", "l", "./log/g2i.log", "File path to application log file")
 	rootCmd.Flags().UintP("stop-timeout", "s", 60, "Time (seconds) to exit if no new log lines found")
-	rootCmd.Flags().UintP("max-batch-size", "m", 5000, "Max points batch size to sent to InfluxDB")
+	flags.AddProcessing(rootCmd.Flags())
+	flags.AddAlerting(rootCmd.Flags())
 
 	// set up global context
 	ctx, cancel = context.WithCancel(context.Background())
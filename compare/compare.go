@@ -0,0 +1,299 @@
+/*
+Copyright © 2020 Anton Kramarev
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+package compare
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/dakaraj/gatling-to-influxdb/influx"
+	l "github.com/dakaraj/gatling-to-influxdb/logger"
+	infc "github.com/influxdata/influxdb1-client/v2"
+)
+
+const (
+	statusOK         = "ok"
+	statusRegression = "regression"
+	statusNew        = "new"
+	statusMissing    = "missing"
+)
+
+// Thresholds define how much worse a candidate may be before it is reported as a regression
+type Thresholds struct {
+	// LatencyIncrease is an allowed increase of mean and percentiles in percents
+	LatencyIncrease float64 `json:"latencyIncrease"`
+	// ErrorRateIncrease is an allowed increase of error rate in percentage points
+	ErrorRateIncrease float64 `json:"errorRateIncrease"`
+	// ThroughputDecrease is an allowed decrease of throughput in percents
+	ThroughputDecrease float64 `json:"throughputDecrease"`
+}
+
+// Diff contains comparison of a single request or group between two tests
+type Diff struct {
+	Kind        string                 `json:"kind"`
+	Name        string                 `json:"name"`
+	Status      string                 `json:"status"`
+	Baseline    influx.AggregatedStats `json:"baseline"`
+	Candidate   influx.AggregatedStats `json:"candidate"`
+	Regressions []string               `json:"regressions,omitempty"`
+}
+
+// Report is a full result of comparison between two tests
+type Report struct {
+	Baseline   string     `json:"baseline"`
+	Candidate  string     `json:"candidate"`
+	Thresholds Thresholds `json:"thresholds"`
+	Diffs      []Diff     `json:"diffs"`
+}
+
+// Regressions returns amount of requests and groups that regressed
+func (r Report) Regressions() int {
+	var n int
+	for _, d := range r.Diffs {
+		if d.Status == statusRegression {
+			n++
+		}
+	}
+
+	return n
+}
+
+// change returns relative change between two values in percents
+func change(base, cand float64) float64 {
+	if base == 0 {
+		return 0
+	}
+	return (cand - base) / base * 100
+}
+
+func (d *Diff) check(t Thresholds) {
+	latencies := []struct {
+		name       string
+		base, cand float64
+	}{
+		{"mean", d.Baseline.Mean, d.Candidate.Mean},
+		{"p50", d.Baseline.P50, d.Candidate.P50},
+		{"p90", d.Baseline.P90, d.Candidate.P90},
+		{"p95", d.Baseline.P95, d.Candidate.P95},
+		{"p99", d.Baseline.P99, d.Candidate.P99},
+	}
+	for _, m := range latencies {
+		if c := change(m.base, m.cand); c > t.LatencyIncrease {
+			d.Regressions = append(d.Regressions, fmt.Sprintf("%s +%.1f%%", m.name, c))
+		}
+	}
+	if c := d.Candidate.ErrorRate() - d.Baseline.ErrorRate(); c > t.ErrorRateIncrease {
+		d.Regressions = append(d.Regressions, fmt.Sprintf("errorRate +%.2fpp", c))
+	}
+	if c := change(d.Baseline.RPS, d.Candidate.RPS); -c > t.ThroughputDecrease {
+		d.Regressions = append(d.Regressions, fmt.Sprintf("rps %.1f%%", c))
+	}
+
+	d.Status = statusOK
+	if len(d.Regressions) > 0 {
+		d.Status = statusRegression
+	}
+}
+
+func diff(kind string, base, cand map[string]influx.AggregatedStats, t Thresholds) []Diff {
+	names := make(map[string]struct{}, len(base)+len(cand))
+	for n := range base {
+		names[n] = struct{}{}
+	}
+	for n := range cand {
+		names[n] = struct{}{}
+	}
+	sorted := make([]string, 0, len(names))
+	for n := range names {
+		sorted = append(sorted, n)
+	}
+	sort.Strings(sorted)
+
+	diffs := make([]Diff, 0, len(sorted))
+	for _, n := range sorted {
+		b, inBase := base[n]
+		c, inCand := cand[n]
+		d := Diff{Kind: kind, Name: n, Baseline: b, Candidate: c}
+		switch {
+		case !inBase:
+			d.Status = statusNew
+		case !inCand:
+			d.Status = statusMissing
+		default:
+			d.check(t)
+		}
+		diffs = append(diffs, d)
+	}
+
+	return diffs
+}
+
+// warnSampled logs a warning if a test was written with sampling, as its response times
+// are calculated from a part of OK requests where slow ones and failures are overrepresented
+func warnSampled(testID string, s map[string]influx.AggregatedStats) {
+	for _, v := range s {
+		if v.Sampled {
+			l.Infof("Test %s was written with sampling, its response times are approximate\n", testID)
+			return
+		}
+	}
+}
+
+// Run queries statistics of both tests from InfluxDB and compares them
+func Run(baseline, candidate string, t Thresholds) (Report, error) {
+	r := Report{Baseline: baseline, Candidate: candidate, Thresholds: t}
+	sources := []struct {
+		kind, measurement, field string
+	}{
+		{"request", "requests", "duration"},
+		{"group", "groups", "totalDuration"},
+	}
+	for _, s := range sources {
+		base, err := influx.QueryAggregatedStats(s.measurement, s.field, baseline)
+		if err != nil {
+			return r, fmt.Errorf("Failed to query %s of baseline test: %w", s.measurement, err)
+		}
+		cand, err := influx.QueryAggregatedStats(s.measurement, s.field, candidate)
+		if err != nil {
+			return r, fmt.Errorf("Failed to query %s of candidate test: %w", s.measurement, err)
+		}
+		warnSampled(baseline, base)
+		warnSampled(candidate, cand)
+		r.Diffs = append(r.Diffs, diff(s.kind, base, cand, t)...)
+	}
+	if len(r.Diffs) == 0 {
+		return r, fmt.Errorf("No data found for tests %q and %q", baseline, candidate)
+	}
+
+	return r, nil
+}
+
+func formatChange(base, cand float64, precision int) string {
+	return fmt.Sprintf("%.*f → %.*f (%+.1f%%)", precision, base, precision, cand, change(base, cand))
+}
+
+func row(d Diff) []string {
+	return []string{
+		d.Kind,
+		d.Name,
+		fmt.Sprintf("%d → %d", d.Baseline.Count, d.Candidate.Count),
+		formatChange(d.Baseline.P50, d.Candidate.P50, 0),
+		formatChange(d.Baseline.P95, d.Candidate.P95, 0),
+		formatChange(d.Baseline.P99, d.Candidate.P99, 0),
+		fmt.Sprintf("%.2f%% → %.2f%%", d.Baseline.ErrorRate(), d.Candidate.ErrorRate()),
+		formatChange(d.Baseline.RPS, d.Candidate.RPS, 2),
+		d.Status,
+		strings.Join(d.Regressions, ", "),
+	}
+}
+
+var header = []string{"Kind", "Name", "Count", "p50 (ms)", "p95 (ms)", "p99 (ms)", "Error rate", "RPS", "Status", "Details"}
+
+// WriteText writes report as a human readable table
+func WriteText(w io.Writer, r Report) error {
+	fmt.Fprintf(w, "Baseline: %s\nCandidate: %s\n\n", r.Baseline, r.Candidate)
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, strings.Join(header, "\t"))
+	for _, d := range r.Diffs {
+		fmt.Fprintln(tw, strings.Join(row(d), "\t"))
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	_, err := fmt.Fprintf(w, "\n%d regression(s) found\n", r.Regressions())
+
+	return err
+}
+
+// WriteMarkdown writes report as a Markdown table
+func WriteMarkdown(w io.Writer, r Report) error {
+	fmt.Fprintf(w, "## Comparison of `%s` (candidate) against `%s` (baseline)\n\n", r.Candidate, r.Baseline)
+	fmt.Fprintf(w, "| %s |\n", strings.Join(header, " | "))
+	fmt.Fprintf(w, "|%s\n", strings.Repeat(" --- |", len(header)))
+	for _, d := range r.Diffs {
+		cells := row(d)
+		for i, c := range cells {
+			cells[i] = strings.ReplaceAll(c, "|", `\|`)
+		}
+		fmt.Fprintf(w, "| %s |\n", strings.Join(cells, " | "))
+	}
+	_, err := fmt.Fprintf(w, "\n**%d regression(s) found**\n", r.Regressions())
+
+	return err
+}
+
+// WriteJSON writes report as an indented JSON document
+func WriteJSON(w io.Writer, r Report) error {
+	e := json.NewEncoder(w)
+	e.SetIndent("", "  ")
+
+	return e.Encode(r)
+}
+
+// Points converts report to points of 'comparisons' measurement
+func Points(r Report, t time.Time) ([]*infc.Point, error) {
+	points := make([]*infc.Point, 0, len(r.Diffs))
+	for _, d := range r.Diffs {
+		p, err := influx.NewPoint(
+			"comparisons",
+			map[string]string{
+				"baseline":  r.Baseline,
+				"candidate": r.Candidate,
+				"kind":      d.Kind,
+				"name":      d.Name,
+				"status":    d.Status,
+			},
+			map[string]interface{}{
+				"baselineCount":      d.Baseline.Count,
+				"candidateCount":     d.Candidate.Count,
+				"baselineMean":       d.Baseline.Mean,
+				"candidateMean":      d.Candidate.Mean,
+				"baselineP50":        d.Baseline.P50,
+				"candidateP50":       d.Candidate.P50,
+				"baselineP90":        d.Baseline.P90,
+				"candidateP90":       d.Candidate.P90,
+				"baselineP95":        d.Baseline.P95,
+				"candidateP95":       d.Candidate.P95,
+				"baselineP99":        d.Baseline.P99,
+				"candidateP99":       d.Candidate.P99,
+				"baselineErrorRate":  d.Baseline.ErrorRate(),
+				"candidateErrorRate": d.Candidate.ErrorRate(),
+				"baselineRps":        d.Baseline.RPS,
+				"candidateRps":       d.Candidate.RPS,
+				"regressions":        strings.Join(d.Regressions, ", "),
+			},
+			t,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("Error creating new point with comparison data: %w", err)
+		}
+		points = append(points, p)
+	}
+
+	return points, nil
+}
@@ -0,0 +1,292 @@
+/*
+Copyright © 2020 Anton Kramarev
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+package compare
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/dakaraj/gatling-to-influxdb/flags"
+	"github.com/dakaraj/gatling-to-influxdb/influx"
+	"github.com/dakaraj/gatling-to-influxdb/influx/influxtest"
+	"github.com/spf13/cobra"
+)
+
+var defaultThresholds = Thresholds{LatencyIncrease: 10, ErrorRateIncrease: 1, ThroughputDecrease: 10}
+
+// setUp connects to a fake database, returned function closes connection and stops it
+func setUp(t *testing.T) (*influxtest.Server, func()) {
+	srv := influxtest.NewServer("gatling")
+	cmd := &cobra.Command{Use: "test"}
+	flags.AddConnection(cmd.Flags())
+	if err := cmd.ParseFlags([]string{"--address", srv.URL}); err != nil {
+		t.Fatalf("Failed to parse flags: %v", err)
+	}
+	if err := influx.InitInfluxConnection(cmd); err != nil {
+		srv.Close()
+		t.Fatalf("Failed to connect: %v", err)
+	}
+
+	return srv, func() {
+		influx.CloseDBConnection()
+		srv.Close()
+	}
+}
+
+// storedRequest describes statistics of a request the fake database responds with
+type storedRequest struct {
+	name     string
+	count    int
+	ko       int
+	duration float64
+	// weight is a sum of weight field, nil for requests written without it
+	weight interface{}
+}
+
+// respondWith makes the fake database answer statistics queries of a test. All
+// durations but mean and max are the same, test lasts for a minute
+func respondWith(srv *influxtest.Server, testID string, requests ...storedRequest) {
+	test := "'" + testID + "'"
+	var stats, ko []influxtest.Series
+	for _, r := range requests {
+		d := r.duration
+		stats = append(stats, influxtest.Series{
+			Name:    "requests",
+			Tags:    map[string]string{"name": r.name},
+			Columns: []string{"time", "count", "mean", "percentile", "percentile_1", "percentile_2", "percentile_3", "max", "sum"},
+			Values:  [][]interface{}{{0, r.count, d * 0.9, d, d, d, d, d * 2, r.weight}},
+		})
+		ko = append(ko, influxtest.Series{
+			Name:    "requests",
+			Tags:    map[string]string{"name": r.name},
+			Columns: []string{"time", "count"},
+			Values:  [][]interface{}{{0, r.ko}},
+		})
+	}
+	srv.Respond(ko, `FROM "requests"`, test, `'KO'`)
+	srv.Respond(stats, `FROM "requests"`, test, "percentile(")
+	srv.Respond([]influxtest.Series{{Name: "requests", Columns: []string{"time", "first"}, Values: [][]interface{}{{1790000000000, 10}}}},
+		`FROM "requests"`, test, "SELECT first(")
+	srv.Respond([]influxtest.Series{{Name: "requests", Columns: []string{"time", "last"}, Values: [][]interface{}{{1790000060000, 10}}}},
+		`FROM "requests"`, test, "SELECT last(")
+}
+
+func TestRunClassifiesRequests(t *testing.T) {
+	srv, restore := setUp(t)
+	defer restore()
+	respondWith(srv, "base",
+		storedRequest{name: "Home", count: 600, ko: 6, duration: 100},
+		storedRequest{name: "Item", count: 600, ko: 6, duration: 100},
+		storedRequest{name: "Cart", count: 600, duration: 100},
+		storedRequest{name: "Pay", count: 600, duration: 100},
+		storedRequest{name: "Logout", count: 60, duration: 10},
+	)
+	respondWith(srv, "cand",
+		// Within thresholds
+		storedRequest{name: "Home", count: 560, ko: 11, duration: 110},
+		// Latency regression
+		storedRequest{name: "Item", count: 600, ko: 6, duration: 111},
+		// Error rate regression
+		storedRequest{name: "Cart", count: 600, ko: 7, duration: 100},
+		// Throughput regression, sampled points stand for more requests
+		storedRequest{name: "Pay", count: 100, duration: 90, weight: 500.0},
+		storedRequest{name: "Login", count: 60, duration: 10},
+	)
+
+	r, err := Run("base", "cand", defaultThresholds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []struct {
+		name        string
+		status      string
+		regressions []string
+	}{
+		{name: "Cart", status: statusRegression, regressions: []string{"errorRate +1.17pp"}},
+		{name: "Home", status: statusOK},
+		{name: "Item", status: statusRegression, regressions: []string{"mean +11.0%", "p50 +11.0%", "p90 +11.0%", "p95 +11.0%", "p99 +11.0%"}},
+		{name: "Login", status: statusNew},
+		{name: "Logout", status: statusMissing},
+		{name: "Pay", status: statusRegression, regressions: []string{"rps -16.7%"}},
+	}
+	if len(r.Diffs) != len(want) {
+		t.Fatalf("Expected %d diffs, got %d: %+v", len(want), len(r.Diffs), r.Diffs)
+	}
+	for i, w := range want {
+		d := r.Diffs[i]
+		if d.Kind != "request" || d.Name != w.name || d.Status != w.status || !reflect.DeepEqual(d.Regressions, w.regressions) {
+			t.Errorf("Diff %d: expected %s %s %v, got %s %s %s %v", i, w.name, w.status, w.regressions, d.Kind, d.Name, d.Status, d.Regressions)
+		}
+	}
+	if r.Regressions() != 3 {
+		t.Errorf("Expected 3 regressions, got %d", r.Regressions())
+	}
+
+	pay := r.Diffs[5].Candidate
+	if pay.Count != 500 || !pay.Sampled || pay.RPS < 8.33 || pay.RPS > 8.34 {
+		t.Errorf("Expected 500 weighted requests at 8.33 rps, got %+v", pay)
+	}
+}
+
+func TestRunWithoutData(t *testing.T) {
+	_, restore := setUp(t)
+	defer restore()
+
+	if _, err := Run("base", "cand", defaultThresholds); err == nil {
+		t.Error("Expected an error when no data is found")
+	}
+}
+
+func TestCheckThresholds(t *testing.T) {
+	base := influx.AggregatedStats{Count: 1000, KO: 10, Mean: 100, P50: 100, P90: 100, P95: 100, P99: 100, RPS: 10}
+	tests := []struct {
+		name        string
+		cand        influx.AggregatedStats
+		regressions []string
+	}{
+		{name: "same", cand: base},
+		{name: "at thresholds", cand: influx.AggregatedStats{Count: 1000, KO: 20, Mean: 110, P50: 110, P90: 110, P95: 110, P99: 110, RPS: 9}},
+		{name: "faster and more stable", cand: influx.AggregatedStats{Count: 2000, Mean: 50, P50: 50, P90: 50, P95: 50, P99: 50, RPS: 20}},
+		{name: "single percentile", cand: influx.AggregatedStats{Count: 1000, KO: 10, Mean: 100, P50: 100, P90: 100, P95: 100, P99: 150, RPS: 10},
+			regressions: []string{"p99 +50.0%"}},
+		{name: "all metrics", cand: influx.AggregatedStats{Count: 1000, KO: 50, Mean: 200, P50: 200, P90: 200, P95: 200, P99: 200, RPS: 5},
+			regressions: []string{"mean +100.0%", "p50 +100.0%", "p90 +100.0%", "p95 +100.0%", "p99 +100.0%", "errorRate +4.00pp", "rps -50.0%"}},
+	}
+	for _, tt := range tests {
+		d := Diff{Baseline: base, Candidate: tt.cand}
+		d.check(defaultThresholds)
+		if !reflect.DeepEqual(d.Regressions, tt.regressions) {
+			t.Errorf("%s: expected regressions %v, got %v", tt.name, tt.regressions, d.Regressions)
+		}
+		if status := map[bool]string{true: statusRegression, false: statusOK}[len(tt.regressions) > 0]; d.Status != status {
+			t.Errorf("%s: expected status %s, got %s", tt.name, status, d.Status)
+		}
+	}
+
+	// Zero baseline values can't be compared relatively
+	d := Diff{Baseline: influx.AggregatedStats{Count: 1}, Candidate: base}
+	d.check(defaultThresholds)
+	if d.Status != statusOK {
+		t.Errorf("Expected no latency or throughput regressions against zero baseline, got %v", d.Regressions)
+	}
+}
+
+// testReport returns a report with a regressed request whose name needs escaping in Markdown
+func testReport() Report {
+	base := influx.AggregatedStats{Count: 100, KO: 1, Mean: 90, P50: 100, P90: 110, P95: 120, P99: 130, Max: 200, RPS: 10}
+	cand := influx.AggregatedStats{Count: 100, KO: 1, Mean: 150, P50: 150, P90: 110, P95: 120, P99: 130, Max: 200, RPS: 10}
+	d := Diff{Kind: "request", Name: "Search | Books", Baseline: base, Candidate: cand}
+	d.check(defaultThresholds)
+
+	return Report{
+		Baseline:   "base",
+		Candidate:  "cand",
+		Thresholds: defaultThresholds,
+		Diffs: []Diff{
+			d,
+			{Kind: "group", Name: "Checkout", Status: statusNew, Candidate: base},
+		},
+	}
+}
+
+func TestWriteJSON(t *testing.T) {
+	r := testReport()
+	var buf bytes.Buffer
+	if err := WriteJSON(&buf, r); err != nil {
+		t.Fatal(err)
+	}
+
+	var got Report
+	if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+		t.Fatalf("Failed to decode report: %v", err)
+	}
+	if !reflect.DeepEqual(got, r) {
+		t.Errorf("Expected decoded report to match written one:\n%+v\n%+v", r, got)
+	}
+	var raw struct {
+		Diffs []map[string]interface{} `json:"diffs"`
+	}
+	json.Unmarshal(buf.Bytes(), &raw)
+	if _, found := raw.Diffs[1]["regressions"]; found {
+		t.Error("Expected empty regressions to be omitted")
+	}
+}
+
+func TestWriteMarkdown(t *testing.T) {
+	var buf bytes.Buffer
+	if err := WriteMarkdown(&buf, testReport()); err != nil {
+		t.Fatal(err)
+	}
+
+	want := "## Comparison of `cand` (candidate) against `base` (baseline)\n\n" +
+		"| Kind | Name | Count | p50 (ms) | p95 (ms) | p99 (ms) | Error rate | RPS | Status | Details |\n" +
+		"| --- | --- | --- | --- | --- | --- | --- | --- | --- | --- |\n" +
+		`| request | Search \| Books | 100 → 100 | 100 → 150 (+50.0%) | 120 → 120 (+0.0%) | 130 → 130 (+0.0%) | 1.00% → 1.00% | 10.00 → 10.00 (+0.0%) | regression | mean +66.7%, p50 +50.0% |` + "\n" +
+		"| group | Checkout | 0 → 100 | 0 → 100 (+0.0%) | 0 → 120 (+0.0%) | 0 → 130 (+0.0%) | 0.00% → 1.00% | 0.00 → 10.00 (+0.0%) | new |  |\n" +
+		"\n**1 regression(s) found**\n"
+	if got := buf.String(); got != want {
+		t.Errorf("Unexpected Markdown report:\n%s\nexpected:\n%s", got, want)
+	}
+}
+
+func TestWriteText(t *testing.T) {
+	var buf bytes.Buffer
+	if err := WriteText(&buf, testReport()); err != nil {
+		t.Fatal(err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 8 || lines[0] != "Baseline: base" || lines[1] != "Candidate: cand" || lines[7] != "1 regression(s) found" {
+		t.Fatalf("Unexpected text report:\n%s", buf.String())
+	}
+	// Columns are aligned by characters, arrows take several bytes
+	column := func(line, s string) int {
+		return utf8.RuneCountInString(line[:strings.Index(line, s)])
+	}
+	if h, r := column(lines[3], "Status"), column(lines[4], "regression"); h != r {
+		t.Errorf("Expected status column at %d, got %d:\n%s", h, r, buf.String())
+	}
+}
+
+func TestPoints(t *testing.T) {
+	points, err := Points(testReport(), time.Unix(1790000000, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(points) != 2 {
+		t.Fatalf("Expected 2 points, got %d", len(points))
+	}
+	tags := points[0].Tags()
+	fields, _ := points[0].Fields()
+	if tags["name"] != "Search | Books" || tags["status"] != statusRegression || tags["baseline"] != "base" {
+		t.Errorf("Unexpected tags %v", tags)
+	}
+	if fields["candidateP50"] != 150.0 || fields["regressions"] != "mean +66.7%, p50 +50.0%" {
+		t.Errorf("Unexpected fields %v", fields)
+	}
+}
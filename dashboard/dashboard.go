@@ -0,0 +1,352 @@
+/*
+Copyright © 2020 Anton Kramarev
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+package dashboard
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/dakaraj/gatling-to-influxdb/influx"
+)
+
+const (
+	// LanguageInfluxQL generates queries for InfluxQL data sources
+	LanguageInfluxQL = "influxql"
+	// LanguageFlux generates queries for Flux data sources
+	LanguageFlux = "flux"
+
+	datasourceInput = "${DS_INFLUXDB}"
+	panelWidth      = 12
+	panelHeight     = 9
+)
+
+// Config contains settings of a generated dashboard
+type Config struct {
+	Title    string
+	Language string
+	// Bucket is used by Flux queries, usually "<database>/<retention policy>"
+	Bucket string
+	// Datasource is a name of Grafana data source, if empty it is requested on import
+	Datasource string
+}
+
+type target struct {
+	RefID        string `json:"refId"`
+	Query        string `json:"query"`
+	RawQuery     bool   `json:"rawQuery,omitempty"`
+	ResultFormat string `json:"resultFormat,omitempty"`
+	Alias        string `json:"alias,omitempty"`
+}
+
+type gridPos struct {
+	H int `json:"h"`
+	W int `json:"w"`
+	X int `json:"x"`
+	Y int `json:"y"`
+}
+
+type panel struct {
+	ID          int                    `json:"id"`
+	Type        string                 `json:"type"`
+	Title       string                 `json:"title"`
+	Datasource  string                 `json:"datasource"`
+	GridPos     gridPos                `json:"gridPos"`
+	Targets     []target               `json:"targets"`
+	FieldConfig map[string]interface{} `json:"fieldConfig"`
+}
+
+// queries holds both flavours of a single query
+type queries struct {
+	influxQL string
+	flux     string
+	alias    string
+}
+
+type generator struct {
+	conf Config
+	ds   string
+}
+
+func (g generator) m(name string) string {
+	return influx.Measurement(name)
+}
+
+func (g generator) target(refID string, q queries, format string) target {
+	if g.conf.Language == LanguageFlux {
+		return target{RefID: refID, Query: q.flux}
+	}
+	return target{RefID: refID, Query: q.influxQL, RawQuery: true, ResultFormat: format, Alias: q.alias}
+}
+
+func (g generator) fluxFrom(measurement, filter string) string {
+	return fmt.Sprintf(
+		"from(bucket: %q)\n  |> range(start: v.timeRangeStart, stop: v.timeRangeStop)\n"+
+			"  |> filter(fn: (r) => r._measurement == %q and r.testId == \"${testId}\"%s)",
+		g.conf.Bucket, g.m(measurement), filter,
+	)
+}
+
+func (g generator) influxQLWhere() string {
+	return `"testId" = '$testId' AND $timeFilter`
+}
+
+// usersQueries sum active users of every node per scenario. Series combining
+// all nodes or all scenarios are skipped, so they are not mixed with per node ones
+func (g generator) usersQueries() queries {
+	return queries{
+		influxQL: fmt.Sprintf(
+			`SELECT sum("active") FROM (SELECT last("active") AS "active" FROM %s WHERE %s AND "nodeName" != '%s' AND "scenario" != 'allUsers' `+
+				`GROUP BY time($__interval), "scenario", "nodeName" fill(previous)) WHERE $timeFilter GROUP BY time($__interval), "scenario" fill(previous)`,
+			influx.QuoteIdent(g.m("users")), g.influxQLWhere(), influx.AllNodes,
+		),
+		flux: g.fluxFrom("users", fmt.Sprintf(` and r._field == "active" and r.nodeName != %q and r.scenario != "allUsers"`, influx.AllNodes)) +
+			"\n  |> aggregateWindow(every: v.windowPeriod, fn: last, createEmpty: false)" +
+			"\n  |> group(columns: [\"scenario\", \"_time\"])\n  |> sum()" +
+			"\n  |> group(columns: [\"scenario\"])\n  |> sort(columns: [\"_time\"])",
+		alias: "$tag_scenario",
+	}
+}
+
+func (g generator) percentileQueries(p int) queries {
+	return queries{
+		influxQL: fmt.Sprintf(
+			`SELECT percentile("duration", %d) FROM %s WHERE %s GROUP BY time($__interval), "name" fill(none)`,
+			p, influx.QuoteIdent(g.m("requests")), g.influxQLWhere(),
+		),
+		flux: g.fluxFrom("requests", ` and r._field == "duration"`) +
+			"\n  |> group(columns: [\"name\"])" +
+			fmt.Sprintf("\n  |> aggregateWindow(every: v.windowPeriod, fn: (column, tables=<-) => tables |> quantile(q: %.2f, column: column), createEmpty: false)", float64(p)/100),
+		alias: "$tag_name",
+	}
+}
+
+// throughputQueries sum weights of request points rather than count them, so requests
+// skipped by sampling are taken into account
+func (g generator) throughputQueries() queries {
+	return queries{
+		influxQL: fmt.Sprintf(
+			`SELECT sum("weight") / ($__interval_ms / 1000) FROM %s WHERE %s GROUP BY time($__interval), "result" fill(0)`,
+			influx.QuoteIdent(g.m("requests")), g.influxQLWhere(),
+		),
+		flux: g.fluxFrom("requests", ` and r._field == "weight"`) +
+			"\n  |> group(columns: [\"result\"])\n  |> aggregateWindow(every: 1s, fn: sum, createEmpty: true)\n  |> fill(value: 0.0)" +
+			"\n  |> aggregateWindow(every: v.windowPeriod, fn: mean, createEmpty: false)",
+		alias: "$tag_result",
+	}
+}
+
+func (g generator) groupQueries(field string) queries {
+	return queries{
+		influxQL: fmt.Sprintf(
+			`SELECT mean(%s) FROM %s WHERE %s GROUP BY time($__interval), "name" fill(none)`,
+			influx.QuoteIdent(field), influx.QuoteIdent(g.m("groups")), g.influxQLWhere(),
+		),
+		flux: g.fluxFrom("groups", fmt.Sprintf(` and r._field == %q`, field)) +
+			"\n  |> group(columns: [\"name\"])\n  |> aggregateWindow(every: v.windowPeriod, fn: mean, createEmpty: false)",
+		alias: "$tag_name " + field,
+	}
+}
+
+func (g generator) errorsQueries() queries {
+	return queries{
+		influxQL: fmt.Sprintf(
+			`SELECT "errorMessage", "nodeName" FROM %s WHERE %s ORDER BY time DESC LIMIT 1000`,
+			influx.QuoteIdent(g.m("errors")), g.influxQLWhere(),
+		),
+		flux: g.fluxFrom("errors", ` and r._field == "errorMessage"`) +
+			"\n  |> group()\n  |> keep(columns: [\"_time\", \"_value\", \"nodeName\"])\n  |> sort(columns: [\"_time\"], desc: true)\n  |> limit(n: 1000)",
+	}
+}
+
+// summaryQueries sum weights of request points like throughput does. Flux query counts
+// points without weight, written before sampling was added, as single requests
+func (g generator) summaryQueries() queries {
+	return queries{
+		influxQL: fmt.Sprintf(
+			`SELECT sum("weight") AS "count", mean("duration") AS "mean", percentile("duration", 95) AS "p95", `+
+				`percentile("duration", 99) AS "p99", max("duration") AS "max" FROM %s WHERE %s GROUP BY "name"`,
+			influx.QuoteIdent(g.m("requests")), g.influxQLWhere(),
+		),
+		flux: g.fluxFrom("requests", ` and (r._field == "duration" or r._field == "weight")`) +
+			"\n  |> pivot(rowKey: [\"_time\"], columnKey: [\"_field\"], valueColumn: \"_value\")" +
+			"\n  |> map(fn: (r) => ({r with duration: float(v: r.duration), weight: if exists r.weight then float(v: r.weight) else 1.0}))" +
+			"\n  |> group(columns: [\"name\"])\n  |> reduce(identity: {count: 0.0, points: 0.0, sum: 0.0, max: 0.0}, fn: (r, accumulator) => ({" +
+			"count: accumulator.count + r.weight, points: accumulator.points + 1.0, sum: accumulator.sum + r.duration, " +
+			"max: if r.duration > accumulator.max then r.duration else accumulator.max}))" +
+			"\n  |> map(fn: (r) => ({name: r.name, count: r.count, mean: r.sum / r.points, max: r.max}))\n  |> group()",
+	}
+}
+
+func unit(u string) map[string]interface{} {
+	return map[string]interface{}{"defaults": map[string]interface{}{"unit": u}, "overrides": []interface{}{}}
+}
+
+func (g generator) panels() []panel {
+	type spec struct {
+		title   string
+		kind    string
+		unit    string
+		format  string
+		queries []queries
+	}
+	specs := []spec{
+		{"Active users", "timeseries", "short", "time_series", []queries{g.usersQueries()}},
+		{"Throughput by result", "timeseries", "reqps", "time_series", []queries{g.throughputQueries()}},
+		{"Response time p95", "timeseries", "ms", "time_series", []queries{g.percentileQueries(95)}},
+		{"Response time p99", "timeseries", "ms", "time_series", []queries{g.percentileQueries(99)}},
+		{"Group durations: raw vs total", "timeseries", "ms", "time_series", []queries{
+			g.groupQueries("rawDuration"), g.groupQueries("totalDuration"),
+		}},
+		{"Requests summary", "table", "ms", "table", []queries{g.summaryQueries()}},
+		{"Errors", "table", "short", "table", []queries{g.errorsQueries()}},
+	}
+
+	panels := make([]panel, 0, len(specs))
+	// Time series take a half of a row while tables take the whole row
+	x, y := 0, 0
+	for i, s := range specs {
+		w := panelWidth
+		if s.kind == "table" {
+			w = 2 * panelWidth
+		}
+		if x+w > 2*panelWidth {
+			x, y = 0, y+panelHeight
+		}
+		p := panel{
+			ID:          i + 1,
+			Type:        s.kind,
+			Title:       s.title,
+			Datasource:  g.ds,
+			GridPos:     gridPos{H: panelHeight, W: w, X: x, Y: y},
+			FieldConfig: unit(s.unit),
+		}
+		x += w
+		for j, q := range s.queries {
+			p.Targets = append(p.Targets, g.target(string(rune('A'+j)), q, s.format))
+		}
+		panels = append(panels, p)
+	}
+
+	return panels
+}
+
+func (g generator) testIDVariable() map[string]interface{} {
+	query := fmt.Sprintf(`SHOW TAG VALUES FROM %s WITH KEY = "testId"`, influx.QuoteIdent(g.m("tests")))
+	if g.conf.Language == LanguageFlux {
+		query = fmt.Sprintf(
+			"import \"influxdata/influxdb/schema\"\nschema.tagValues(bucket: %q, tag: \"testId\", "+
+				"predicate: (r) => r._measurement == %q, start: -1y)",
+			g.conf.Bucket, g.m("tests"),
+		)
+	}
+
+	return map[string]interface{}{
+		"name":       "testId",
+		"label":      "Test ID",
+		"type":       "query",
+		"datasource": g.ds,
+		"query":      query,
+		"refresh":    2,
+		"sort":       2,
+		"multi":      false,
+		"includeAll": false,
+	}
+}
+
+func (g generator) annotation() map[string]interface{} {
+	a := map[string]interface{}{
+		"name":       "Test start / end",
+		"datasource": g.ds,
+		"enable":     true,
+		"iconColor":  "rgba(255, 96, 96, 1)",
+	}
+	if g.conf.Language == LanguageFlux {
+		a["query"] = g.fluxFrom("tests", ` and r._field == "description"`) + "\n  |> group()"
+		a["textColumn"] = "_value"
+		a["tagsColumn"] = "action"
+		return a
+	}
+	a["query"] = fmt.Sprintf(
+		`SELECT "description", "action" FROM %s WHERE %s`,
+		influx.QuoteIdent(g.m("tests")), g.influxQLWhere(),
+	)
+	a["textColumn"] = "description"
+	a["tagsColumn"] = "action"
+
+	return a
+}
+
+// Generate builds a dashboard model ready to be imported to Grafana
+func Generate(conf Config) (map[string]interface{}, error) {
+	switch conf.Language {
+	case LanguageInfluxQL:
+	case LanguageFlux:
+		if conf.Bucket == "" {
+			return nil, fmt.Errorf("Bucket is required for Flux queries")
+		}
+	default:
+		return nil, fmt.Errorf("Unknown query language %q, expected one of: %s, %s", conf.Language, LanguageInfluxQL, LanguageFlux)
+	}
+
+	g := generator{conf: conf, ds: conf.Datasource}
+	if g.ds == "" {
+		g.ds = datasourceInput
+	}
+
+	d := map[string]interface{}{
+		"title":         conf.Title,
+		"tags":          []string{"gatling", "g2i"},
+		"timezone":      "browser",
+		"schemaVersion": 30,
+		"refresh":       "10s",
+		"time":          map[string]string{"from": "now-1h", "to": "now"},
+		"templating":    map[string]interface{}{"list": []interface{}{g.testIDVariable()}},
+		"annotations":   map[string]interface{}{"list": []interface{}{g.annotation()}},
+		"panels":        g.panels(),
+	}
+	if conf.Datasource == "" {
+		d["__inputs"] = []map[string]string{{
+			"name":     strings.Trim(datasourceInput, "${}"),
+			"label":    "InfluxDB",
+			"type":     "datasource",
+			"pluginId": "influxdb",
+		}}
+	}
+
+	return d, nil
+}
+
+// Write generates a dashboard and writes it as an indented JSON document
+func Write(w io.Writer, conf Config) error {
+	d, err := Generate(conf)
+	if err != nil {
+		return err
+	}
+	e := json.NewEncoder(w)
+	e.SetIndent("", "  ")
+	e.SetEscapeHTML(false)
+
+	return e.Encode(d)
+}
@@ -0,0 +1,123 @@
+/*
+Copyright © 2020 Anton Kramarev
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+package dashboard
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/dakaraj/gatling-to-influxdb/flags"
+	"github.com/dakaraj/gatling-to-influxdb/influx"
+	"github.com/spf13/cobra"
+)
+
+var update = flag.Bool("update", false, "Update golden files of generated dashboards")
+
+// usePrefix sets measurement prefix the same way commands do
+func usePrefix(t *testing.T, prefix string) {
+	cmd := &cobra.Command{Use: "test"}
+	flags.AddConnection(cmd.Flags())
+	if err := cmd.ParseFlags([]string{"--measurement-prefix", prefix}); err != nil {
+		t.Fatal(err)
+	}
+	influx.InitSchema(cmd)
+}
+
+func TestWriteGolden(t *testing.T) {
+	tests := []struct {
+		golden string
+		prefix string
+		conf   Config
+	}{
+		{golden: "influxql.json", conf: Config{Title: "Gatling (g2i)", Language: LanguageInfluxQL}},
+		{golden: "flux.json", conf: Config{Title: "Gatling (g2i)", Language: LanguageFlux, Bucket: "gatling/autogen"}},
+		{golden: "influxql-prefix-datasource.json", prefix: "g2i_", conf: Config{Title: "Load tests", Language: LanguageInfluxQL, Datasource: "InfluxDB prod"}},
+	}
+	defer usePrefix(t, "")
+	for _, tt := range tests {
+		t.Run(tt.golden, func(t *testing.T) {
+			usePrefix(t, tt.prefix)
+			var buf bytes.Buffer
+			if err := Write(&buf, tt.conf); err != nil {
+				t.Fatal(err)
+			}
+
+			path := filepath.Join("testdata", tt.golden)
+			if *update {
+				if err := ioutil.WriteFile(path, buf.Bytes(), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			want, err := ioutil.ReadFile(path)
+			if err != nil {
+				t.Fatalf("Failed to read golden file, run tests with -update to create it: %v", err)
+			}
+			if !bytes.Equal(buf.Bytes(), want) {
+				t.Errorf("Generated dashboard differs from %s, run tests with -update if the change is expected:\n%s", path, buf.String())
+			}
+		})
+	}
+}
+
+func TestGenerateUsesMeasurementPrefix(t *testing.T) {
+	usePrefix(t, "g2i_")
+	defer usePrefix(t, "")
+
+	for _, conf := range []Config{
+		{Language: LanguageInfluxQL},
+		{Language: LanguageFlux, Bucket: "gatling/autogen"},
+	} {
+		var buf bytes.Buffer
+		if err := Write(&buf, conf); err != nil {
+			t.Fatal(err)
+		}
+		var d map[string]interface{}
+		if err := json.Unmarshal(buf.Bytes(), &d); err != nil {
+			t.Fatalf("%s: invalid JSON: %v", conf.Language, err)
+		}
+		for _, m := range []string{"requests", "groups", "users", "errors", "tests"} {
+			if !strings.Contains(buf.String(), `\"g2i_`+m+`\"`) {
+				t.Errorf("%s: expected queries of prefixed %s measurement", conf.Language, m)
+			}
+			if strings.Contains(buf.String(), `\"`+m+`\"`) {
+				t.Errorf("%s: expected no queries of unprefixed %s measurement", conf.Language, m)
+			}
+		}
+	}
+}
+
+func TestGenerateRejectsInvalidConfig(t *testing.T) {
+	for _, conf := range []Config{
+		{Language: "sql"},
+		{Language: LanguageFlux},
+	} {
+		if _, err := Generate(conf); err == nil {
+			t.Errorf("Expected an error for %+v", conf)
+		}
+	}
+}
@@ -0,0 +1,110 @@
+/*
+Copyright © 2020 Anton Kramarev
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+// Package flags registers command line flags shared by several commands.
+// Flags are defined in one place so that commands and tests of packages reading them
+// always see the same names and defaults
+package flags
+
+import "github.com/spf13/pflag"
+
+// AddConnection registers flags of InfluxDB connection and of the way points are written
+func AddConnection(fs *pflag.FlagSet) {
+	fs.StringP("address", "a", "http://localhost:8086", "HTTP address and port of InfluxDB instance")
+	fs.StringP("username", "u", "", "Username credential for InfluxDB instance")
+	fs.StringP("password", "p", "", "Password credential for InfluxDB instance")
+	fs.StringP("database", "b", "gatling", "Database name in InfluxDB")
+	fs.String("measurement-prefix", "", "Prefix added to names of all measurements written by g2i")
+	fs.UintP("max-batch-size", "m", 5000, "Max points batch size to sent to InfluxDB")
+	fs.String("retention-policy", "", "Retention policy to write points to, database default policy is used if empty")
+	fs.StringArray("retention-policy-route", nil, "Write a measurement to another retention policy, e.g. 'requests=week'. Can be repeated")
+	fs.String("write-consistency", "", "Write consistency for InfluxDB clusters: any, one, quorum or all")
+	fs.Bool("create-database", false, "Create database if it does not exist, requires admin privileges")
+	fs.String("create-database-duration", "", "Duration of default retention policy of created database, e.g. 30d, infinite if empty")
+	fs.Bool("dry-run-write", true, "Check write permissions with an empty write request before start")
+	fs.Bool("gzip", false, "Compress bodies of write requests to InfluxDB with gzip")
+	fs.Uint("http-timeout", 60, "Time (seconds) to wait for InfluxDB to respond to a request")
+	fs.Uint("ping-timeout", 10, "Time (seconds) to wait for InfluxDB to respond to initial ping")
+	fs.String("tls-ca", "", "File with PEM encoded CA certificates to verify InfluxDB server certificate with")
+	fs.String("tls-cert", "", "File with PEM encoded client certificate for mutual TLS")
+	fs.String("tls-key", "", "File with PEM encoded client certificate key for mutual TLS")
+	fs.Bool("tls-skip-verify", false, "Skip verification of InfluxDB server certificate")
+	fs.String("proxy", "", "HTTP proxy address for InfluxDB requests, HTTP_PROXY / HTTPS_PROXY variables are used if empty")
+	fs.Int("max-idle-conns", 10, "Max amount of idle connections to InfluxDB kept for reuse")
+	fs.Int("max-conns-per-host", 0, "Max amount of simultaneous connections to InfluxDB, 0 means no limit")
+	fs.Uint("idle-conn-timeout", 90, "Time (seconds) an idle connection to InfluxDB is kept for reuse")
+}
+
+// AddProcessing registers flags of the way log lines are turned into points, shared
+// by live and import modes
+func AddProcessing(fs *pflag.FlagSet) {
+	fs.StringP("test-id", "t", "", "Unique test identifier")
+	fs.Uint("users-interval", 5, "Time (seconds) between snapshots of user activity")
+	fs.Uint("users-reorder-window", 5, "Time (seconds) to wait for out of order USER lines before a snapshot is sent")
+	fs.Float64("sample-ok", 100, "Percentage (1-100) of OK requests written to the database, KO requests are always written")
+	fs.Uint("sample-slower-than", 0, "Always write OK requests with duration (ms) not less than this value when sampling, 0 to disable")
+	fs.StringArray("name-replace", nil, `Replace parts of request and group names matching a regex, e.g. '/users/\d+=>/users/{id}'. Can be repeated`)
+	fs.StringArray("name-allow", nil, "Regex of allowed request and group names, others are written as other-name. Can be repeated")
+	fs.Uint("max-names", 0, "Max amount of distinct request and group names each, new names are written as other-name when reached, 0 for no limit")
+	fs.String("other-name", "other", "Name used for requests and groups not passing name-allow or max-names limits")
+	fs.Uint("group-depth", 3, "Amount of group hierarchy levels written as separate group_l<N> tags")
+	fs.Uint("error-classes-interval", 10, "Time (seconds) error class occurrences are counted over")
+	fs.Uint("top-error-classes", 10, "Amount of most frequent error classes reported at the end of the test, 0 to disable")
+	fs.StringArray("assert", nil, `Assertion to check at the end of the test, e.g. 'global.p95 < 800ms'. Can be repeated`)
+	fs.String("assertions-file", "", "File with assertions to check at the end of the test, one per line")
+	fs.String("grafana-url", "", "Grafana address to post test start / end and error burst annotations to")
+	fs.String("grafana-api-key", "", "Grafana API key with Editor role")
+	fs.String("grafana-dashboard-uid", "", "Post annotations to a single dashboard instead of all dashboards")
+	fs.Uint("grafana-error-burst", 10, "Amount of ERROR lines within a window to post an annotation, 0 to disable")
+	fs.Uint("grafana-error-window", 10, "Window (seconds) for ERROR lines burst detection")
+}
+
+// AddImport registers flags specific to import of finished logs
+func AddImport(fs *pflag.FlagSet) {
+	fs.Int("workers", 0, "Amount of goroutines parsing lines of imported logs and building points, 0 means one per CPU and 1 disables parallel processing")
+	fs.Bool("align-start", true, "Shift timestamps of each log so all RUN start times match, compensating clock skew between nodes")
+	fs.Uint64("max-extracted-size", 20000000000, "Max total size (bytes) of logs extracted from each imported archive")
+}
+
+// AddAlerting registers flags of conditions checked during a live test
+func AddAlerting(fs *pflag.FlagSet) {
+	fs.StringArray("alert", nil, `Condition to check during the test, alert is sent when it is violated, e.g. 'global.errorRate < 5%'. Can be repeated`)
+	fs.String("alerts-file", "", "File with alert conditions, one per line")
+	fs.StringArray("alert-webhook", nil, "Webhook URL to post alerts to. Can be repeated")
+	fs.String("alert-format", "generic", "Alert payload format: generic, slack or teams")
+	fs.String("alert-template", "", "File with Go template of alert payload, overrides alert-format")
+	fs.Uint("alert-window", 60, "Sliding window (seconds) alert conditions are evaluated over")
+	fs.Uint("alert-interval", 10, "Time (seconds) between alert conditions evaluations")
+	fs.Uint("alert-repeat", 0, "Time (seconds) to repeat notification for a still firing alert, 0 to never repeat")
+	fs.Uint("alert-min-samples", 10, "Min amount of requests in a window required to evaluate a condition")
+	fs.Int("alert-abort-pid", 0, "PID of a process to signal when any alert fires, e.g. to abort a test")
+	fs.String("alert-abort-signal", "INT", "Signal sent to alert-abort-pid process: INT, TERM or KILL")
+}
+
+// AddRelay registers flags of relay server agents send points to
+func AddRelay(fs *pflag.FlagSet) {
+	fs.String("listen", ":8087", "Address to accept agent connections on")
+	fs.String("agent-username", "", "Username agents must authenticate with, required")
+	fs.String("agent-password", "", "Password agents must authenticate with, required")
+	fs.Uint("aggregation-interval", 10, "Time (seconds) between writes of merged users and aggregated requests")
+	fs.Uint("max-body-size", 25000000, "Max size (bytes) of a write request body received from an agent, also applied after decompression")
+}
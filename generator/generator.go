@@ -0,0 +1,617 @@
+/*
+Copyright © 2020 Anton Kramarev
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+// Package generator writes synthetic Gatling simulation logs. Generated logs
+// have the same format as ones written by Gatling, so they can be used to measure
+// performance of log processing, to load test a database or to try dashboards
+// without running a real test
+package generator
+
+import (
+	"bufio"
+	"container/heap"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Version is Gatling version written to RUN line. Logs are written in its format,
+// which is the one g2i reads
+const Version = "3.3.1"
+
+// Ramp profiles defining how user start times are spread over ramp duration
+const (
+	// RampLinear starts users one by one evenly
+	RampLinear = "linear"
+	// RampInstant starts all users at once
+	RampInstant = "instant"
+	// RampSteps starts users in equal batches evenly
+	RampSteps = "steps"
+	// RampRandom starts users at random moments
+	RampRandom = "random"
+)
+
+// Request is a request of a scenario
+type Request struct {
+	Name string `json:"name"`
+	// Weight is a relative frequency of the request when requests are picked randomly
+	Weight int `json:"weight,omitempty"`
+	// Response times are spread evenly between min and max ones
+	MinResponseTime Duration `json:"minResponseTime"`
+	MaxResponseTime Duration `json:"maxResponseTime"`
+	// KORate is a share of failed requests between 0 and 1
+	KORate float64 `json:"koRate"`
+	// ErrorMessages of failed requests, messages of configuration are used if empty
+	ErrorMessages []string `json:"errorMessages,omitempty"`
+}
+
+// Scenario describes what its users do
+type Scenario struct {
+	Name string `json:"name"`
+	// Weight is a relative share of users running the scenario
+	Weight int `json:"weight,omitempty"`
+	// Each user makes the given amount of iterations
+	Iterations int `json:"iterations"`
+	// RequestsPerIteration is amount of requests picked randomly by weight for every
+	// iteration. When it is zero all requests are made in order
+	RequestsPerIteration int       `json:"requestsPerIteration,omitempty"`
+	Requests             []Request `json:"requests"`
+	// Groups wrap requests of every iteration, each next group is nested in the previous one
+	Groups []string `json:"groups,omitempty"`
+	// Pause is made after every request
+	Pause Duration `json:"pause"`
+}
+
+// Ramp describes how users are started
+type Ramp struct {
+	Profile  string   `json:"profile"`
+	Duration Duration `json:"duration"`
+	// Steps is amount of batches of steps profile
+	Steps int `json:"steps,omitempty"`
+}
+
+// Config describes a synthetic simulation
+type Config struct {
+	Simulation  string     `json:"simulation"`
+	Description string     `json:"description"`
+	Users       int        `json:"users"`
+	Ramp        Ramp       `json:"ramp"`
+	Scenarios   []Scenario `json:"scenarios"`
+	// ErrorMessages are used for failed requests without own messages
+	ErrorMessages []string `json:"errorMessages"`
+	// ErrorLineRate is a share of failed requests additionally reported with ERROR line
+	ErrorLineRate float64 `json:"errorLineRate"`
+	Seed          int64   `json:"seed"`
+	// Start is a time test starts at
+	Start time.Time `json:"-"`
+	// RealTime makes lines to be written when events happen, like during a live test
+	RealTime bool `json:"-"`
+}
+
+// Result contains amounts of written lines
+type Result struct {
+	Lines    int
+	Users    int
+	Requests int
+	Groups   int
+	Errors   int
+	// End is a timestamp of the last event
+	End time.Time
+}
+
+// DefaultConfig returns a configuration of a small test that is a reasonable start
+func DefaultConfig() Config {
+	ms := func(n int) Duration { return Duration{time.Duration(n) * time.Millisecond} }
+	return Config{
+		Simulation:  "simulations.SyntheticSimulation",
+		Description: "Synthetic test",
+		Users:       100,
+		Ramp:        Ramp{Profile: RampLinear, Duration: Duration{time.Minute}},
+		Scenarios: []Scenario{
+			{
+				Name:       "Synthetic",
+				Weight:     1,
+				Iterations: 10,
+				Requests: []Request{
+					{Name: "Home", MinResponseTime: ms(20), MaxResponseTime: ms(200), KORate: 0.01},
+					{Name: "Search", MinResponseTime: ms(50), MaxResponseTime: ms(500), KORate: 0.02},
+					{Name: "Open item", MinResponseTime: ms(30), MaxResponseTime: ms(300), KORate: 0.02},
+					{Name: "Add to cart", MinResponseTime: ms(40), MaxResponseTime: ms(400), KORate: 0.03},
+					{Name: "Checkout", MinResponseTime: ms(100), MaxResponseTime: ms(900), KORate: 0.05},
+				},
+				Groups: []string{"Journey"},
+				Pause:  Duration{time.Second},
+			},
+		},
+		ErrorMessages: []string{
+			"status.find.in(200,304), but actually found 500",
+			"j.u.c.TimeoutException: Request timeout after 60000 ms",
+			"jsonPath($.id).find.exists, found nothing",
+		},
+		ErrorLineRate: 0.1,
+		Seed:          1,
+	}
+}
+
+// SetKORate sets the same share of failed requests for all requests of all scenarios
+func (c *Config) SetKORate(rate float64) {
+	for i := range c.Scenarios {
+		for j := range c.Scenarios[i].Requests {
+			c.Scenarios[i].Requests[j].KORate = rate
+		}
+	}
+}
+
+// SetIterations sets the same amount of iterations for all scenarios
+func (c *Config) SetIterations(n int) {
+	for i := range c.Scenarios {
+		c.Scenarios[i].Iterations = n
+	}
+}
+
+// Validate checks that a configuration describes a test that can be generated
+func (c Config) Validate() error {
+	switch {
+	case c.Users <= 0:
+		return errors.New("Amount of users must be greater than zero")
+	case len(c.Scenarios) == 0:
+		return errors.New("At least one scenario is required")
+	case c.Ramp.Duration.Duration < 0:
+		return errors.New("Ramp duration must not be negative")
+	case c.ErrorLineRate < 0 || c.ErrorLineRate > 1:
+		return errors.New("Error line rate must be between 0 and 1")
+	}
+	switch c.Ramp.Profile {
+	case RampLinear, RampInstant, RampRandom:
+	case RampSteps:
+		if c.Ramp.Steps <= 0 {
+			return errors.New("Amount of steps must be greater than zero for steps ramp profile")
+		}
+	default:
+		return fmt.Errorf("Unknown ramp profile %q, expected one of: %s, %s, %s, %s", c.Ramp.Profile, RampLinear, RampInstant, RampSteps, RampRandom)
+	}
+
+	for _, s := range c.Scenarios {
+		if err := c.validateScenario(s); err != nil {
+			return fmt.Errorf("Invalid scenario %q: %w", s.Name, err)
+		}
+	}
+
+	return nil
+}
+
+func (c Config) validateScenario(s Scenario) error {
+	switch {
+	case s.Name == "":
+		return errors.New("Name is required")
+	case s.Weight < 0:
+		return errors.New("Weight must not be negative")
+	case s.Iterations < 0 || s.RequestsPerIteration < 0:
+		return errors.New("Amount of iterations and requests must not be negative")
+	case s.Iterations > 0 && len(s.Requests) == 0:
+		return errors.New("At least one request is required")
+	case s.Pause.Duration < 0:
+		return errors.New("Pause must not be negative")
+	}
+	for _, r := range s.Requests {
+		switch {
+		case r.Name == "":
+			return errors.New("Request name is required")
+		case r.Weight < 0:
+			return fmt.Errorf("Weight of request %q must not be negative", r.Name)
+		case r.MinResponseTime.Duration < 0 || r.MaxResponseTime.Duration < r.MinResponseTime.Duration:
+			return fmt.Errorf("Response time range of request %q is invalid", r.Name)
+		case r.KORate < 0 || r.KORate > 1:
+			return fmt.Errorf("KO rate of request %q must be between 0 and 1", r.Name)
+		case r.KORate > 0 && len(r.ErrorMessages) == 0 && len(c.ErrorMessages) == 0:
+			return fmt.Errorf("Request %q can fail, but there are no error messages", r.Name)
+		}
+	}
+
+	return nil
+}
+
+func weight(w int) int {
+	if w == 0 {
+		return 1
+	}
+
+	return w
+}
+
+// scenario is a scenario prepared for generation
+type scenario struct {
+	*Scenario
+	// cumulative weights of requests used to pick them randomly
+	weights []int
+	// groups contains hierarchies of groups as they are written to the log, from outer to inner
+	groups []string
+}
+
+func newScenario(s *Scenario) *scenario {
+	p := &scenario{Scenario: s}
+	total := 0
+	for _, r := range s.Requests {
+		total += weight(r.Weight)
+		p.weights = append(p.weights, total)
+	}
+	for i := range s.Groups {
+		p.groups = append(p.groups, strings.Join(s.Groups[:i+1], ","))
+	}
+
+	return p
+}
+
+// steps returns amount of requests made per iteration
+func (s *scenario) steps() int {
+	if s.RequestsPerIteration > 0 {
+		return s.RequestsPerIteration
+	}
+
+	return len(s.Requests)
+}
+
+// user is a virtual user producing its lines one by one
+type user struct {
+	id        int
+	scn       *scenario
+	startTime int64
+	// t is a time the user is going to make its next action at
+	t         int64
+	iteration int
+	step      int
+	// State of currently open groups from outer to inner, open is amount of them
+	groupStart []int64
+	groupRaw   []int64
+	groupKO    []bool
+	open       int
+	// errorMessage is written as ERROR line after a failed request
+	errorMessage string
+	errorTime    int64
+	started      bool
+	finished     bool
+	// next line of the user and a timestamp it is written at
+	line []byte
+	ts   int64
+}
+
+// users is a queue of users ordered by timestamps of their next lines, so all lines
+// are written in time order like Gatling does
+type users []*user
+
+func (u users) Len() int            { return len(u) }
+func (u users) Less(i, j int) bool  { return u[i].ts < u[j].ts }
+func (u users) Swap(i, j int)       { u[i], u[j] = u[j], u[i] }
+func (u *users) Push(x interface{}) { *u = append(*u, x.(*user)) }
+func (u *users) Pop() interface{} {
+	old := *u
+	x := old[len(old)-1]
+	*u = old[:len(old)-1]
+	return x
+}
+
+type generator struct {
+	cfg       Config
+	rnd       *rand.Rand
+	scenarios []*scenario
+	res       Result
+}
+
+func millis(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+// startTimes returns start times of all users in milliseconds in ascending order
+func (g *generator) startTimes(start int64) []int64 {
+	n := g.cfg.Users
+	d := int64(g.cfg.Ramp.Duration.Duration / time.Millisecond)
+	times := make([]int64, n)
+	for i := range times {
+		switch g.cfg.Ramp.Profile {
+		case RampInstant:
+			times[i] = start
+		case RampSteps:
+			steps := int64(g.cfg.Ramp.Steps)
+			times[i] = start + int64(i)*steps/int64(n)*d/steps
+		case RampRandom:
+			times[i] = start + g.rnd.Int63n(d+1)
+		default:
+			if n > 1 {
+				times[i] = start + int64(i)*d/int64(n-1)
+			} else {
+				times[i] = start
+			}
+		}
+	}
+	sort.Slice(times, func(i, j int) bool { return times[i] < times[j] })
+
+	return times
+}
+
+// scenarioOf assigns users to scenarios according to weights, so shares are kept
+// at any moment of ramp up
+func (g *generator) scenarioOf(assigned []int) *scenario {
+	best := 0
+	for i, s := range g.scenarios {
+		if float64(assigned[i]+1)/float64(weight(s.Weight)) < float64(assigned[best]+1)/float64(weight(g.scenarios[best].Weight)) {
+			best = i
+		}
+	}
+	assigned[best]++
+
+	return g.scenarios[best]
+}
+
+func (g *generator) pickRequest(u *user) *Request {
+	s := u.scn
+	if s.RequestsPerIteration == 0 {
+		return &s.Requests[u.step]
+	}
+	n := g.rnd.Intn(s.weights[len(s.weights)-1])
+	i := sort.SearchInts(s.weights, n+1)
+
+	return &s.Requests[i]
+}
+
+func (g *generator) responseTime(r *Request) int64 {
+	min := int64(r.MinResponseTime.Duration / time.Millisecond)
+	max := int64(r.MaxResponseTime.Duration / time.Millisecond)
+
+	return min + g.rnd.Int63n(max-min+1)
+}
+
+func (g *generator) errorMessage(r *Request) string {
+	messages := r.ErrorMessages
+	if len(messages) == 0 {
+		messages = g.cfg.ErrorMessages
+	}
+
+	return messages[g.rnd.Intn(len(messages))]
+}
+
+// appendUserID adds user ID field to the line
+func (g *generator) appendUserID(b []byte, u *user) []byte {
+	b = append(b, '\t')
+
+	return strconv.AppendInt(b, int64(u.id), 10)
+}
+
+func (g *generator) userLine(u *user, event string, end int64) {
+	u.line = append(u.line, "USER\t"...)
+	u.line = append(u.line, u.scn.Name...)
+	u.line = g.appendUserID(u.line, u)
+	u.line = append(u.line, '\t')
+	u.line = append(u.line, event...)
+	u.line = append(u.line, '\t')
+	u.line = strconv.AppendInt(u.line, u.startTime, 10)
+	u.line = append(u.line, '\t')
+	u.line = strconv.AppendInt(u.line, end, 10)
+}
+
+// advance prepares the next line of a user, it returns false when user has nothing to write
+func (g *generator) advance(u *user) bool {
+	s := u.scn
+	u.line = u.line[:0]
+	switch {
+	case u.finished:
+		return false
+	case !u.started:
+		u.started = true
+		u.ts = u.startTime
+		g.userLine(u, "START", u.startTime)
+		g.res.Users++
+	case u.errorMessage != "":
+		u.ts = u.errorTime
+		u.line = append(u.line, "ERROR\t"...)
+		u.line = append(u.line, u.errorMessage...)
+		u.line = append(u.line, '\t')
+		u.line = strconv.AppendInt(u.line, u.errorTime, 10)
+		u.errorMessage = ""
+		g.res.Errors++
+	case u.iteration == s.Iterations:
+		u.finished = true
+		u.ts = u.t
+		g.userLine(u, "END", u.t)
+	case u.step == s.steps():
+		// All requests of an iteration are done, closing its groups from the inner one
+		u.open--
+		level := u.open
+		u.ts = u.t
+		u.line = append(u.line, "GROUP"...)
+		u.line = g.appendUserID(u.line, u)
+		u.line = append(u.line, '\t')
+		u.line = append(u.line, s.groups[level]...)
+		u.line = append(u.line, '\t')
+		u.line = strconv.AppendInt(u.line, u.groupStart[level], 10)
+		u.line = append(u.line, '\t')
+		u.line = strconv.AppendInt(u.line, u.t, 10)
+		u.line = append(u.line, '\t')
+		u.line = strconv.AppendInt(u.line, u.groupRaw[level], 10)
+		if u.groupKO[level] {
+			u.line = append(u.line, "\tKO"...)
+		} else {
+			u.line = append(u.line, "\tOK"...)
+		}
+		if u.open == 0 {
+			g.nextIteration(u)
+		}
+		g.res.Groups++
+	default:
+		if u.step == 0 {
+			for i := range s.groups {
+				u.groupStart[i], u.groupRaw[i], u.groupKO[i] = u.t, 0, false
+			}
+			u.open = len(s.groups)
+		}
+		r := g.pickRequest(u)
+		start := u.t
+		end := start + g.responseTime(r)
+		ko := g.rnd.Float64() < r.KORate
+		u.ts = end
+		u.line = append(u.line, "REQUEST"...)
+		u.line = g.appendUserID(u.line, u)
+		u.line = append(u.line, '\t')
+		if len(s.groups) > 0 {
+			u.line = append(u.line, s.groups[len(s.groups)-1]...)
+		}
+		u.line = append(u.line, '\t')
+		u.line = append(u.line, r.Name...)
+		u.line = append(u.line, '\t')
+		u.line = strconv.AppendInt(u.line, start, 10)
+		u.line = append(u.line, '\t')
+		u.line = strconv.AppendInt(u.line, end, 10)
+		if ko {
+			message := g.errorMessage(r)
+			u.line = append(u.line, "\tKO\t"...)
+			u.line = append(u.line, message...)
+			if g.rnd.Float64() < g.cfg.ErrorLineRate {
+				u.errorMessage, u.errorTime = message, end
+			}
+		} else {
+			// Gatling writes a space instead of an empty message
+			u.line = append(u.line, "\tOK\t "...)
+		}
+		for i := range s.groups {
+			u.groupRaw[i] += end - start
+			u.groupKO[i] = u.groupKO[i] || ko
+		}
+		u.t = end + int64(s.Pause.Duration/time.Millisecond)
+		u.step++
+		if u.step == s.steps() && len(s.groups) == 0 {
+			g.nextIteration(u)
+		}
+		g.res.Requests++
+	}
+	u.line = append(u.line, '\n')
+
+	return true
+}
+
+func (g *generator) nextIteration(u *user) {
+	u.iteration++
+	u.step = 0
+}
+
+// Write writes a complete simulation log described by the configuration. In real
+// time mode it returns when the last line is written or context is cancelled
+func Write(ctx context.Context, w io.Writer, cfg Config) (Result, error) {
+	if err := cfg.Validate(); err != nil {
+		return Result{}, err
+	}
+	if cfg.RealTime || cfg.Start.IsZero() {
+		cfg.Start = time.Now()
+	}
+	g := &generator{cfg: cfg, rnd: rand.New(rand.NewSource(cfg.Seed))}
+	for i := range cfg.Scenarios {
+		g.scenarios = append(g.scenarios, newScenario(&cfg.Scenarios[i]))
+	}
+	bw := bufio.NewWriterSize(w, 64*1024)
+
+	start := millis(cfg.Start)
+	// Gatling writes a space when a test has no description
+	description := cfg.Description
+	if description == "" {
+		description = " "
+	}
+	if _, err := fmt.Fprintf(bw, "RUN\t%s\tsynthetic\t%d\t%s\t%s\n", cfg.Simulation, start, description, Version); err != nil {
+		return g.res, err
+	}
+	g.res.Lines++
+	g.res.End = cfg.Start
+
+	// Users are started lazily, so only active ones are kept in memory
+	starts := g.startTimes(start)
+	assigned := make([]int, len(g.scenarios))
+	newUser := func(i int) *user {
+		scn := g.scenarioOf(assigned)
+		return &user{
+			id:         i + 1,
+			scn:        scn,
+			startTime:  starts[i],
+			t:          starts[i],
+			groupStart: make([]int64, len(scn.groups)),
+			groupRaw:   make([]int64, len(scn.groups)),
+			groupKO:    make([]bool, len(scn.groups)),
+		}
+	}
+	var queue users
+	next := 0
+	for {
+		// The next user is added to the queue once it starts before others' next lines
+		if next < len(starts) && (queue.Len() == 0 || starts[next] <= queue[0].ts) {
+			u := newUser(next)
+			g.advance(u)
+			heap.Push(&queue, u)
+			next++
+			continue
+		}
+		if queue.Len() == 0 {
+			break
+		}
+
+		u := queue[0]
+		if cfg.RealTime {
+			if err := waitFor(ctx, bw, cfg.Start.Add(time.Duration(u.ts-start)*time.Millisecond)); err != nil {
+				return g.res, err
+			}
+		}
+		if _, err := bw.Write(u.line); err != nil {
+			return g.res, err
+		}
+		g.res.Lines++
+		if u.ts > millis(g.res.End) {
+			g.res.End = time.Unix(0, u.ts*int64(time.Millisecond))
+		}
+		if g.advance(u) {
+			heap.Fix(&queue, 0)
+		} else {
+			heap.Pop(&queue)
+		}
+	}
+
+	return g.res, bw.Flush()
+}
+
+// waitFor flushes written lines and waits until the moment an event happens
+func waitFor(ctx context.Context, bw *bufio.Writer, t time.Time) error {
+	wait := time.Until(t)
+	if wait <= 0 {
+		return nil
+	}
+	if err := bw.Flush(); err != nil {
+		return err
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
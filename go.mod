@@ -4,5 +4,7 @@ go 1.13
 
 require (
 	github.com/influxdata/influxdb1-client v0.0.0-20200515024757-02f0bf5dbca3
+	github.com/klauspost/compress v1.11.13
 	github.com/spf13/cobra v1.0.0
+	github.com/spf13/pflag v1.0.3
 )
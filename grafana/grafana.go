@@ -0,0 +1,272 @@
+/*
+Copyright © 2020 Anton Kramarev
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+package grafana
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	l "github.com/dakaraj/gatling-to-influxdb/logger"
+	"github.com/spf13/cobra"
+)
+
+type annotation struct {
+	DashboardUID string   `json:"dashboardUID,omitempty"`
+	Time         int64    `json:"time"`
+	TimeEnd      int64    `json:"timeEnd,omitempty"`
+	Tags         []string `json:"tags"`
+	Text         string   `json:"text"`
+}
+
+// job is either an annotation to post or a flush request that is
+// completed once all annotations queued before it are posted
+type job struct {
+	a       annotation
+	flushed chan struct{}
+}
+
+type testInfo struct {
+	testID         string
+	simulationName string
+	description    string
+	nodeName       string
+}
+
+var (
+	address      string
+	apiKey       string
+	dashboardUID string
+	httpClient   = &http.Client{Timeout: 5 * time.Second}
+
+	// Annotations are posted by a single worker, so a slow Grafana doesn't stall log processing
+	queueSize   = 100
+	queue       = make(chan job, queueSize)
+	startWorker sync.Once
+	// flushTimeout limits waiting for queued annotations in total, otherwise an unresponsive
+	// Grafana delays the end of processing by a request timeout per annotation
+	flushTimeout = 10 * time.Second
+
+	// mu guards test information and error burst detection state
+	mu           sync.Mutex
+	info         testInfo
+	burstSize    int
+	burstWindow  time.Duration
+	recentErrors []time.Time
+	inBurst      bool
+)
+
+// Enabled reports if Grafana integration is configured
+func Enabled() bool {
+	return address != ""
+}
+
+// tags returns annotation tags, mu must be held by caller
+func tags(extra ...string) []string {
+	t := []string{"g2i", info.testID, info.simulationName, info.nodeName}
+	return append(t, extra...)
+}
+
+func worker() {
+	for j := range queue {
+		if j.flushed != nil {
+			close(j.flushed)
+			continue
+		}
+		post(j.a)
+	}
+}
+
+// enqueue passes annotation to the worker without waiting for it to be posted.
+// Annotation is dropped if too many of them are waiting already
+func enqueue(a annotation) {
+	startWorker.Do(func() { go worker() })
+	select {
+	case queue <- job{a: a}:
+	default:
+		l.Errorf("Grafana annotation '%s' dropped, %d annotations are waiting to be posted\n", a.Text, queueSize)
+	}
+}
+
+// Flush waits until all queued annotations are posted, but not longer than flushTimeout
+func Flush() {
+	startWorker.Do(func() { go worker() })
+	deadline := time.NewTimer(flushTimeout)
+	defer deadline.Stop()
+
+	done := make(chan struct{})
+	select {
+	case queue <- job{flushed: done}:
+		select {
+		case <-done:
+			return
+		case <-deadline.C:
+		}
+	case <-deadline.C:
+	}
+	l.Errorf("Stopped waiting for Grafana annotations after %v, the rest of them may not be posted\n", flushTimeout)
+}
+
+func post(a annotation) {
+	a.DashboardUID = dashboardUID
+	body, _ := json.Marshal(a)
+	req, err := http.NewRequest(http.MethodPost, address+"/api/annotations", bytes.NewReader(body))
+	if err != nil {
+		l.Errorf("Failed to create Grafana annotation request: %v\n", err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+apiKey)
+	}
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		l.Errorf("Failed to post Grafana annotation: %v\n", err)
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		l.Errorf("Grafana responded with %s to annotation request: %s\n", resp.Status, msg)
+		return
+	}
+	l.Debugf("Grafana annotation '%s' posted\n", a.Text)
+}
+
+// ResetTestInfo discards test information and error burst state, so another test can be processed
+func ResetTestInfo() {
+	mu.Lock()
+	defer mu.Unlock()
+
+	info = testInfo{}
+	recentErrors = nil
+	inBurst = false
+}
+
+// AnnotateTestStart posts an annotation marking test start and saves
+// test information for later annotations. When several logs are merged into
+// a single test only the first call posts an annotation
+func AnnotateTestStart(testID, simulationName, description, nodeName string, t time.Time) {
+	mu.Lock()
+	if info.testID != "" || info.simulationName != "" {
+		mu.Unlock()
+		return
+	}
+	info = testInfo{testID, simulationName, description, nodeName}
+	a := annotation{Time: t.UnixNano() / int64(time.Millisecond), Tags: tags("start")}
+	mu.Unlock()
+	if !Enabled() {
+		return
+	}
+
+	a.Text = fmt.Sprintf("Test %s started: %s", testID, simulationName)
+	if d := strings.TrimSpace(description); d != "" {
+		a.Text += " (" + d + ")"
+	}
+	enqueue(a)
+}
+
+// AnnotateTestEnd posts an annotation marking test end and waits until it is posted
+// together with all annotations queued before, at most flushTimeout in total
+func AnnotateTestEnd(t time.Time) {
+	if !Enabled() {
+		return
+	}
+
+	mu.Lock()
+	a := annotation{
+		Time: t.UnixNano() / int64(time.Millisecond),
+		Tags: tags("end"),
+		Text: fmt.Sprintf("Test %s finished: %s", info.testID, info.simulationName),
+	}
+	mu.Unlock()
+	enqueue(a)
+	Flush()
+}
+
+// AddError registers a single ERROR line and posts an annotation when amount of errors
+// within a window reaches a threshold. Only one annotation is posted per burst
+func AddError(t time.Time, message string) {
+	if !Enabled() || burstSize == 0 {
+		return
+	}
+	mu.Lock()
+
+	// Drop errors that are out of window
+	from := t.Add(-burstWindow)
+	i := 0
+	for i < len(recentErrors) && recentErrors[i].Before(from) {
+		i++
+	}
+	recentErrors = append(recentErrors[i:], t)
+
+	if len(recentErrors) < burstSize {
+		// Burst is over when error rate falls below threshold
+		inBurst = false
+		mu.Unlock()
+		return
+	}
+	if inBurst {
+		mu.Unlock()
+		return
+	}
+	inBurst = true
+
+	a := annotation{
+		Time:    recentErrors[0].UnixNano() / int64(time.Millisecond),
+		TimeEnd: t.UnixNano() / int64(time.Millisecond),
+		Tags:    tags("errors"),
+		Text: fmt.Sprintf(
+			"Burst of %d errors within %s in test %s. Last error: %s",
+			len(recentErrors), burstWindow, info.testID, strings.TrimSpace(message),
+		),
+	}
+	mu.Unlock()
+	enqueue(a)
+}
+
+// Init reads Grafana integration settings from flags
+func Init(cmd *cobra.Command) error {
+	address, _ = cmd.Flags().GetString("grafana-url")
+	address = strings.TrimRight(address, "/")
+	apiKey, _ = cmd.Flags().GetString("grafana-api-key")
+	dashboardUID, _ = cmd.Flags().GetString("grafana-dashboard-uid")
+	size, _ := cmd.Flags().GetUint("grafana-error-burst")
+	burstSize = int(size)
+	window, _ := cmd.Flags().GetUint("grafana-error-window")
+	burstWindow = time.Duration(window) * time.Second
+	if !Enabled() {
+		return nil
+	}
+	if !strings.HasPrefix(address, "http://") && !strings.HasPrefix(address, "https://") {
+		return fmt.Errorf("Grafana address must start with http:// or https://, got %s", address)
+	}
+
+	return nil
+}
@@ -0,0 +1,287 @@
+/*
+Copyright © 2020 Anton Kramarev
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+package grafana
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dakaraj/gatling-to-influxdb/flags"
+	"github.com/spf13/cobra"
+)
+
+// fakeGrafana records annotations posted to it
+type fakeGrafana struct {
+	*httptest.Server
+	mu          sync.Mutex
+	annotations []annotation
+	auth        []string
+	latency     time.Duration
+}
+
+func newFakeGrafana(latency time.Duration) *fakeGrafana {
+	g := &fakeGrafana{latency: latency}
+	g.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != "/api/annotations" {
+			http.NotFound(w, r)
+			return
+		}
+		time.Sleep(g.latency)
+		var a annotation
+		if err := json.NewDecoder(r.Body).Decode(&a); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		g.mu.Lock()
+		g.annotations = append(g.annotations, a)
+		g.auth = append(g.auth, r.Header.Get("Authorization"))
+		g.mu.Unlock()
+		w.Write([]byte(`{"message":"Annotation added"}`))
+	}))
+
+	return g
+}
+
+func (g *fakeGrafana) posted() []annotation {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	return append([]annotation(nil), g.annotations...)
+}
+
+// setUp points the package to a fake Grafana and returns a function restoring defaults
+func setUp(t *testing.T, latency time.Duration, args ...string) (*fakeGrafana, func()) {
+	g := newFakeGrafana(latency)
+	cmd := &cobra.Command{}
+	flags.AddProcessing(cmd.Flags())
+	if err := cmd.ParseFlags(append([]string{"--grafana-url", g.URL + "/"}, args...)); err != nil {
+		t.Fatal(err)
+	}
+	if err := Init(cmd); err != nil {
+		t.Fatal(err)
+	}
+	ResetTestInfo()
+
+	return g, func() {
+		Flush()
+		g.Close()
+		address, apiKey, dashboardUID = "", "", ""
+		ResetTestInfo()
+	}
+}
+
+func equalTags(got []string, want ...string) bool {
+	if len(got) != len(want) {
+		return false
+	}
+	for i := range got {
+		if got[i] != want[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// addBurst adds two errors, which is a burst with burst size of 2. Bursts
+// added a minute apart are separate ones with the default window
+func addBurst(t time.Time) {
+	AddError(t, "error")
+	AddError(t.Add(time.Second), "error")
+}
+
+func TestInitRejectsAddressWithoutScheme(t *testing.T) {
+	cmd := &cobra.Command{}
+	flags.AddProcessing(cmd.Flags())
+	cmd.Flags().Set("grafana-url", "grafana:3000")
+	defer func() { address = "" }()
+
+	if err := Init(cmd); err == nil {
+		t.Fatal("expected an error for address without scheme")
+	}
+}
+
+func TestAnnotateTestStartAndEnd(t *testing.T) {
+	g, restore := setUp(t, 0, "--grafana-api-key", "secret", "--grafana-dashboard-uid", "dash")
+	defer restore()
+
+	start := time.Unix(1790000000, 0)
+	AnnotateTestStart("test1", "shop", " smoke ", "node1", start)
+	// Only the first log of a merged test annotates its start
+	AnnotateTestStart("test1", "shop", "", "node2", start.Add(time.Second))
+	AnnotateTestEnd(start.Add(time.Minute))
+
+	// AnnotateTestEnd waits until annotations are posted
+	posted := g.posted()
+	if len(posted) != 2 {
+		t.Fatalf("got %d annotations, want 2: %+v", len(posted), posted)
+	}
+	s, e := posted[0], posted[1]
+	if s.Text != "Test test1 started: shop (smoke)" || s.Time != 1790000000000 {
+		t.Errorf("unexpected start annotation: %+v", s)
+	}
+	if !equalTags(s.Tags, "g2i", "test1", "shop", "node1", "start") {
+		t.Errorf("unexpected start annotation tags: %v", s.Tags)
+	}
+	if e.Text != "Test test1 finished: shop" || e.Time != 1790000060000 {
+		t.Errorf("unexpected end annotation: %+v", e)
+	}
+	if !equalTags(e.Tags, "g2i", "test1", "shop", "node1", "end") {
+		t.Errorf("unexpected end annotation tags: %v", e.Tags)
+	}
+	for i, a := range posted {
+		if a.DashboardUID != "dash" {
+			t.Errorf("annotation %d posted to dashboard %q, want dash", i, a.DashboardUID)
+		}
+		if g.auth[i] != "Bearer secret" {
+			t.Errorf("annotation %d posted with authorization %q", i, g.auth[i])
+		}
+	}
+}
+
+func TestAddErrorAnnotatesBursts(t *testing.T) {
+	g, restore := setUp(t, 0, "--grafana-error-burst", "3", "--grafana-error-window", "10")
+	defer restore()
+
+	start := time.Unix(1790000000, 0)
+	AnnotateTestStart("test1", "shop", "", "node1", start)
+	// Two errors are below threshold, then a burst of five is annotated once
+	AddError(start, "first")
+	AddError(start.Add(20*time.Second), "second")
+	for i := 0; i < 5; i++ {
+		AddError(start.Add(40*time.Second+time.Duration(i)*time.Second), "timeout\n")
+	}
+	// Another burst after error rate falls below threshold
+	for i := 0; i < 3; i++ {
+		AddError(start.Add(80*time.Second+time.Duration(i)*time.Second), "refused")
+	}
+	Flush()
+
+	posted := g.posted()
+	if len(posted) != 3 {
+		t.Fatalf("got %d annotations, want start and 2 bursts: %+v", len(posted), posted)
+	}
+	b := posted[1]
+	if b.Time != 1790000040000 || b.TimeEnd != 1790000042000 {
+		t.Errorf("unexpected burst time range: %d - %d", b.Time, b.TimeEnd)
+	}
+	if b.Text != "Burst of 3 errors within 10s in test test1. Last error: timeout" {
+		t.Errorf("unexpected burst text: %s", b.Text)
+	}
+	if !equalTags(b.Tags, "g2i", "test1", "shop", "node1", "errors") {
+		t.Errorf("unexpected burst tags: %v", b.Tags)
+	}
+	if posted[2].Time != 1790000080000 {
+		t.Errorf("second burst starts at %d, want 1790000080000", posted[2].Time)
+	}
+}
+
+func TestSlowGrafanaDoesNotBlockProcessing(t *testing.T) {
+	latency := 200 * time.Millisecond
+	g, restore := setUp(t, latency, "--grafana-error-burst", "2")
+	defer restore()
+
+	start := time.Unix(1790000000, 0)
+	began := time.Now()
+	AnnotateTestStart("test1", "shop", "", "node1", start)
+	for i := 0; i < 3; i++ {
+		addBurst(start.Add(time.Duration(i) * time.Minute))
+	}
+	if d := time.Since(began); d >= latency {
+		t.Errorf("queueing annotations took %v, it must not wait for Grafana", d)
+	}
+
+	Flush()
+	if n := len(g.posted()); n != 4 {
+		t.Errorf("got %d annotations after flush, want 4", n)
+	}
+}
+
+func TestAnnotationsDroppedWhenQueueIsFull(t *testing.T) {
+	g, restore := setUp(t, 5*time.Millisecond, "--grafana-error-burst", "2")
+	defer restore()
+
+	start := time.Unix(1790000000, 0)
+	AnnotateTestStart("test1", "shop", "", "node1", start)
+	for i := 0; i < queueSize+10; i++ {
+		addBurst(start.Add(time.Duration(i) * time.Minute))
+	}
+	Flush()
+
+	if n := len(g.posted()); n >= queueSize+11 {
+		t.Errorf("got %d annotations, expected some of them to be dropped", n)
+	}
+}
+
+func TestConcurrentAnnotations(t *testing.T) {
+	g, restore := setUp(t, 0, "--grafana-error-burst", "2")
+	defer restore()
+
+	start := time.Unix(1790000000, 0)
+	wg := &sync.WaitGroup{}
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		AnnotateTestStart("test1", "shop", "", "node1", start)
+		for i := 0; i < 10; i++ {
+			addBurst(start.Add(time.Duration(i) * time.Minute))
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		AnnotateTestEnd(start.Add(time.Hour))
+	}()
+	wg.Wait()
+	Flush()
+
+	if n := len(g.posted()); n != 12 {
+		t.Errorf("got %d annotations, want 12", n)
+	}
+}
+
+func TestAnnotateTestEndWaitsOnlyUntilDeadline(t *testing.T) {
+	g, restore := setUp(t, 300*time.Millisecond)
+	defer restore()
+	defer func(d time.Duration) { flushTimeout = d }(flushTimeout)
+	flushTimeout = 500 * time.Millisecond
+
+	start := time.Unix(1790000000, 0)
+	AnnotateTestStart("test1", "shop", "", "node1", start)
+	for i := 0; i < 5; i++ {
+		enqueue(annotation{Text: "queued"})
+	}
+	began := time.Now()
+	AnnotateTestEnd(start.Add(time.Minute))
+
+	// Each annotation is posted in time, but all of them together are not
+	if took := time.Since(began); took > time.Second {
+		t.Errorf("Expected waiting to stop after %v, took %v", flushTimeout, took)
+	}
+	if n := len(g.posted()); n == 0 || n >= 7 {
+		t.Errorf("Expected only some of 7 annotations to be posted before deadline, got %d", n)
+	}
+}
@@ -24,14 +24,17 @@ package influx
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"runtime"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/dakaraj/gatling-to-influxdb/grafana"
 	l "github.com/dakaraj/gatling-to-influxdb/logger"
 	_ "github.com/influxdata/influxdb1-client" // workaround from client documentation
-	client "github.com/influxdata/influxdb1-client/v2"
+	"github.com/influxdata/influxdb1-client/models"
 	infc "github.com/influxdata/influxdb1-client/v2"
 	"github.com/spf13/cobra"
 )
@@ -40,78 +43,222 @@ type testInfo struct {
 	testID         string
 	simulationName string
 	description    string
-	nodeName       string
+	nodeNames      []string
 	testStartTime  time.Time
 }
 
-type userLineData struct {
-	timestamp time.Time
-	scenario  string
-	status    string
-}
-
 var (
-	c         infc.Client
-	dbName    string
-	info      testInfo
-	lastPoint time.Time
-	maxPoints uint
+	c                  infc.Client
+	dbName             string
+	measurementPrefix  string
+	maxPoints          uint
+	usersInterval      uint
+	usersReorderWindow uint
 
 	// pc is a channel to send all point from parser to
 	pc = make(chan *infc.Point, 1000)
 	// uc is a channel for userLineData processing
 	uc = make(chan userLineData, 1000)
 
-	// TODO: parameterize later
-	writeDataTimeout = 5
+	// writeDataTimeout is max time points wait in a batch before being sent
+	writeDataTimeout = 5 * time.Second
+	// retryDelay is time to wait before a failed batch is sent again
+	retryDelay = 2 * time.Second
+
+	// infoMu guards test information, which is set by parser and read by consumers
+	infoMu sync.Mutex
+	info   testInfo
+	// lastPoint is the latest point timestamp (ns) used for a closing point,
+	// it is updated atomically as points are sent from several goroutines
+	lastPoint int64
 )
 
-// InitTestInfo collect basic test information to be used by Influx client
+// InitTestInfo collect basic test information to be used by Influx client.
+// When several logs are parsed for a single test it is called once per log,
+// the first call sets test information while others only register a node
 func InitTestInfo(testID, simulationName, description, nodeName string, testStartTime time.Time) {
-	info = testInfo{
-		testID:         testID,
-		simulationName: simulationName,
-		description:    description,
-		nodeName:       nodeName,
-		testStartTime:  testStartTime,
+	infoMu.Lock()
+	defer infoMu.Unlock()
+	if info.testStartTime.IsZero() {
+		info = testInfo{
+			testID:         testID,
+			simulationName: simulationName,
+			description:    description,
+			testStartTime:  testStartTime,
+		}
+	}
+	info.nodeNames = append(info.nodeNames, nodeName)
+}
+
+// ResetTestInfo discards test information, so another test can be processed
+func ResetTestInfo() {
+	infoMu.Lock()
+	info = testInfo{}
+	infoMu.Unlock()
+	atomic.StoreInt64(&lastPoint, 0)
+}
+
+// currentTestInfo returns a copy of test information safe to be used by consumers
+func currentTestInfo() testInfo {
+	infoMu.Lock()
+	defer infoMu.Unlock()
+	t := info
+	t.nodeNames = append([]string(nil), info.nodeNames...)
+
+	return t
+}
+
+// updateLastPoint saves the latest point timestamp, as points of a log processed
+// in parallel are not sent in time order
+func updateLastPoint(t time.Time) {
+	n := t.UnixNano()
+	for {
+		last := atomic.LoadInt64(&lastPoint)
+		if n <= last || atomic.CompareAndSwapInt64(&lastPoint, last, n) {
+			return
+		}
+	}
+}
+
+// lastPointTime returns the latest point timestamp, it is zero if no points were sent
+func lastPointTime() time.Time {
+	n := atomic.LoadInt64(&lastPoint)
+	if n == 0 {
+		return time.Time{}
 	}
+
+	return time.Unix(0, n)
+}
+
+// Measurement returns a full measurement name as it is written to the database
+func Measurement(name string) string {
+	return measurementPrefix + name
+}
+
+// InitSchema reads settings of measurement naming, it is called automatically when
+// connection is initialized, so it is only required by commands that don't connect to database
+func InitSchema(cmd *cobra.Command) {
+	measurementPrefix, _ = cmd.Flags().GetString("measurement-prefix")
+}
+
+// tagBuffer keeps memory used to prepare tags of a point. Tags are only used to build
+// a point key, which is a copy, so buffers are pooled instead of being allocated per point
+type tagBuffer struct {
+	b    []byte
+	tags models.Tags
+}
+
+var tagBuffers = sync.Pool{
+	New: func() interface{} { return &tagBuffer{} },
 }
 
 // NewPoint is mostly an alias fo standard NewPoint function from influx package,
-// except timestamp is required
+// except timestamp is required and measurement name is prefixed if configured
 func NewPoint(name string, tags map[string]string, fields map[string]interface{}, t time.Time) (*infc.Point, error) {
-	return infc.NewPoint(name, tags, fields, t)
+	tb := tagBuffers.Get().(*tagBuffer)
+	defer tagBuffers.Put(tb)
+
+	// Buffer is grown before tags are sliced from it, so it is not reallocated after
+	size := 0
+	for k, v := range tags {
+		size += len(k) + len(v)
+	}
+	if cap(tb.b) < size {
+		tb.b = make([]byte, 0, size)
+	}
+	tb.b = tb.b[:0]
+	tb.tags = tb.tags[:0]
+	for k, v := range tags {
+		start := len(tb.b)
+		tb.b = append(tb.b, k...)
+		tb.b = append(tb.b, v...)
+		tb.tags = append(tb.tags, models.NewTag(tb.b[start:start+len(k)], tb.b[start+len(k):]))
+	}
+	sort.Sort(&tb.tags)
+
+	pt, err := models.NewPoint(Measurement(name), tb.tags, fields, t)
+	if err != nil {
+		return nil, err
+	}
+
+	return infc.NewPointFrom(pt), nil
 }
 
 // SendPoint sends point to the channel listened by metrics consumer
 func SendPoint(p *infc.Point) {
+	// The latest point timestamp is saved for use as a closing point.
+	// Don't use users data because it has aggregated time stamp instead of concrete one
+	if p.Name() != Measurement("users") {
+		updateLastPoint(p.Time())
+	}
 	pc <- p
 }
 
+// sendBatch sends points to the database, points are split by retention policies
+// their measurements are routed to
 func sendBatch(points []*infc.Point) {
+	sendRouted(points, writeConsistency)
+}
+
+func sendRouted(points []*infc.Point, consistency string) {
+	if len(retentionRoutes) == 0 {
+		sendBatchTo(retentionPolicy, consistency, points)
+		return
+	}
+
+	byPolicy := make(map[string][]*infc.Point)
+	var policies []string
+	for _, p := range points {
+		rp := retentionPolicyOf(p.Name())
+		if _, found := byPolicy[rp]; !found {
+			policies = append(policies, rp)
+		}
+		byPolicy[rp] = append(byPolicy[rp], p)
+	}
+	for _, rp := range policies {
+		sendBatchTo(rp, consistency, byPolicy[rp])
+	}
+}
+
+func sendBatchTo(rp, consistency string, points []*infc.Point) {
 	const retries = 5
 
 	bp, _ := infc.NewBatchPoints(infc.BatchPointsConfig{
-		Precision: "ns",
-		Database:  dbName,
+		Precision:        "ns",
+		Database:         dbName,
+		RetentionPolicy:  rp,
+		WriteConsistency: consistency,
 	})
 	bp.AddPoints(points)
 
-	// Retry mechanism for batch points sending
+	// Retry mechanism for batch points sending, only errors that may
+	// disappear with time are retried
 	var errCounter int
-SendLoop:
 	for {
 		err := c.Write(bp)
-		if err != nil {
-			l.Errorf("Error sending points batch to InfluxDB: %v\n", err)
-			errCounter++
-			if errCounter == retries {
-				l.Errorf("Failed to send %d points as batch to server\n", len(points))
-				return
+		if err == nil {
+			break
+		}
+		var we *writeError
+		if errors.As(err, &we) && !we.temporary() {
+			if we.partial() {
+				l.Errorf("Some of %d points were rejected by InfluxDB: %v\n", len(points), err)
+			} else {
+				l.Errorf("Batch of %d points was rejected by InfluxDB: %v\n", len(points), err)
 			}
-			time.Sleep(2 * time.Second)
+			return
 		}
-		break SendLoop
+		l.Errorf("Error sending points batch to InfluxDB: %v\n", err)
+		errCounter++
+		if errCounter == retries {
+			l.Errorf("Failed to send %d points as batch to server\n", len(points))
+			return
+		}
+		wait := retryDelay
+		if we != nil && we.retryAfter > wait {
+			wait = we.retryAfter
+		}
+		time.Sleep(wait)
 	}
 
 	if errCounter > 0 {
@@ -122,142 +269,38 @@ SendLoop:
 	l.Debugf("Successfully written %d points to DB\n", len(points))
 }
 
-// SendUserLineData takes a line with user data and adds it to the processing list
-func SendUserLineData(timestamp time.Time, scenario, status string) {
-	uld := userLineData{timestamp, scenario, status}
-
-	uc <- uld
-}
-
-func sendUserData(m map[string]int, ts time.Time) ([]*client.Point, error) {
-	// Prepare points
-	points := make([]*client.Point, 0, len(m))
-	for k, v := range m {
-		point, err := client.NewPoint(
-			"users",
-			map[string]string{
-				"scenario": k,
-				"testId":   info.testID,
-				"nodeName": info.nodeName,
-			},
-			map[string]interface{}{
-				"active": v,
-			},
-			ts,
-		)
-		if err != nil {
-			return nil, fmt.Errorf("Error creating new point with user data: %w", err)
-		}
-
-		points = append(points, point)
-
+// WritePoints synchronously sends points to the database. If total amount of points
+// is higher than allowed batch amount it is split and sent in batches
+func WritePoints(points []*infc.Point) {
+	for len(points) > int(maxPoints) {
+		sendBatch(points[:int(maxPoints)])
+		points = points[int(maxPoints):]
+	}
+	if len(points) > 0 {
+		sendBatch(points)
 	}
-
-	return points, nil
 }
 
-func usersProcessor(ctx context.Context, wg *sync.WaitGroup) {
-	// Send current user state to database each N seconds
-	const timeRangeLen = 5
-	defer wg.Done()
-
-	// Workaround:
-	// Wait for testInfo to fill
-	for {
-		if !info.testStartTime.IsZero() {
-			break
-		}
-		time.Sleep(time.Second)
+// ForwardPoints synchronously sends points received from another g2i instance, which
+// already chose retention policy and write consistency. Points without a retention
+// policy are routed by own settings, empty consistency is replaced by own one too
+func ForwardPoints(points []*infc.Point, rp, consistency string) {
+	if consistency == "" {
+		consistency = writeConsistency
 	}
-
-	secondFrom := info.testStartTime.Round(time.Second)
-	secondTo := secondFrom.Add(time.Second * timeRangeLen)
-	usersMap := make(map[string]int)
-
-CollectorLoop:
-	for {
-		select {
-		// If an external cancellation signal is received
-		case <-ctx.Done():
-			// Init closeup
-			closingPointTime := lastPoint
-			var points []*client.Point
-			// Fill empty points with last available data
-			// Last point in buffer should always be sent. So this is an imitation of do-while loop
-			for {
-				// Advance searching range for next N seconds
-				secondFrom, secondTo = secondTo, secondTo.Add(time.Second*timeRangeLen)
-
-				// Collect remaining points
-				pts, err := sendUserData(usersMap, secondFrom)
-				if err != nil {
-					l.Errorf("Failed to send user data: %v", err)
-					continue
-				}
-				points = append(points, pts...)
-
-				// Stop the loop when meeting the closing point time
-				if !secondTo.Before(closingPointTime) {
-					break
-				}
-			}
-			// If total amount of points is higher than allowed batch amount
-			// it is split and sent in batches
-			for len(points) > int(maxPoints) {
-				sendBatch(points[:int(maxPoints)])
-				points = points[int(maxPoints):]
-			}
-			sendBatch(points)
-
-			break CollectorLoop
-
-		// On each new user line data
-		case p := <-uc:
-		SearcherLoop:
-			for {
-				// If point is somehow from the past
-				if p.timestamp.Before(secondFrom) {
-					// Then we just update the map
-					switch p.status {
-					case "START":
-						usersMap[p.scenario]++
-					case "END":
-						usersMap[p.scenario]--
-					}
-
-					break SearcherLoop
-				}
-
-				// TODO: May combine with previous one later
-				// If timestamp is a part of the current time range
-				if (p.timestamp.After(secondFrom) || p.timestamp.Equal(secondFrom)) && p.timestamp.Before(secondTo) {
-					// We update the map
-					switch p.status {
-					case "START":
-						usersMap[p.scenario]++
-					case "END":
-						usersMap[p.scenario]--
-					}
-
-					break SearcherLoop
-				}
-
-				// Else we assume this time range is done and advance searching range for next N seconds
-				secondFrom, secondTo = secondTo, secondTo.Add(time.Second*timeRangeLen)
-
-				// And send data for previous range
-				points, err := sendUserData(usersMap, secondFrom)
-				if err != nil {
-					l.Errorf("Failed to send user data: %v", err)
-					continue
-				}
-				for _, p := range points {
-					pc <- p
-				}
-
-				// Loop is then advanced looking for suitable range
-			}
+	send := func(batch []*infc.Point) {
+		if rp == "" {
+			sendRouted(batch, consistency)
+			return
 		}
+		sendBatchTo(rp, consistency, batch)
+	}
+	for len(points) > int(maxPoints) {
+		send(points[:int(maxPoints)])
+		points = points[int(maxPoints):]
+	}
+	if len(points) > 0 {
+		send(points)
 	}
 }
 
@@ -265,7 +308,7 @@ func metricsPointsCollector(ctx context.Context, wg *sync.WaitGroup) {
 	defer wg.Done()
 	points := make([]*infc.Point, 0, int(maxPoints))
 
-	timer := time.NewTimer(time.Second * time.Duration(writeDataTimeout))
+	timer := time.NewTimer(writeDataTimeout)
 CollectorLoop:
 	for {
 		select {
@@ -277,7 +320,7 @@ CollectorLoop:
 				points = make([]*infc.Point, 0, int(maxPoints))
 			}
 			// Reset timer
-			timer.Reset(time.Second * time.Duration(writeDataTimeout))
+			timer.Reset(writeDataTimeout)
 		// When point is received on the channel
 		case p := <-pc:
 			points = append(points, p)
@@ -287,15 +330,25 @@ CollectorLoop:
 				// After sending points to server clear points buffer
 				points = make([]*infc.Point, 0, maxPoints)
 				// Reset timer
-				timer.Reset(time.Second * time.Duration(writeDataTimeout))
-			}
-			// Each point received saves its timestamp for use as a closing point
-			// Don't use users data because it has aggregated time stamp instead of concrete one
-			if p.Name() != "users" {
-				lastPoint = p.Time()
+				timer.Reset(writeDataTimeout)
 			}
 		// Await for external stop signal
 		case <-ctx.Done():
+			// Collect points still waiting in the channel, parser may be
+			// much faster than the collector when reading a complete log
+		DrainLoop:
+			for {
+				select {
+				case p := <-pc:
+					points = append(points, p)
+					if len(points) == int(maxPoints) {
+						sendBatch(points)
+						points = make([]*infc.Point, 0, int(maxPoints))
+					}
+				default:
+					break DrainLoop
+				}
+			}
 			// Send any unsent points
 			if len(points) > 0 {
 				sendBatch(points)
@@ -307,30 +360,38 @@ CollectorLoop:
 }
 
 func sendClosingPoint() {
+	ti := currentTestInfo()
 	// If info struct is empty, then parsing of file did not start,
 	// so there is no need to send closing point
-	if info.testStartTime.IsZero() {
+	if ti.testStartTime.IsZero() {
 		l.Infoln("Skipping stop test point write...")
 		return
 	}
 
-	// Create a point signifying a test end
-	p, _ := infc.NewPoint(
-		"tests",
-		map[string]string{
-			"action":     "end",
-			"simulation": info.simulationName,
-			"testId":     info.testID,
-			"nodeName":   info.nodeName,
-		},
-		map[string]interface{}{
-			"description": info.description,
-		},
-		// Add 5 secods to the time since last point was received
-		lastPoint.Add(time.Second*5),
-	)
-
-	sendBatch([]*infc.Point{p})
+	// Add 5 secods to the time since last point was received
+	endTime := lastPointTime().Add(time.Second * 5)
+	grafana.AnnotateTestEnd(endTime)
+
+	// Create a point signifying a test end for each node
+	points := make([]*infc.Point, 0, len(ti.nodeNames))
+	for _, n := range ti.nodeNames {
+		p, _ := NewPoint(
+			"tests",
+			map[string]string{
+				"action":     "end",
+				"simulation": ti.simulationName,
+				"testId":     ti.testID,
+				"nodeName":   n,
+			},
+			map[string]interface{}{
+				"description": ti.description,
+			},
+			endTime,
+		)
+		points = append(points, p)
+	}
+
+	sendBatch(points)
 }
 
 // StartProcessing starts consumers that receive points from parser and send to
@@ -339,64 +400,86 @@ func StartProcessing(ctx context.Context, owg *sync.WaitGroup) {
 	defer owg.Done()
 
 	l.Infoln("Starting consumers for parser results")
-	wg := &sync.WaitGroup{}
+	upWG, mpcWG := &sync.WaitGroup{}, &sync.WaitGroup{}
 
 	// start requests consumer
 	upCtx, upCancel := context.WithCancel(context.Background())
 	mpcCtx, mpcCancel := context.WithCancel(context.Background())
-	wg.Add(2)
-	go usersProcessor(upCtx, wg)
-	go metricsPointsCollector(mpcCtx, wg)
+	upWG.Add(1)
+	mpcWG.Add(1)
+	go usersProcessor(upCtx, upWG)
+	go metricsPointsCollector(mpcCtx, mpcWG)
 
 	// Wait for external stop signal
 	<-ctx.Done()
 
 	l.Infoln("Stopping all points processor...")
+	// Users processor sends points to the collector, so it is stopped first
+	// and the collector still sends everything it received
 	upCancel()
-	mpcCancel() // This should be the last one
-
-	wg.Wait()
+	upWG.Wait()
+	mpcCancel()
+	mpcWG.Wait()
 	sendClosingPoint()
 	l.Infoln("Points processor finished")
+}
 
-	err := CloseDBConnection()
-	if err != nil {
-		l.Errorf("Failed to close DB connection: %v", err)
+// StartForwarding starts only a consumer sending points to InfluxDB server, it is used
+// when points are received already prepared instead of being parsed from a log
+func StartForwarding(ctx context.Context, owg *sync.WaitGroup) {
+	defer owg.Done()
+
+	wg := &sync.WaitGroup{}
+	wg.Add(1)
+	go metricsPointsCollector(ctx, wg)
+	wg.Wait()
+	l.Infoln("Points forwarding finished")
+}
+
+// InitProcessing reads settings of points processing that are only required
+// when parsing a log file
+func InitProcessing(cmd *cobra.Command) error {
+	usersInterval, _ = cmd.Flags().GetUint("users-interval")
+	if usersInterval == 0 {
+		return fmt.Errorf("Users snapshot interval must be greater than zero")
 	}
+	usersReorderWindow, _ = cmd.Flags().GetUint("users-reorder-window")
+
+	return nil
 }
 
 // InitInfluxConnection establishes connection to InfluxDB database
 // and checks if it is successful
 func InitInfluxConnection(cmd *cobra.Command) error {
-	username, _ := cmd.Flags().GetString("username")
-	password, _ := cmd.Flags().GetString("password")
 	address, _ := cmd.Flags().GetString("address")
 	dbName, _ = cmd.Flags().GetString("database")
 	maxPoints, _ = cmd.Flags().GetUint("max-batch-size")
+	pingTimeout, _ := cmd.Flags().GetUint("ping-timeout")
 	detached, _ := cmd.Flags().GetBool("detached")
+	InitSchema(cmd)
+	if err := initRetention(cmd); err != nil {
+		return fmt.Errorf("Invalid write settings: %w", err)
+	}
 
-	var err error
-	c, err = infc.NewHTTPClient(infc.HTTPConfig{
-		Addr:      address,
-		Username:  username,
-		Password:  password,
-		UserAgent: fmt.Sprintf("g2i-http-client-%s(%s)", cmd.Version, runtime.Version()),
-		Timeout:   time.Second * 60,
-	})
+	conf, err := httpConfig(cmd)
+	if err != nil {
+		return fmt.Errorf("Invalid connection settings: %w", err)
+	}
+	checks, err := readPreflightSettings(cmd)
 	if err != nil {
 		return err
 	}
-
-	_, _, err = c.Ping(time.Second * 10)
+	c, err = newWriteClient(conf)
 	if err != nil {
-		return fmt.Errorf("Connection with InfluxDB at %s could not be established. Error: %w", address, err)
+		return err
 	}
-	res, err := c.Query(infc.NewQuery("SHOW MEASUREMENTS", dbName, ""))
+
+	_, _, err = c.Ping(time.Second * time.Duration(pingTimeout))
 	if err != nil {
 		return fmt.Errorf("Connection with InfluxDB at %s could not be established. Error: %w", address, err)
 	}
-	if err := res.Error(); err != nil {
-		return fmt.Errorf("Test query failed with error: %w", err)
+	if err := preflight(checks); err != nil {
+		return err
 	}
 	if !detached {
 		l.Infof("Connection with InfluxDB at %s successfully established\n", address)
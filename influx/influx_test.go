@@ -0,0 +1,435 @@
+/*
+Copyright © 2020 Anton Kramarev
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+package influx
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dakaraj/gatling-to-influxdb/flags"
+	"github.com/dakaraj/gatling-to-influxdb/influx/influxtest"
+	infc "github.com/influxdata/influxdb1-client/v2"
+	"github.com/spf13/cobra"
+)
+
+// testDB is a database tests write to
+const testDB = "g2i_test"
+
+// newTestCommand returns a command with connection flags of the application pointed
+// to a fake server, flags are parsed from args
+func newTestCommand(t *testing.T, srv *influxtest.Server, args ...string) *cobra.Command {
+	cmd := &cobra.Command{Use: "test"}
+	flags.AddConnection(cmd.Flags())
+	if err := cmd.ParseFlags(append([]string{"--address", srv.URL, "--database", testDB}, args...)); err != nil {
+		t.Fatalf("Failed to parse flags: %v", err)
+	}
+
+	return cmd
+}
+
+// setUp starts a fake server and saves shared state of the package, returned function
+// stops the server and restores the state
+func setUp(t *testing.T) (*influxtest.Server, func()) {
+	srv := influxtest.NewServer(testDB)
+	timeout, delay := writeDataTimeout, retryDelay
+	interval, window := usersInterval, usersReorderWindow
+	prefix := measurementPrefix
+	// Retries are not delayed unless a server asks for it
+	retryDelay = 10 * time.Millisecond
+	ResetTestInfo()
+
+	return srv, func() {
+		if c != nil {
+			c.Close()
+		}
+		srv.Close()
+		writeDataTimeout, retryDelay = timeout, delay
+		usersInterval, usersReorderWindow = interval, window
+		measurementPrefix = prefix
+		ResetTestInfo()
+	}
+}
+
+// connect connects to a fake server with flags parsed from args
+func connect(t *testing.T, srv *influxtest.Server, args ...string) {
+	if err := InitInfluxConnection(newTestCommand(t, srv, args...)); err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+}
+
+// testPoints returns request points one millisecond apart
+func testPoints(n int, start time.Time) []*infc.Point {
+	points := make([]*infc.Point, 0, n)
+	for i := 0; i < n; i++ {
+		p, _ := NewPoint(
+			"requests",
+			map[string]string{"testId": "test", "name": "request", "result": "OK"},
+			map[string]interface{}{"duration": i},
+			start.Add(time.Duration(i)*time.Millisecond),
+		)
+		points = append(points, p)
+	}
+
+	return points
+}
+
+// expectWrites checks amount of write requests and stored lines
+func expectWrites(t *testing.T, srv *influxtest.Server, requests, lines int) {
+	t.Helper()
+	if n := len(srv.Writes()); n != requests {
+		t.Errorf("Expected %d write requests, server received %d", requests, n)
+	}
+	if n := len(srv.Lines()); n != lines {
+		t.Errorf("Expected %d lines written, server stored %d", lines, n)
+	}
+}
+
+func TestInitInfluxConnection(t *testing.T) {
+	srv, tearDown := setUp(t)
+	defer tearDown()
+
+	connect(t, srv)
+	if srv.Pings() != 1 {
+		t.Errorf("Expected a single ping, server received %d", srv.Pings())
+	}
+	if q := srv.Queries(); len(q) != 1 || q[0] != "SHOW DATABASES" {
+		t.Errorf("Expected database existence check, server received queries %q", q)
+	}
+	// Test write has no points
+	expectWrites(t, srv, 1, 0)
+}
+
+func TestInitInfluxConnectionMissingDatabase(t *testing.T) {
+	srv, tearDown := setUp(t)
+	defer tearDown()
+
+	if err := InitInfluxConnection(newTestCommand(t, srv, "--database", "missing")); err == nil {
+		t.Error("Connection to a missing database succeeded")
+	}
+}
+
+func TestInitInfluxConnectionMissingDatabaseFoundByTestWrite(t *testing.T) {
+	srv, tearDown := setUp(t)
+	defer tearDown()
+
+	// Databases can't be listed without read access
+	srv.Inject(influxtest.Query, influxtest.Fault{Status: 403})
+	if err := InitInfluxConnection(newTestCommand(t, srv, "--database", "missing")); err == nil {
+		t.Error("Connection to a missing database succeeded")
+	}
+	expectWrites(t, srv, 1, 0)
+}
+
+func TestInitInfluxConnectionUnlistedDatabase(t *testing.T) {
+	srv, tearDown := setUp(t)
+	defer tearDown()
+
+	// Write only user gets an empty list of databases without an error
+	srv.HideDatabases(true)
+	connect(t, srv)
+	expectWrites(t, srv, 1, 0)
+}
+
+func TestInitInfluxConnectionUnlistedMissingDatabase(t *testing.T) {
+	srv, tearDown := setUp(t)
+	defer tearDown()
+
+	srv.HideDatabases(true)
+	if err := InitInfluxConnection(newTestCommand(t, srv, "--database", "missing")); err == nil {
+		t.Error("Connection to a missing database succeeded")
+	}
+	expectWrites(t, srv, 1, 0)
+}
+
+func TestInitInfluxConnectionCreatesUnlistedMissingDatabase(t *testing.T) {
+	srv, tearDown := setUp(t)
+	defer tearDown()
+
+	srv.HideDatabases(true)
+	connect(t, srv, "--database", "created", "--create-database")
+	// Database is created only after the test write reports it missing
+	if q := srv.Queries(); len(q) != 2 || q[1] != `CREATE DATABASE "created"` {
+		t.Errorf("Expected database to be created after test write, server received queries %q", q)
+	}
+	expectWrites(t, srv, 2, 0)
+}
+
+func TestInitInfluxConnectionCreatesDatabase(t *testing.T) {
+	srv, tearDown := setUp(t)
+	defer tearDown()
+
+	connect(t, srv, "--database", "created", "--create-database")
+	for _, db := range srv.Databases() {
+		if db == "created" {
+			return
+		}
+	}
+	t.Error("Database was not created")
+}
+
+func TestInitInfluxConnectionFailedPing(t *testing.T) {
+	srv, tearDown := setUp(t)
+	defer tearDown()
+
+	srv.Inject(influxtest.Ping, influxtest.Fault{Status: 503})
+	if err := InitInfluxConnection(newTestCommand(t, srv)); err == nil {
+		t.Error("Connection succeeded although ping failed")
+	}
+}
+
+func TestInitInfluxConnectionUnresponsiveServer(t *testing.T) {
+	srv, tearDown := setUp(t)
+	defer tearDown()
+
+	srv.Inject(influxtest.Ping, influxtest.Fault{Latency: 3 * time.Second})
+	if err := InitInfluxConnection(newTestCommand(t, srv, "--http-timeout", "1")); err == nil {
+		t.Error("Connection succeeded although server did not respond")
+	}
+}
+
+func TestSendBatch(t *testing.T) {
+	srv, tearDown := setUp(t)
+	defer tearDown()
+
+	connect(t, srv, "--dry-run-write=false")
+	sendBatch(testPoints(10, time.Now()))
+	expectWrites(t, srv, 1, 10)
+	if w := srv.Writes()[0]; w.Database != testDB || w.Precision != "ns" {
+		t.Errorf("Batch was written to database %q with precision %q", w.Database, w.Precision)
+	}
+}
+
+func TestSendBatchCompressed(t *testing.T) {
+	srv, tearDown := setUp(t)
+	defer tearDown()
+
+	connect(t, srv, "--dry-run-write=false", "--gzip")
+	sendBatch(testPoints(10, time.Now()))
+	expectWrites(t, srv, 1, 10)
+	if w := srv.Writes(); len(w) == 0 || !w[0].Gzip {
+		t.Error("Batch was not compressed")
+	}
+}
+
+func TestSendBatchRoutesRetentionPolicies(t *testing.T) {
+	srv, tearDown := setUp(t)
+	defer tearDown()
+
+	connect(t, srv, "--dry-run-write=false", "--retention-policy", "forever", "--retention-policy-route", "requests=week")
+	sendBatch(testPoints(10, time.Now()))
+	expectWrites(t, srv, 1, 10)
+	if w := srv.Writes(); len(w) == 0 || w[0].RetentionPolicy != "week" {
+		t.Errorf("Requests were not written to routed retention policy: %+v", w)
+	}
+}
+
+func TestSendBatchRetriesServerErrors(t *testing.T) {
+	srv, tearDown := setUp(t)
+	defer tearDown()
+
+	connect(t, srv, "--dry-run-write=false")
+	srv.Inject(influxtest.Write, influxtest.Fault{Status: 500}, influxtest.Fault{Status: 503}, influxtest.Fault{Status: 429})
+	sendBatch(testPoints(10, time.Now()))
+	expectWrites(t, srv, 4, 10)
+}
+
+func TestSendBatchRetriesAfterTimeout(t *testing.T) {
+	srv, tearDown := setUp(t)
+	defer tearDown()
+
+	connect(t, srv, "--dry-run-write=false", "--http-timeout", "1")
+	srv.Inject(influxtest.Write, influxtest.Fault{Latency: 3 * time.Second})
+	sendBatch(testPoints(10, time.Now()))
+	expectWrites(t, srv, 2, 10)
+}
+
+func TestSendBatchRespectsRetryAfter(t *testing.T) {
+	srv, tearDown := setUp(t)
+	defer tearDown()
+
+	connect(t, srv, "--dry-run-write=false")
+	srv.Inject(influxtest.Write, influxtest.Fault{Status: 429, RetryAfter: time.Second})
+	start := time.Now()
+	sendBatch(testPoints(10, time.Now()))
+	if elapsed := time.Since(start); elapsed < time.Second {
+		t.Errorf("Batch was sent again after %v instead of 1s", elapsed)
+	}
+	expectWrites(t, srv, 2, 10)
+}
+
+func TestSendBatchGivesUpAfterRetries(t *testing.T) {
+	srv, tearDown := setUp(t)
+	defer tearDown()
+
+	connect(t, srv, "--dry-run-write=false")
+	for i := 0; i < 5; i++ {
+		srv.Inject(influxtest.Write, influxtest.Fault{Status: 503})
+	}
+	sendBatch(testPoints(10, time.Now()))
+	expectWrites(t, srv, 5, 0)
+	// Following batches are still sent
+	sendBatch(testPoints(10, time.Now()))
+	expectWrites(t, srv, 6, 10)
+}
+
+func TestSendBatchDoesNotRetryRejected(t *testing.T) {
+	srv, tearDown := setUp(t)
+	defer tearDown()
+
+	connect(t, srv, "--dry-run-write=false")
+	srv.Inject(influxtest.Write, influxtest.Fault{Status: 400, Message: "bad request"})
+	sendBatch(testPoints(10, time.Now()))
+	expectWrites(t, srv, 1, 0)
+}
+
+func TestSendBatchDoesNotRetryPartialWrite(t *testing.T) {
+	srv, tearDown := setUp(t)
+	defer tearDown()
+
+	connect(t, srv, "--dry-run-write=false")
+	srv.Inject(influxtest.Write, influxtest.Fault{Dropped: 3})
+	sendBatch(testPoints(10, time.Now()))
+	expectWrites(t, srv, 1, 7)
+}
+
+// startCollector starts points collector as forwarding does, returned function stops it
+func startCollector() func() {
+	ctx, cancel := context.WithCancel(context.Background())
+	wg := &sync.WaitGroup{}
+	wg.Add(1)
+	go StartForwarding(ctx, wg)
+
+	return func() {
+		cancel()
+		wg.Wait()
+	}
+}
+
+func TestMetricsPointsCollectorSendsFullBatches(t *testing.T) {
+	srv, tearDown := setUp(t)
+	defer tearDown()
+
+	connect(t, srv, "--dry-run-write=false", "--max-batch-size", "10")
+	writeDataTimeout = time.Hour
+	stop := startCollector()
+	for _, p := range testPoints(25, time.Now()) {
+		SendPoint(p)
+	}
+	ok := srv.WaitForLines(20, 5*time.Second)
+	stop()
+	if !ok {
+		t.Fatal("Full batches were not sent before shutdown")
+	}
+	// The rest is sent on shutdown
+	expectWrites(t, srv, 3, 25)
+}
+
+func TestMetricsPointsCollectorSendsBatchOnTimeout(t *testing.T) {
+	srv, tearDown := setUp(t)
+	defer tearDown()
+
+	connect(t, srv, "--dry-run-write=false")
+	writeDataTimeout = 100 * time.Millisecond
+	stop := startCollector()
+	for _, p := range testPoints(3, time.Now()) {
+		SendPoint(p)
+	}
+	ok := srv.WaitForLines(3, 5*time.Second)
+	stop()
+	if !ok {
+		t.Fatal("Batch was not sent after timeout")
+	}
+	expectWrites(t, srv, 1, 3)
+}
+
+// TestStartProcessingFlushesOnShutdown sends points and user events from several
+// goroutines to a slow server and stops processing right away, everything must still be written
+func TestStartProcessingFlushesOnShutdown(t *testing.T) {
+	const (
+		senders   = 4
+		perSender = 500
+	)
+	srv, tearDown := setUp(t)
+	defer tearDown()
+
+	connect(t, srv, "--dry-run-write=false", "--max-batch-size", "100")
+	srv.SetLatency(20 * time.Millisecond)
+	usersInterval, usersReorderWindow = 1, 0
+	start := time.Now().Truncate(time.Second)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	wg := &sync.WaitGroup{}
+	wg.Add(1)
+	go StartProcessing(ctx, wg)
+	InitTestInfo("test", "Test", "Test description", "node1", start)
+
+	senderWG := &sync.WaitGroup{}
+	for s := 0; s < senders; s++ {
+		senderWG.Add(1)
+		go func(s int) {
+			defer senderWG.Done()
+			for i, p := range testPoints(perSender, start.Add(time.Duration(s)*time.Second)) {
+				SendPoint(p)
+				if i%100 == 0 {
+					SendUserLineData(p.Time(), "node1", "Scenario", "START")
+				}
+			}
+		}(s)
+	}
+	senderWG.Wait()
+	cancel()
+	wg.Wait()
+
+	var requests, users, ends int
+	last := start.Add(time.Duration(senders-1)*time.Second + time.Duration(perSender-1)*time.Millisecond)
+	for _, p := range srv.Points() {
+		switch string(p.Name()) {
+		case Measurement("requests"):
+			requests++
+		case Measurement("users"):
+			users++
+			if id := string(p.Tags().Get([]byte("testId"))); id != "test" {
+				t.Errorf("Users point has testId %q", id)
+			}
+		case Measurement("tests"):
+			if string(p.Tags().Get([]byte("action"))) != "end" {
+				continue
+			}
+			ends++
+			if !p.Time().Equal(last.Add(5 * time.Second)) {
+				t.Errorf("Test end is written at %v instead of %v", p.Time(), last.Add(5*time.Second))
+			}
+		}
+	}
+	if requests != senders*perSender {
+		t.Errorf("Expected %d request points, server stored %d", senders*perSender, requests)
+	}
+	if users == 0 {
+		t.Error("No users points were written")
+	}
+	if ends != 1 {
+		t.Errorf("Expected a single test end point, server stored %d", ends)
+	}
+}
@@ -0,0 +1,569 @@
+/*
+Copyright © 2020 Anton Kramarev
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+// Package influxtest provides an in-process fake of InfluxDB HTTP API. It serves
+// /ping, /query and /write endpoints of InfluxDB 1.x together with /health,
+// /api/v2/query and /api/v2/write of 2.x, records everything it receives and can
+// inject latency and error responses. Data queries return canned results, so code
+// talking to InfluxDB can be checked without a real database
+package influxtest
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/influxdata/influxdb1-client/models"
+)
+
+// Endpoints faults can be injected to. Each of them covers both 1.x and 2.x versions
+const (
+	Ping  = "ping"
+	Query = "query"
+	Write = "write"
+)
+
+// Version is reported by ping responses
+const Version = "1.8.10"
+
+// Fault is a response returned instead of a normal one
+type Fault struct {
+	// Status is HTTP status code of response, normal status is used if it is zero
+	Status int
+	// Message is an error message of response
+	Message string
+	// RetryAfter is sent in Retry-After header, rounded to seconds
+	RetryAfter time.Duration
+	// Latency delays the response
+	Latency time.Duration
+	// Dropped makes a write partial, so only lines except the last Dropped ones are stored
+	Dropped int
+}
+
+// WriteRequest is a write received by the server
+type WriteRequest struct {
+	// API is 1 for /write and 2 for /api/v2/write
+	API             int
+	Database        string
+	RetentionPolicy string
+	Precision       string
+	Consistency     string
+	Gzip            bool
+	// Lines are lines of line protocol that were stored
+	Lines  []string
+	Status int
+}
+
+// Server is a fake InfluxDB server listening on a local port
+type Server struct {
+	URL string
+
+	srv       *httptest.Server
+	mu        sync.Mutex
+	latency   time.Duration
+	databases map[string]bool
+	// hidden makes databases invisible to SHOW DATABASES
+	hidden    bool
+	responses []response
+	faults    map[string][]Fault
+	writes    []WriteRequest
+	queries   []string
+	pings     int
+}
+
+// response is a canned result of statements containing all of the given substrings
+type response struct {
+	contains []string
+	series   []Series
+}
+
+// NewServer starts a server with the given databases
+func NewServer(databases ...string) *Server {
+	s := &Server{
+		databases: make(map[string]bool),
+		faults:    make(map[string][]Fault),
+	}
+	for _, db := range databases {
+		s.databases[db] = true
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ping", s.handlePing)
+	mux.HandleFunc("/health", s.handleHealth)
+	mux.HandleFunc("/query", s.handleQuery)
+	mux.HandleFunc("/api/v2/query", s.handleFluxQuery)
+	mux.HandleFunc("/write", s.handleWrite)
+	mux.HandleFunc("/api/v2/write", s.handleWriteV2)
+	s.srv = httptest.NewServer(mux)
+	s.URL = s.srv.URL
+
+	return s
+}
+
+// Close stops the server, requests still waiting for injected latency are cancelled
+func (s *Server) Close() {
+	s.srv.CloseClientConnections()
+	s.srv.Close()
+}
+
+// SetLatency delays all responses
+func (s *Server) SetLatency(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.latency = d
+}
+
+// HideDatabases makes SHOW DATABASES respond with no series, as InfluxDB 1.x
+// does for a user without read access to any database. Writes are not affected
+func (s *Server) HideDatabases(hidden bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.hidden = hidden
+}
+
+// Respond makes SELECT and other data statements containing all of the given substrings
+// return the series. Responses are matched in order they were added, statements
+// matching none of them return no data
+func (s *Server) Respond(series []Series, contains ...string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.responses = append(s.responses, response{contains: contains, series: series})
+}
+
+// Inject queues faults of an endpoint, each of them is used for a single request in order
+func (s *Server) Inject(endpoint string, faults ...Fault) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.faults[endpoint] = append(s.faults[endpoint], faults...)
+}
+
+// Writes returns all received write requests, including failed ones
+func (s *Server) Writes() []WriteRequest {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]WriteRequest(nil), s.writes...)
+}
+
+// Lines returns all stored lines of line protocol in order they were received
+func (s *Server) Lines() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var lines []string
+	for _, w := range s.writes {
+		lines = append(lines, w.Lines...)
+	}
+
+	return lines
+}
+
+// Points returns stored points, lines that could not be parsed are skipped
+func (s *Server) Points() []models.Point {
+	var points []models.Point
+	for _, line := range s.Lines() {
+		p, err := models.ParsePointsString(line)
+		if err == nil {
+			points = append(points, p...)
+		}
+	}
+
+	return points
+}
+
+// Queries returns texts of all received queries
+func (s *Server) Queries() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.queries...)
+}
+
+// Pings returns amount of received ping and health requests
+func (s *Server) Pings() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.pings
+}
+
+// Databases returns names of existing databases
+func (s *Server) Databases() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	names := make([]string, 0, len(s.databases))
+	for db := range s.databases {
+		names = append(names, db)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// WaitForLines waits until at least n lines are stored, it returns false on timeout
+func (s *Server) WaitForLines(n int, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for {
+		if len(s.Lines()) >= n {
+			return true
+		}
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// fault takes the next fault of an endpoint, the returned one only contains
+// server latency if no fault is queued
+func (s *Server) fault(endpoint string) Fault {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var f Fault
+	if queue := s.faults[endpoint]; len(queue) > 0 {
+		f = queue[0]
+		s.faults[endpoint] = queue[1:]
+	}
+	f.Latency += s.latency
+
+	return f
+}
+
+// delay waits for injected latency, it returns false if client has gone meanwhile
+func delay(r *http.Request, d time.Duration) bool {
+	if d <= 0 {
+		return true
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-r.Context().Done():
+		return false
+	}
+}
+
+// writeError responds with an error in a format of the requested API version
+func writeError(w http.ResponseWriter, api, status int, message string, retryAfter time.Duration) {
+	var body interface{} = map[string]string{"error": message}
+	if api == 2 {
+		body = map[string]string{"code": strings.ToLower(strings.Replace(http.StatusText(status), " ", "_", -1)), "message": message}
+	}
+	if retryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int((retryAfter+time.Second-1)/time.Second)))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Influxdb-Error", message)
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+// applyFault waits for latency and responds with an injected error. It returns true
+// if the request is handled and no normal response should be written
+func applyFault(w http.ResponseWriter, r *http.Request, f Fault, api int) bool {
+	if !delay(r, f.Latency) {
+		return true
+	}
+	if f.Status == 0 || f.Dropped > 0 {
+		return false
+	}
+	message := f.Message
+	if message == "" {
+		message = http.StatusText(f.Status)
+	}
+	writeError(w, api, f.Status, message, f.RetryAfter)
+
+	return true
+}
+
+func (s *Server) handlePing(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	s.pings++
+	s.mu.Unlock()
+	if applyFault(w, r, s.fault(Ping), 1) {
+		return
+	}
+	w.Header().Set("X-Influxdb-Build", "OSS")
+	w.Header().Set("X-Influxdb-Version", Version)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) handleHealth(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	s.pings++
+	s.mu.Unlock()
+	if applyFault(w, r, s.fault(Ping), 2) {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"name": "influxdb", "status": "pass", "version": Version})
+}
+
+// result is a result of a single InfluxQL statement
+type result struct {
+	StatementID int      `json:"statement_id"`
+	Series      []Series `json:"series,omitempty"`
+	Error       string   `json:"error,omitempty"`
+}
+
+// Series is a part of a statement result in the same format InfluxDB responds with
+type Series struct {
+	Name    string            `json:"name"`
+	Tags    map[string]string `json:"tags,omitempty"`
+	Columns []string          `json:"columns"`
+	Values  [][]interface{}   `json:"values"`
+}
+
+// unquoteIdent removes quotes of an InfluxQL identifier
+func unquoteIdent(s string) string {
+	if len(s) >= 2 && s[0] == '"' && s[len(s)-1] == '"' {
+		return strings.Replace(s[1:len(s)-1], `\"`, `"`, -1)
+	}
+
+	return s
+}
+
+// execute runs a statement. Only statements managing databases are supported,
+// others return canned responses set with Respond or no data
+func (s *Server) execute(id int, stmt string) result {
+	res := result{StatementID: id}
+	fields := strings.Fields(stmt)
+	upper := strings.ToUpper(stmt)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch {
+	case strings.HasPrefix(upper, "SHOW DATABASES") && s.hidden:
+		res.Series = []Series{}
+	case strings.HasPrefix(upper, "SHOW DATABASES"):
+		sr := Series{Name: "databases", Columns: []string{"name"}, Values: [][]interface{}{}}
+		names := make([]string, 0, len(s.databases))
+		for db := range s.databases {
+			names = append(names, db)
+		}
+		sort.Strings(names)
+		for _, db := range names {
+			sr.Values = append(sr.Values, []interface{}{db})
+		}
+		res.Series = []Series{sr}
+	case strings.HasPrefix(upper, "CREATE DATABASE ") && len(fields) >= 3:
+		s.databases[unquoteIdent(fields[2])] = true
+	case strings.HasPrefix(upper, "DROP DATABASE ") && len(fields) >= 3:
+		delete(s.databases, unquoteIdent(fields[2]))
+	default:
+		res.Series = s.respond(stmt)
+	}
+
+	return res
+}
+
+// respond returns series of the first canned response matching a statement
+func (s *Server) respond(stmt string) []Series {
+ResponsesLoop:
+	for _, r := range s.responses {
+		for _, c := range r.contains {
+			if !strings.Contains(stmt, c) {
+				continue ResponsesLoop
+			}
+		}
+		return r.series
+	}
+
+	return nil
+}
+
+func (s *Server) handleQuery(w http.ResponseWriter, r *http.Request) {
+	q := r.FormValue("q")
+	s.mu.Lock()
+	s.queries = append(s.queries, q)
+	s.mu.Unlock()
+	if applyFault(w, r, s.fault(Query), 1) {
+		return
+	}
+	if strings.TrimSpace(q) == "" {
+		writeError(w, 1, http.StatusBadRequest, "missing required parameter \"q\"", 0)
+		return
+	}
+
+	var results []result
+	for _, stmt := range strings.Split(q, ";") {
+		if stmt = strings.TrimSpace(stmt); stmt != "" {
+			results = append(results, s.execute(len(results), stmt))
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Influxdb-Version", Version)
+	json.NewEncoder(w).Encode(map[string]interface{}{"results": results})
+}
+
+// handleFluxQuery records a Flux query and responds with an empty result
+func (s *Server) handleFluxQuery(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+	q := string(body)
+	var req struct {
+		Query string `json:"query"`
+	}
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") && json.Unmarshal(body, &req) == nil {
+		q = req.Query
+	}
+	s.mu.Lock()
+	s.queries = append(s.queries, q)
+	s.mu.Unlock()
+	if applyFault(w, r, s.fault(Query), 2) {
+		return
+	}
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	io.WriteString(w, "\r\n")
+}
+
+// readLines reads a write request body, decompressing it if needed
+func readLines(r *http.Request) ([]string, error) {
+	var body io.Reader = r.Body
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		gz, err := gzip.NewReader(r.Body)
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close()
+		body = gz
+	}
+	data, err := ioutil.ReadAll(body)
+	if err != nil {
+		return nil, err
+	}
+
+	var lines []string
+	for _, line := range bytes.Split(data, []byte("\n")) {
+		if line = bytes.TrimSpace(line); len(line) > 0 {
+			lines = append(lines, string(line))
+		}
+	}
+
+	return lines, nil
+}
+
+// write stores lines of a write request the same way InfluxDB does: valid lines
+// are stored even if others can't be parsed
+func (s *Server) write(w http.ResponseWriter, r *http.Request, req WriteRequest) {
+	f := s.fault(Write)
+	record := func(status int) {
+		req.Status = status
+		s.mu.Lock()
+		s.writes = append(s.writes, req)
+		s.mu.Unlock()
+	}
+	lines, err := readLines(r)
+	if err != nil {
+		writeError(w, req.API, http.StatusBadRequest, fmt.Sprintf("unable to read body: %v", err), 0)
+		record(http.StatusBadRequest)
+		return
+	}
+	if applyFault(w, r, f, req.API) {
+		record(f.Status)
+		return
+	}
+
+	s.mu.Lock()
+	exists := s.databases[req.Database]
+	s.mu.Unlock()
+	switch {
+	case req.Database == "":
+		writeError(w, req.API, http.StatusBadRequest, "database is required", 0)
+		record(http.StatusBadRequest)
+		return
+	case !exists && req.API == 2:
+		writeError(w, req.API, http.StatusNotFound, fmt.Sprintf("bucket %q not found", r.URL.Query().Get("bucket")), 0)
+		record(http.StatusNotFound)
+		return
+	case !exists:
+		writeError(w, req.API, http.StatusNotFound, fmt.Sprintf("database not found: %q", req.Database), 0)
+		record(http.StatusNotFound)
+		return
+	}
+
+	var invalid string
+	for _, line := range lines {
+		if _, err := models.ParsePointsString(line); err != nil {
+			if invalid == "" {
+				invalid = fmt.Sprintf("unable to parse '%s': %v", line, err)
+			}
+			continue
+		}
+		req.Lines = append(req.Lines, line)
+	}
+	dropped := len(lines) - len(req.Lines)
+	if f.Dropped > 0 {
+		n := f.Dropped
+		if n > len(req.Lines) {
+			n = len(req.Lines)
+		}
+		req.Lines = req.Lines[:len(req.Lines)-n]
+		dropped += n
+		invalid = "field type conflict"
+	}
+	if dropped > 0 {
+		writeError(w, req.API, http.StatusBadRequest, fmt.Sprintf("partial write: %s dropped=%d", invalid, dropped), 0)
+		record(http.StatusBadRequest)
+		return
+	}
+	record(http.StatusNoContent)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) handleWrite(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	s.write(w, r, WriteRequest{
+		API:             1,
+		Database:        q.Get("db"),
+		RetentionPolicy: q.Get("rp"),
+		Precision:       q.Get("precision"),
+		Consistency:     q.Get("consistency"),
+		Gzip:            r.Header.Get("Content-Encoding") == "gzip",
+	})
+}
+
+// handleWriteV2 writes to a bucket, which is mapped to a database and retention
+// policy like InfluxDB 2.x does it for buckets named "database/policy"
+func (s *Server) handleWriteV2(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	bucket := q.Get("bucket")
+	req := WriteRequest{
+		API:       2,
+		Database:  bucket,
+		Precision: q.Get("precision"),
+		Gzip:      r.Header.Get("Content-Encoding") == "gzip",
+	}
+	if i := strings.Index(bucket, "/"); i >= 0 {
+		req.Database, req.RetentionPolicy = bucket[:i], bucket[i+1:]
+	}
+	if req.Precision == "" {
+		req.Precision = "ns"
+	}
+	s.write(w, r, req)
+}
@@ -0,0 +1,225 @@
+/*
+Copyright © 2020 Anton Kramarev
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+package influxtest
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// post sends a body to an endpoint of the server and returns status and response body
+func post(t *testing.T, url, contentType string, body []byte, gzipped bool) (int, string) {
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if gzipped {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, _ := ioutil.ReadAll(resp.Body)
+
+	return resp.StatusCode, string(data)
+}
+
+func TestWriteV2MapsBucketToRetentionPolicy(t *testing.T) {
+	srv := NewServer("gatling")
+	defer srv.Close()
+
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	gz.Write([]byte("requests,name=Home duration=10i 1\nusers active=5i 2\n"))
+	gz.Close()
+	status, body := post(t, srv.URL+"/api/v2/write?bucket=gatling/week", "text/plain", buf.Bytes(), true)
+	if status != http.StatusNoContent {
+		t.Fatalf("Expected status 204, got %d: %s", status, body)
+	}
+	status, body = post(t, srv.URL+"/api/v2/write?bucket=gatling&precision=ms", "text/plain", []byte("users active=1i 3"), false)
+	if status != http.StatusNoContent {
+		t.Fatalf("Expected status 204, got %d: %s", status, body)
+	}
+
+	writes := srv.Writes()
+	if len(writes) != 2 {
+		t.Fatalf("Expected 2 writes, got %d", len(writes))
+	}
+	want := []WriteRequest{
+		{API: 2, Database: "gatling", RetentionPolicy: "week", Precision: "ns", Gzip: true, Status: http.StatusNoContent},
+		{API: 2, Database: "gatling", Precision: "ms", Status: http.StatusNoContent},
+	}
+	for i, w := range writes {
+		w.Lines = nil
+		if !reflect.DeepEqual(w, want[i]) {
+			t.Errorf("Write %d: expected %+v, got %+v", i, want[i], w)
+		}
+	}
+	if n := len(srv.Lines()); n != 3 {
+		t.Errorf("Expected 3 stored lines, got %d", n)
+	}
+}
+
+func TestWriteV2Errors(t *testing.T) {
+	srv := NewServer("gatling")
+	defer srv.Close()
+
+	tests := []struct {
+		name   string
+		url    string
+		body   string
+		fault  *Fault
+		status int
+		code   string
+		lines  int
+	}{
+		{name: "missing bucket", url: "/api/v2/write?bucket=other", body: "users active=1i 1", status: http.StatusNotFound, code: "not_found"},
+		{name: "no bucket", url: "/api/v2/write", body: "users active=1i 1", status: http.StatusBadRequest, code: "bad_request"},
+		{name: "invalid line", url: "/api/v2/write?bucket=gatling", body: "users active=1i 1\nusers", status: http.StatusBadRequest, code: "bad_request", lines: 1},
+		{name: "injected fault", url: "/api/v2/write?bucket=gatling", body: "users active=1i 1", fault: &Fault{Status: http.StatusServiceUnavailable}, status: http.StatusServiceUnavailable, code: "service_unavailable"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before := len(srv.Lines())
+			if tt.fault != nil {
+				srv.Inject(Write, *tt.fault)
+			}
+			status, body := post(t, srv.URL+tt.url, "text/plain", []byte(tt.body), false)
+			if status != tt.status {
+				t.Fatalf("Expected status %d, got %d: %s", tt.status, status, body)
+			}
+			var e struct {
+				Code    string `json:"code"`
+				Message string `json:"message"`
+			}
+			if err := json.Unmarshal([]byte(body), &e); err != nil {
+				t.Fatalf("Expected an error of 2.x API, got %q: %v", body, err)
+			}
+			if e.Code != tt.code || e.Message == "" {
+				t.Errorf("Expected code %q with a message, got %+v", tt.code, e)
+			}
+			if n := len(srv.Lines()) - before; n != tt.lines {
+				t.Errorf("Expected %d stored lines, got %d", tt.lines, n)
+			}
+		})
+	}
+}
+
+func TestQueryV2RecordsFluxQueries(t *testing.T) {
+	srv := NewServer("gatling")
+	defer srv.Close()
+
+	const flux = `from(bucket: "gatling") |> range(start: -1h)`
+	status, body := post(t, srv.URL+"/api/v2/query", "application/json", []byte(`{"query": "from(bucket: \"gatling\") |> range(start: -1h)"}`), false)
+	if status != http.StatusOK || strings.TrimSpace(body) != "" {
+		t.Fatalf("Expected an empty result, got status %d: %q", status, body)
+	}
+	status, _ = post(t, srv.URL+"/api/v2/query", "application/vnd.flux", []byte(flux), false)
+	if status != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", status)
+	}
+	srv.Inject(Query, Fault{Status: http.StatusUnauthorized, Message: "unauthorized access"})
+	status, body = post(t, srv.URL+"/api/v2/query", "application/vnd.flux", []byte(flux), false)
+	if status != http.StatusUnauthorized || !strings.Contains(body, `"code":"unauthorized"`) {
+		t.Errorf("Expected an injected 2.x error, got status %d: %s", status, body)
+	}
+
+	queries := srv.Queries()
+	if len(queries) != 3 {
+		t.Fatalf("Expected 3 queries, got %d", len(queries))
+	}
+	for i, q := range queries {
+		if q != flux {
+			t.Errorf("Query %d: expected %q, got %q", i, flux, q)
+		}
+	}
+}
+
+func TestHealth(t *testing.T) {
+	srv := NewServer()
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/health")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var h map[string]string
+	if err := json.NewDecoder(resp.Body).Decode(&h); err != nil {
+		t.Fatal(err)
+	}
+	if h["status"] != "pass" || h["version"] != Version {
+		t.Errorf("Expected passing health of version %s, got %v", Version, h)
+	}
+	if srv.Pings() != 1 {
+		t.Errorf("Expected health check to be counted as ping, got %d", srv.Pings())
+	}
+}
+
+func TestRespondReturnsCannedSeries(t *testing.T) {
+	srv := NewServer("gatling")
+	defer srv.Close()
+	srv.Respond([]Series{{Name: "requests", Tags: map[string]string{"name": "Home"}, Columns: []string{"time", "count"}, Values: [][]interface{}{{0, 10}}}},
+		`FROM "requests"`, "'KO'")
+	srv.Respond([]Series{{Name: "requests", Columns: []string{"time", "count"}, Values: [][]interface{}{{0, 100}}}},
+		`FROM "requests"`)
+
+	query := func(q string) string {
+		resp, err := http.Get(srv.URL + "/query?db=gatling&q=" + url.QueryEscape(q))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		return strings.TrimSpace(string(body))
+	}
+
+	tests := []struct {
+		query string
+		want  string
+	}{
+		{query: `SELECT count("duration") FROM "requests" WHERE "result" = 'KO' GROUP BY "name"`,
+			want: `{"results":[{"statement_id":0,"series":[{"name":"requests","tags":{"name":"Home"},"columns":["time","count"],"values":[[0,10]]}]}]}`},
+		{query: `SELECT count("duration") FROM "requests"`,
+			want: `{"results":[{"statement_id":0,"series":[{"name":"requests","columns":["time","count"],"values":[[0,100]]}]}]}`},
+		{query: `SELECT count("totalDuration") FROM "groups"`,
+			want: `{"results":[{"statement_id":0}]}`},
+	}
+	for _, tt := range tests {
+		if got := query(tt.query); got != tt.want {
+			t.Errorf("%s: expected %s, got %s", tt.query, tt.want, got)
+		}
+	}
+}
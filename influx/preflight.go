@@ -0,0 +1,181 @@
+/*
+Copyright © 2020 Anton Kramarev
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+package influx
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"regexp"
+
+	l "github.com/dakaraj/gatling-to-influxdb/logger"
+	infc "github.com/influxdata/influxdb1-client/v2"
+	"github.com/spf13/cobra"
+)
+
+// durationLiteral matches InfluxQL duration literals accepted as retention policy duration
+var durationLiteral = regexp.MustCompile(`^(\d+(ns|u|µ|ms|s|m|h|d|w))+$|^INF$`)
+
+var errDatabaseNotFound = errors.New("Database not found")
+
+// preflightSettings define which checks are done before starting to write points
+type preflightSettings struct {
+	createDatabase   bool
+	databaseDuration string
+	dryRunWrite      bool
+}
+
+func readPreflightSettings(cmd *cobra.Command) (preflightSettings, error) {
+	var s preflightSettings
+	s.createDatabase, _ = cmd.Flags().GetBool("create-database")
+	s.databaseDuration, _ = cmd.Flags().GetString("create-database-duration")
+	s.dryRunWrite, _ = cmd.Flags().GetBool("dry-run-write")
+	if s.databaseDuration != "" && !durationLiteral.MatchString(s.databaseDuration) {
+		return s, fmt.Errorf("Invalid retention duration %q, expected a value like 30d or INF", s.databaseDuration)
+	}
+
+	return s, nil
+}
+
+// databaseExists checks if database is listed by server. Only databases the user can read
+// are listed, so neither an error nor a missing database mean that it does not exist
+func databaseExists() (bool, error) {
+	res, err := c.Query(infc.NewQuery("SHOW DATABASES", "", ""))
+	if err != nil {
+		return false, err
+	}
+	if err := res.Error(); err != nil {
+		return false, err
+	}
+	for _, r := range res.Results {
+		for _, s := range r.Series {
+			for _, v := range s.Values {
+				if len(v) > 0 && v[0] == dbName {
+					return true, nil
+				}
+			}
+		}
+	}
+
+	return false, nil
+}
+
+func createDatabase(duration string) error {
+	q := "CREATE DATABASE " + QuoteIdent(dbName)
+	if duration != "" {
+		q += " WITH DURATION " + duration
+	}
+	res, err := c.Query(infc.NewQuery(q, "", ""))
+	if err != nil {
+		return err
+	}
+	if err := res.Error(); err != nil {
+		return err
+	}
+	l.Infof("Database %s created\n", dbName)
+
+	return nil
+}
+
+// dryRunWrite sends a write request without any points. Server validates credentials,
+// write permissions and database existence but nothing is written
+func (c *writeClient) dryRunWrite(db string) error {
+	u := c.url
+	u.Path = path.Join(u.Path, "write")
+	req, err := http.NewRequest(http.MethodPost, u.String(), http.NoBody)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("User-Agent", c.conf.UserAgent)
+	if c.conf.Username != "" {
+		req.SetBasicAuth(c.conf.Username, c.conf.Password)
+	}
+	params := req.URL.Query()
+	params.Set("db", db)
+	req.URL.RawQuery = params.Encode()
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	body = bytes.TrimSpace(body)
+
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusNoContent:
+		return nil
+	case http.StatusUnauthorized:
+		return fmt.Errorf("Authentication failed, check credentials: %s", body)
+	case http.StatusForbidden:
+		return fmt.Errorf("User is not authorized to write to database %s: %s", db, body)
+	case http.StatusNotFound:
+		return fmt.Errorf("%w: %s", errDatabaseNotFound, body)
+	default:
+		return fmt.Errorf("Test write failed with status %s: %s", resp.Status, body)
+	}
+}
+
+// preflight checks if points can be written to the database. Only write access
+// is required: a database not listed by server may be just not readable by the user,
+// so only the test write decides if it is missing and has to be created
+func preflight(s preflightSettings) error {
+	exists, err := databaseExists()
+	switch {
+	case err != nil:
+		l.Infof("Database existence can't be checked, it is not permitted: %v\n", err)
+	case !exists:
+		l.Infof("Database %s is not listed by server, it is either missing or not readable by the user\n", dbName)
+	}
+
+	wc, ok := c.(*writeClient)
+	if !s.dryRunWrite || !ok {
+		// Without a test write database is created if it is not known to exist,
+		// which does nothing if it does exist
+		if !exists && s.createDatabase {
+			if err := createDatabase(s.databaseDuration); err != nil {
+				return fmt.Errorf("Failed to create database %s: %w", dbName, err)
+			}
+		}
+		return nil
+	}
+
+	err = wc.dryRunWrite(dbName)
+	if errors.Is(err, errDatabaseNotFound) {
+		if !s.createDatabase {
+			return fmt.Errorf("Database %s does not exist, it can be created automatically with --create-database key", dbName)
+		}
+		if err := createDatabase(s.databaseDuration); err != nil {
+			return fmt.Errorf("Failed to create database %s: %w", dbName, err)
+		}
+		err = wc.dryRunWrite(dbName)
+	}
+	if err != nil {
+		return fmt.Errorf("Test write failed: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,188 @@
+/*
+Copyright © 2020 Anton Kramarev
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+package influx
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/influxdata/influxdb1-client/models"
+	infc "github.com/influxdata/influxdb1-client/v2"
+)
+
+// AggregatedStats contains statistics of a single request or group name
+// for one test calculated by InfluxDB
+type AggregatedStats struct {
+	Count int64   `json:"count"`
+	KO    int64   `json:"ko"`
+	Mean  float64 `json:"mean"`
+	P50   float64 `json:"p50"`
+	P90   float64 `json:"p90"`
+	P95   float64 `json:"p95"`
+	P99   float64 `json:"p99"`
+	Max   float64 `json:"max"`
+	RPS   float64 `json:"rps"`
+	// Sampled is set if only a part of OK requests was written, then Count, KO and RPS
+	// are calculated from point weights, while durations are approximate
+	Sampled bool `json:"sampled,omitempty"`
+}
+
+// ErrorRate returns percentage of failed entries, from 0 to 100
+func (s AggregatedStats) ErrorRate() float64 {
+	if s.Count == 0 {
+		return 0
+	}
+	return float64(s.KO) / float64(s.Count) * 100
+}
+
+// QuoteString escapes a value to be safely used as a string literal in InfluxQL query
+func QuoteString(s string) string {
+	return "'" + strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(s) + "'"
+}
+
+// QuoteIdent escapes a name to be safely used as an identifier in InfluxQL query
+func QuoteIdent(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
+
+func toFloat(v interface{}) float64 {
+	switch n := v.(type) {
+	case json.Number:
+		f, _ := n.Float64()
+		return f
+	case float64:
+		return n
+	case int64:
+		return float64(n)
+	}
+
+	return 0
+}
+
+func runQuery(query string) ([]models.Row, error) {
+	res, err := c.Query(infc.NewQuery(query, dbName, "ms"))
+	if err != nil {
+		return nil, fmt.Errorf("Query to InfluxDB failed: %w", err)
+	}
+	if err := res.Error(); err != nil {
+		return nil, fmt.Errorf("Query returned an error: %w", err)
+	}
+	if len(res.Results) == 0 {
+		return nil, nil
+	}
+
+	return res.Results[0].Series, nil
+}
+
+// QueryAggregatedStats calculates statistics per name for the given test using
+// duration field of a measurement, e.g. 'duration' of 'requests' or 'totalDuration' of 'groups'.
+// Count is a sum of 'weight' field if points have it, so sampled requests are counted correctly
+func QueryAggregatedStats(measurement, field, testID string) (map[string]AggregatedStats, error) {
+	from := QuoteIdent(Measurement(measurement))
+	f := QuoteIdent(field)
+	where := fmt.Sprintf(`"testId" = %s`, QuoteString(testID))
+
+	rows, err := runQuery(fmt.Sprintf(
+		`SELECT count(%[1]s), mean(%[1]s), percentile(%[1]s, 50), percentile(%[1]s, 90), `+
+			`percentile(%[1]s, 95), percentile(%[1]s, 99), max(%[1]s), sum("weight") FROM %[2]s WHERE %[3]s GROUP BY "name"`,
+		f, from, where,
+	))
+	if err != nil {
+		return nil, err
+	}
+	result := make(map[string]AggregatedStats, len(rows))
+	for _, r := range rows {
+		if len(r.Values) == 0 || len(r.Values[0]) < 9 {
+			continue
+		}
+		v := r.Values[0]
+		s := AggregatedStats{
+			Count: int64(toFloat(v[1])),
+			Mean:  toFloat(v[2]),
+			P50:   toFloat(v[3]),
+			P90:   toFloat(v[4]),
+			P95:   toFloat(v[5]),
+			P99:   toFloat(v[6]),
+			Max:   toFloat(v[7]),
+		}
+		// Groups and requests written by older versions have no weight
+		if v[8] != nil {
+			weighted := int64(math.Round(toFloat(v[8])))
+			s.Sampled = weighted != s.Count
+			s.Count = weighted
+		}
+		result[r.Tags["name"]] = s
+	}
+
+	rows, err = runQuery(fmt.Sprintf(
+		`SELECT count(%s) FROM %s WHERE %s AND "result" = 'KO' GROUP BY "name"`,
+		f, from, where,
+	))
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range rows {
+		s, found := result[r.Tags["name"]]
+		if !found || len(r.Values) == 0 || len(r.Values[0]) < 2 {
+			continue
+		}
+		s.KO = int64(toFloat(r.Values[0][1]))
+		result[r.Tags["name"]] = s
+	}
+
+	// Throughput is calculated over the whole test duration rather than per name
+	// so requests executed once per user do not look unreasonably fast
+	span, err := queryTimeSpan(from, f, where)
+	if err != nil {
+		return nil, err
+	}
+	seconds := span.Seconds()
+	if seconds < 1 {
+		seconds = 1
+	}
+	for k, s := range result {
+		s.RPS = float64(s.Count) / seconds
+		result[k] = s
+	}
+
+	return result, nil
+}
+
+func queryTimeSpan(from, field, where string) (time.Duration, error) {
+	var bounds [2]int64
+	for i, selector := range []string{"first", "last"} {
+		rows, err := runQuery(fmt.Sprintf(`SELECT %s(%s) FROM %s WHERE %s`, selector, field, from, where))
+		if err != nil {
+			return 0, err
+		}
+		if len(rows) == 0 || len(rows[0].Values) == 0 {
+			return 0, nil
+		}
+		bounds[i] = int64(toFloat(rows[0].Values[0][0]))
+	}
+
+	return time.Duration(bounds[1]-bounds[0]) * time.Millisecond, nil
+}
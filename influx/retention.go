@@ -0,0 +1,73 @@
+/*
+Copyright © 2020 Anton Kramarev
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+package influx
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	// retentionPolicy is a policy points are written to unless their measurement is routed
+	// to another one, database default policy is used if empty
+	retentionPolicy string
+	// retentionRoutes maps full measurement names to retention policies
+	retentionRoutes  map[string]string
+	writeConsistency string
+)
+
+// initRetention reads retention policy and write consistency settings
+func initRetention(cmd *cobra.Command) error {
+	retentionPolicy, _ = cmd.Flags().GetString("retention-policy")
+	writeConsistency, _ = cmd.Flags().GetString("write-consistency")
+	routes, _ := cmd.Flags().GetStringArray("retention-policy-route")
+
+	switch writeConsistency {
+	case "", "any", "one", "quorum", "all":
+	default:
+		return fmt.Errorf("Unknown write consistency %q, expected one of: any, one, quorum, all", writeConsistency)
+	}
+
+	retentionRoutes = make(map[string]string, len(routes))
+	for _, r := range routes {
+		kv := strings.SplitN(r, "=", 2)
+		if len(kv) != 2 || strings.TrimSpace(kv[0]) == "" || strings.TrimSpace(kv[1]) == "" {
+			return fmt.Errorf("Invalid retention policy route %q, expected measurement=policy", r)
+		}
+		// Routes are defined with short names, while points have prefixed ones
+		retentionRoutes[Measurement(strings.TrimSpace(kv[0]))] = strings.TrimSpace(kv[1])
+	}
+
+	return nil
+}
+
+// retentionPolicyOf returns a retention policy points of the measurement are written to
+func retentionPolicyOf(name string) string {
+	if rp, found := retentionRoutes[name]; found {
+		return rp
+	}
+
+	return retentionPolicy
+}
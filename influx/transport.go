@@ -0,0 +1,268 @@
+/*
+Copyright © 2020 Anton Kramarev
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+package influx
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"runtime"
+	"strconv"
+	"time"
+
+	infc "github.com/influxdata/influxdb1-client/v2"
+	"github.com/spf13/cobra"
+)
+
+// transport is shared by all HTTP requests to InfluxDB, so connections are reused
+var transport *http.Transport
+
+// Transport returns HTTP transport configured with TLS, proxy and connection pool settings
+// of InfluxDB connection, so other components talking to InfluxDB can reuse it
+func Transport() *http.Transport {
+	return transport
+}
+
+// tlsConfig builds TLS settings from provided CA and client certificate files
+func tlsConfig(cmd *cobra.Command) (*tls.Config, error) {
+	caFile, _ := cmd.Flags().GetString("tls-ca")
+	certFile, _ := cmd.Flags().GetString("tls-cert")
+	keyFile, _ := cmd.Flags().GetString("tls-key")
+	skipVerify, _ := cmd.Flags().GetBool("tls-skip-verify")
+
+	conf := &tls.Config{InsecureSkipVerify: skipVerify}
+	if caFile != "" {
+		ca, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read CA file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("No PEM certificates found in %s", caFile)
+		}
+		conf.RootCAs = pool
+	}
+	if (certFile == "") != (keyFile == "") {
+		return nil, errors.New("Both client certificate and key files must be provided")
+	}
+	if certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to load client certificate: %w", err)
+		}
+		conf.Certificates = []tls.Certificate{cert}
+	}
+
+	return conf, nil
+}
+
+// httpConfig builds InfluxDB client settings together with a transport used for writes
+func httpConfig(cmd *cobra.Command) (infc.HTTPConfig, error) {
+	username, _ := cmd.Flags().GetString("username")
+	password, _ := cmd.Flags().GetString("password")
+	address, _ := cmd.Flags().GetString("address")
+	timeout, _ := cmd.Flags().GetUint("http-timeout")
+	useGzip, _ := cmd.Flags().GetBool("gzip")
+	proxy, _ := cmd.Flags().GetString("proxy")
+	maxIdle, _ := cmd.Flags().GetInt("max-idle-conns")
+	maxPerHost, _ := cmd.Flags().GetInt("max-conns-per-host")
+	idleTimeout, _ := cmd.Flags().GetUint("idle-conn-timeout")
+
+	tlsConf, err := tlsConfig(cmd)
+	if err != nil {
+		return infc.HTTPConfig{}, err
+	}
+
+	// Proxy from environment variables is used unless set explicitly
+	proxyFunc := http.ProxyFromEnvironment
+	if proxy != "" {
+		u, err := url.Parse(proxy)
+		if err != nil {
+			return infc.HTTPConfig{}, fmt.Errorf("Failed to parse proxy address: %w", err)
+		}
+		proxyFunc = http.ProxyURL(u)
+	}
+
+	transport = &http.Transport{
+		Proxy: proxyFunc,
+		DialContext: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		TLSClientConfig:     tlsConf,
+		TLSHandshakeTimeout: 10 * time.Second,
+		MaxIdleConns:        maxIdle,
+		MaxIdleConnsPerHost: maxIdle,
+		MaxConnsPerHost:     maxPerHost,
+		IdleConnTimeout:     time.Duration(idleTimeout) * time.Second,
+	}
+
+	conf := infc.HTTPConfig{
+		Addr:      address,
+		Username:  username,
+		Password:  password,
+		UserAgent: fmt.Sprintf("g2i-http-client-%s(%s)", cmd.Root().Version, runtime.Version()),
+		Timeout:   time.Duration(timeout) * time.Second,
+		TLSConfig: tlsConf,
+		Proxy:     proxyFunc,
+	}
+	if useGzip {
+		conf.WriteEncoding = infc.GzipEncoding
+	}
+
+	return conf, nil
+}
+
+// writeClient is InfluxDB client sending writes through a shared tuned transport.
+// Standard client creates its own transport with default connection pool settings,
+// which is enough for rare queries but not for a constant stream of batches
+type writeClient struct {
+	infc.Client
+	url        url.URL
+	conf       infc.HTTPConfig
+	httpClient *http.Client
+}
+
+func newWriteClient(conf infc.HTTPConfig) (*writeClient, error) {
+	c, err := infc.NewHTTPClient(conf)
+	if err != nil {
+		return nil, err
+	}
+	u, err := url.Parse(conf.Addr)
+	if err != nil {
+		return nil, err
+	}
+
+	return &writeClient{
+		Client: c,
+		url:    *u,
+		conf:   conf,
+		httpClient: &http.Client{
+			Timeout:   conf.Timeout,
+			Transport: transport,
+		},
+	}, nil
+}
+
+// Write sends points batch to InfluxDB, compressing request body if configured
+func (c *writeClient) Write(bp infc.BatchPoints) error {
+	var b bytes.Buffer
+	var w io.Writer = &b
+	var gz *gzip.Writer
+	if c.conf.WriteEncoding == infc.GzipEncoding {
+		gz = gzip.NewWriter(&b)
+		w = gz
+	}
+	for _, p := range bp.Points() {
+		if p == nil {
+			continue
+		}
+		if _, err := io.WriteString(w, p.PrecisionString(bp.Precision())+"\n"); err != nil {
+			return err
+		}
+	}
+	if gz != nil {
+		if err := gz.Close(); err != nil {
+			return err
+		}
+	}
+
+	u := c.url
+	u.Path = path.Join(u.Path, "write")
+	req, err := http.NewRequest(http.MethodPost, u.String(), &b)
+	if err != nil {
+		return err
+	}
+	if gz != nil {
+		req.Header.Set("Content-Encoding", string(infc.GzipEncoding))
+	}
+	req.Header.Set("Content-Type", "")
+	req.Header.Set("User-Agent", c.conf.UserAgent)
+	if c.conf.Username != "" {
+		req.SetBasicAuth(c.conf.Username, c.conf.Password)
+	}
+	params := req.URL.Query()
+	params.Set("db", bp.Database())
+	params.Set("rp", bp.RetentionPolicy())
+	params.Set("precision", bp.Precision())
+	params.Set("consistency", bp.WriteConsistency())
+	req.URL.RawQuery = params.Encode()
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	// Body is read completely, so connection can be reused
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK {
+		we := &writeError{status: resp.Status, code: resp.StatusCode, body: bytes.TrimSpace(body)}
+		if s, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && s > 0 {
+			we.retryAfter = time.Duration(s) * time.Second
+		}
+		return we
+	}
+
+	return nil
+}
+
+// writeError is returned when InfluxDB responds to a write with an error status
+type writeError struct {
+	status     string
+	code       int
+	body       []byte
+	retryAfter time.Duration
+}
+
+func (e *writeError) Error() string {
+	return fmt.Sprintf("Write failed with status %s: %s", e.status, e.body)
+}
+
+// temporary reports if the same write may succeed later. Other errors mean
+// points are rejected, so sending them again makes no sense
+func (e *writeError) temporary() bool {
+	return e.code == http.StatusTooManyRequests || e.code == http.StatusRequestTimeout || e.code >= 500
+}
+
+// partial reports if some points of a batch were written while others were rejected
+func (e *writeError) partial() bool {
+	return bytes.Contains(e.body, []byte("partial write"))
+}
+
+// Close releases idle connections of both clients
+func (c *writeClient) Close() error {
+	transport.CloseIdleConnections()
+	return c.Client.Close()
+}
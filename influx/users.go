@@ -0,0 +1,318 @@
+/*
+Copyright © 2020 Anton Kramarev
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+package influx
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	l "github.com/dakaraj/gatling-to-influxdb/logger"
+	client "github.com/influxdata/influxdb1-client/v2"
+)
+
+const (
+	// allScenarios is a scenario tag value of users points combining all scenarios
+	allScenarios = "allUsers"
+	// AllNodes is a nodeName tag value of users points combining all load generators
+	AllNodes = "AllNodes"
+)
+
+type userLineData struct {
+	timestamp time.Time
+	nodeName  string
+	scenario  string
+	status    string
+}
+
+// userKey identifies a series of user activity
+type userKey struct {
+	nodeName string
+	scenario string
+}
+
+// SendUserLineData takes a line with user data and adds it to the processing list
+func SendUserLineData(timestamp time.Time, nodeName, scenario, status string) {
+	uld := userLineData{timestamp, nodeName, scenario, status}
+
+	uc <- uld
+}
+
+// userCounters contains user activity of a single scenario
+type userCounters struct {
+	active        int
+	started       int
+	finished      int
+	totalStarted  int
+	totalFinished int
+}
+
+func (u *userCounters) add(status string) {
+	switch status {
+	case "START":
+		u.active++
+		u.started++
+		u.totalStarted++
+	case "END":
+		u.active--
+		u.finished++
+		u.totalFinished++
+	}
+}
+
+func (u *userCounters) merge(o *userCounters) {
+	u.active += o.active
+	u.started += o.started
+	u.finished += o.finished
+	u.totalStarted += o.totalStarted
+	u.totalFinished += o.totalFinished
+}
+
+func updateUsers(m map[userKey]*userCounters, key userKey, status string) {
+	u, found := m[key]
+	if !found {
+		u = &userCounters{}
+		m[key] = u
+	}
+	u.add(status)
+}
+
+// sendUserData builds points for every scenario of every node, for all scenarios of a node
+// combined and, if there are several nodes, for all nodes combined. Then resets per interval counters
+func sendUserData(m map[userKey]*userCounters, testID string, ts time.Time) ([]*client.Point, error) {
+	combined := make(map[userKey]*userCounters)
+	nodes := make(map[string]struct{})
+	for k := range m {
+		nodes[k.nodeName] = struct{}{}
+	}
+	combine := func(key userKey, u *userCounters) {
+		c, found := combined[key]
+		if !found {
+			c = &userCounters{}
+			combined[key] = c
+		}
+		c.merge(u)
+	}
+	for k, v := range m {
+		combine(userKey{k.nodeName, allScenarios}, v)
+		if len(nodes) > 1 {
+			combine(userKey{AllNodes, k.scenario}, v)
+			combine(userKey{AllNodes, allScenarios}, v)
+		}
+	}
+
+	// Prepare points
+	points := make([]*client.Point, 0, len(m)+len(combined))
+	for _, series := range []map[userKey]*userCounters{m, combined} {
+		for k, u := range series {
+			point, err := NewPoint(
+				"users",
+				map[string]string{
+					"scenario": k.scenario,
+					"testId":   testID,
+					"nodeName": k.nodeName,
+				},
+				map[string]interface{}{
+					"active":        u.active,
+					"started":       u.started,
+					"finished":      u.finished,
+					"totalStarted":  u.totalStarted,
+					"totalFinished": u.totalFinished,
+				},
+				ts,
+			)
+			if err != nil {
+				return nil, fmt.Errorf("Error creating new point with user data: %w", err)
+			}
+			points = append(points, point)
+		}
+	}
+
+	// Started and finished users are counted per interval
+	for _, v := range m {
+		v.started, v.finished = 0, 0
+	}
+
+	return points, nil
+}
+
+// usersTimeline assigns user events to time buckets and emits a bucket only when
+// the watermark (latest seen event time minus reordering window) passes its end,
+// so slightly out of order events are still attributed to the right bucket
+type usersTimeline struct {
+	testID   string
+	interval time.Duration
+	window   time.Duration
+	// next is a start of the earliest bucket that is not emitted yet
+	next    time.Time
+	latest  time.Time
+	pending map[time.Time]map[userKey]*userCounters
+	current map[userKey]*userCounters
+	late    int
+}
+
+func newUsersTimeline(testID string, start time.Time, interval, window time.Duration) *usersTimeline {
+	return &usersTimeline{
+		testID:   testID,
+		interval: interval,
+		window:   window,
+		next:     start,
+		latest:   start,
+		pending:  make(map[time.Time]map[userKey]*userCounters),
+		current:  make(map[userKey]*userCounters),
+	}
+}
+
+// add puts event to its bucket and returns points of buckets that are complete
+func (ut *usersTimeline) add(p userLineData) []*client.Point {
+	bucket := ut.next
+	if p.timestamp.Before(ut.next) {
+		// Event is late even for the reordering window, so it is counted in the earliest open bucket
+		ut.late++
+	} else {
+		bucket = ut.next.Add(p.timestamp.Sub(ut.next) / ut.interval * ut.interval)
+	}
+	counters, found := ut.pending[bucket]
+	if !found {
+		counters = make(map[userKey]*userCounters)
+		ut.pending[bucket] = counters
+	}
+	updateUsers(counters, userKey{p.nodeName, p.scenario}, p.status)
+
+	if !p.timestamp.After(ut.latest) {
+		return nil
+	}
+	ut.latest = p.timestamp
+
+	return ut.emit(ut.latest.Add(-ut.window))
+}
+
+// emit applies all buckets ending not later than watermark to current user state
+// and returns resulting points. Buckets without events still produce points
+// with last known state, so there are no gaps in data
+func (ut *usersTimeline) emit(watermark time.Time) []*client.Point {
+	var points []*client.Point
+	for to := ut.next.Add(ut.interval); !to.After(watermark); to = ut.next.Add(ut.interval) {
+		points = append(points, ut.emitNext()...)
+	}
+
+	return points
+}
+
+func (ut *usersTimeline) emitNext() []*client.Point {
+	for key, delta := range ut.pending[ut.next] {
+		u, found := ut.current[key]
+		if !found {
+			u = &userCounters{}
+			ut.current[key] = u
+		}
+		u.merge(delta)
+	}
+	delete(ut.pending, ut.next)
+	ut.next = ut.next.Add(ut.interval)
+
+	// Bucket is considered done even if points failed to build,
+	// so a single bad bucket doesn't block further processing
+	points, err := sendUserData(ut.current, ut.testID, ut.next)
+	if err != nil {
+		l.Errorf("Failed to send user data: %v", err)
+		return nil
+	}
+
+	return points
+}
+
+// flush emits all remaining buckets up to the one containing closing time
+func (ut *usersTimeline) flush(closing time.Time) []*client.Point {
+	if ut.latest.After(closing) {
+		closing = ut.latest
+	}
+	// Last bucket should always be sent. So this is an imitation of do-while loop
+	points := ut.emitNext()
+	for !ut.next.After(closing) {
+		points = append(points, ut.emitNext()...)
+	}
+	if ut.late > 0 {
+		l.Infof("%d user events arrived later than reordering window allowed\n", ut.late)
+	}
+
+	return points
+}
+
+func usersProcessor(ctx context.Context, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	// Workaround:
+	// Wait for testInfo to fill
+	ti := currentTestInfo()
+	for ti.testStartTime.IsZero() {
+		select {
+		case <-ctx.Done():
+			// A complete log can be processed before the next check,
+			// so events are only dropped if test has not started at all
+			if ti = currentTestInfo(); ti.testStartTime.IsZero() {
+				return
+			}
+		case <-time.After(time.Second):
+			ti = currentTestInfo()
+		}
+	}
+
+	// Send current user state to database each N seconds
+	timeline := newUsersTimeline(
+		ti.testID,
+		ti.testStartTime.Truncate(time.Second),
+		time.Second*time.Duration(usersInterval),
+		time.Second*time.Duration(usersReorderWindow),
+	)
+
+	for {
+		select {
+		// If an external cancellation signal is received
+		case <-ctx.Done():
+			// Parser is already stopped at this point, so all events left in channel are processed first
+			var points []*client.Point
+		DrainLoop:
+			for {
+				select {
+				case p := <-uc:
+					points = append(points, timeline.add(p)...)
+				default:
+					break DrainLoop
+				}
+			}
+			// Fill empty points with last available data up to the closing point time
+			points = append(points, timeline.flush(lastPointTime())...)
+			WritePoints(points)
+
+			return
+
+		// On each new user line data
+		case p := <-uc:
+			for _, point := range timeline.add(p) {
+				pc <- point
+			}
+		}
+	}
+}
@@ -0,0 +1,163 @@
+/*
+Copyright © 2020 Anton Kramarev
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+package influx
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	infc "github.com/influxdata/influxdb1-client/v2"
+)
+
+var timelineStart = time.Unix(1790000000, 0)
+
+// at returns a time the given amount of seconds after timeline start
+func at(seconds int) time.Time {
+	return timelineStart.Add(time.Duration(seconds) * time.Second)
+}
+
+func userEvent(seconds int, node, scenario, status string) userLineData {
+	return userLineData{at(seconds), node, scenario, status}
+}
+
+// userPoints maps "node/scenario@seconds" of users points to their active, started
+// and finished values
+func userPoints(t *testing.T, points []*infc.Point) map[string][3]int64 {
+	m := make(map[string][3]int64)
+	for _, p := range points {
+		fields, err := p.Fields()
+		if err != nil {
+			t.Fatal(err)
+		}
+		key := fmt.Sprintf("%s/%s@%d", p.Tags()["nodeName"], p.Tags()["scenario"], p.Time().Sub(timelineStart)/time.Second)
+		if _, found := m[key]; found {
+			t.Errorf("Duplicate point %s", key)
+		}
+		m[key] = [3]int64{fields["active"].(int64), fields["started"].(int64), fields["finished"].(int64)}
+	}
+
+	return m
+}
+
+func TestUsersTimelineEmitsBucketsAfterWindow(t *testing.T) {
+	ut := newUsersTimeline("test", timelineStart, 10*time.Second, 5*time.Second)
+
+	if p := ut.add(userEvent(1, "n1", "A", "START")); p != nil {
+		t.Errorf("Expected no points before watermark passes a bucket, got %d", len(p))
+	}
+	// Watermark is 7s, the first bucket ends at 10s
+	if p := ut.add(userEvent(12, "n1", "A", "START")); p != nil {
+		t.Errorf("Expected no points before watermark passes a bucket, got %d", len(p))
+	}
+	got := userPoints(t, ut.add(userEvent(16, "n1", "A", "END")))
+	want := map[string][3]int64{
+		"n1/A@10":        {1, 1, 0},
+		"n1/allUsers@10": {1, 1, 0},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected points of the first bucket %v, got %v", want, got)
+	}
+
+	got = userPoints(t, ut.flush(at(20)))
+	want = map[string][3]int64{
+		"n1/A@20":        {1, 1, 1},
+		"n1/allUsers@20": {1, 1, 1},
+		"n1/A@30":        {1, 0, 0},
+		"n1/allUsers@30": {1, 0, 0},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected flushed points %v, got %v", want, got)
+	}
+}
+
+func TestUsersTimelineOutOfOrderEvents(t *testing.T) {
+	ut := newUsersTimeline("test", timelineStart, 10*time.Second, 5*time.Second)
+	ut.add(userEvent(8, "n1", "A", "START"))
+	// Within the window: 9s is before the latest 13s, but its bucket is still open
+	ut.add(userEvent(13, "n1", "A", "START"))
+	if p := ut.add(userEvent(9, "n1", "A", "START")); p != nil {
+		t.Errorf("Expected no points for an event older than the latest one, got %d", len(p))
+	}
+	got := userPoints(t, ut.add(userEvent(15, "n1", "A", "END")))
+	if want := [3]int64{2, 2, 0}; got["n1/A@10"] != want {
+		t.Errorf("Expected an event within window in its own bucket %v, got %v", want, got["n1/A@10"])
+	}
+	// Outside the window: the first bucket is emitted, so the event is counted in the next one
+	ut.add(userEvent(2, "n1", "A", "END"))
+	if ut.late != 1 {
+		t.Errorf("Expected 1 late event, got %d", ut.late)
+	}
+
+	got = userPoints(t, ut.flush(at(15)))
+	if want := [3]int64{1, 1, 2}; got["n1/A@20"] != want {
+		t.Errorf("Expected a late event clamped into the earliest open bucket %v, got %v", want, got["n1/A@20"])
+	}
+}
+
+func TestUsersTimelineFillsGaps(t *testing.T) {
+	ut := newUsersTimeline("test", timelineStart, 10*time.Second, 0)
+	ut.add(userEvent(1, "n1", "A", "START"))
+	ut.add(userEvent(2, "n2", "B", "START"))
+
+	got := userPoints(t, ut.add(userEvent(41, "n1", "A", "END")))
+	for _, sec := range []int{10, 20, 30, 40} {
+		want := [3]int64{1, 0, 0}
+		if sec == 10 {
+			want = [3]int64{1, 1, 0}
+		}
+		for _, key := range []string{"n1/A", "n2/B", "n1/allUsers", "n2/allUsers", "AllNodes/A", "AllNodes/B"} {
+			if v := got[fmt.Sprintf("%s@%d", key, sec)]; v != want {
+				t.Errorf("Expected %s at %ds %v, got %v", key, sec, want, v)
+			}
+		}
+		if v := got[fmt.Sprintf("AllNodes/allUsers@%d", sec)]; v != [3]int64{2 * want[0], 2 * want[1], 0} {
+			t.Errorf("Expected all users at %ds to combine nodes, got %v", sec, v)
+		}
+	}
+	if len(got) != 4*7 {
+		t.Errorf("Expected 7 series in 4 buckets, got %d points", len(got))
+	}
+
+	got = userPoints(t, ut.flush(at(41)))
+	if want := [3]int64{0, 0, 1}; got["n1/A@50"] != want || len(got) != 7 {
+		t.Errorf("Expected the last bucket with n1/A %v, got %v", want, got)
+	}
+}
+
+func TestUsersTimelineFlushesLatestEvent(t *testing.T) {
+	ut := newUsersTimeline("test", timelineStart, 10*time.Second, 30*time.Second)
+	ut.add(userEvent(25, "n1", "A", "START"))
+
+	// Closing time before the latest event still emits its bucket. Buckets before
+	// the first event have no series to write
+	got := userPoints(t, ut.flush(at(5)))
+	want := map[string][3]int64{
+		"n1/A@30":        {1, 1, 0},
+		"n1/allUsers@30": {1, 1, 0},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected flushed points %v, got %v", want, got)
+	}
+}
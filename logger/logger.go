@@ -32,10 +32,11 @@ import (
 
 // that will add prefixes to log lines
 var (
-	// logger is a single local logger implementation
-	logger *log.Logger
-	sw     io.Writer
-	ew     io.Writer
+	sw io.Writer = os.Stdout
+	ew io.Writer = os.Stderr
+	// logger is a single local logger implementation, it writes to standard
+	// streams only until InitLogger is called, e.g. in tests
+	logger = log.New(sw, "", log.Ldate|log.Ltime|log.LUTC)
 )
 
 // InitLogger sets up a new instance of logger that writes to file and STDOUT
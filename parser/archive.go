@@ -0,0 +1,237 @@
+/*
+Copyright © 2020 Anton Kramarev
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+package parser
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// archiveExts are extensions of archives with results directories
+var archiveExts = []string{".zip", ".tar", ".tar.gz", ".tgz", ".tar.zst"}
+
+// errExtractLimit is returned when logs extracted from an archive exceed allowed size,
+// which protects from archives expanding to fill the disk
+var errExtractLimit = errors.New("Extracted logs exceed size limit")
+
+// importRun is a set of logs imported as a single test
+type importRun struct {
+	// name distinguishes the run when several of them are imported at once,
+	// it is a run timestamp when results directory follows Gatling naming
+	name string
+	logs []string
+}
+
+func isArchive(p string) bool {
+	for _, ext := range archiveExts {
+		if strings.HasSuffix(strings.ToLower(p), ext) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// runName derives a run name from directory containing a log
+func runName(logPath string) string {
+	dir := filepath.Base(filepath.Dir(logPath))
+	if m := resultDirNamePattern.FindStringSubmatch(dir); m != nil {
+		return m[1]
+	}
+
+	return dir
+}
+
+// extractTarget returns a path an archive entry is extracted to, or an empty
+// string if entry is not a log or points outside of destination directory
+func extractTarget(dir, name string) string {
+	if !isLogFileName(path.Base(name)) {
+		return ""
+	}
+	target := filepath.Join(dir, filepath.FromSlash(path.Clean("/"+name)))
+	if !strings.HasPrefix(target, dir+string(filepath.Separator)) {
+		return ""
+	}
+
+	return target
+}
+
+// extractFile writes an entry to target. Sizes written by archives are not trusted,
+// so at most left bytes are read and left is decreased by amount of written ones
+func extractFile(target string, r io.Reader, left *int64) error {
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+	file, err := os.Create(target)
+	if err != nil {
+		return err
+	}
+	n, err := io.Copy(file, io.LimitReader(r, *left+1))
+	*left -= n
+	if err != nil {
+		file.Close()
+		return err
+	}
+	if *left < 0 {
+		file.Close()
+		return errExtractLimit
+	}
+
+	return file.Close()
+}
+
+func extractZip(archive, dir string, left *int64) error {
+	zr, err := zip.OpenReader(archive)
+	if err != nil {
+		return err
+	}
+	defer zr.Close()
+
+	for _, f := range zr.File {
+		target := extractTarget(dir, f.Name)
+		if target == "" || f.FileInfo().IsDir() {
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return err
+		}
+		err = extractFile(target, rc, left)
+		rc.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func extractTar(archive, dir string, left *int64) error {
+	// Compression of tar archives is handled the same way as of logs
+	r, err := openLog(archive)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	tr := tar.NewReader(r)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		target := extractTarget(dir, h.Name)
+		if target == "" || h.Typeflag != tar.TypeReg {
+			continue
+		}
+		if err := extractFile(target, tr, left); err != nil {
+			return err
+		}
+	}
+}
+
+// archiveRuns extracts logs from an archive into a temporary directory and returns
+// them as separate runs ordered by their names. Extracted logs may take maxSize bytes
+func archiveRuns(archive, tmpDir string, maxSize int64) ([]importRun, error) {
+	dir, err := ioutil.TempDir(tmpDir, "archive-")
+	if err != nil {
+		return nil, err
+	}
+	left := maxSize
+	if strings.HasSuffix(strings.ToLower(archive), ".zip") {
+		err = extractZip(archive, dir, &left)
+	} else {
+		err = extractTar(archive, dir, &left)
+	}
+	if errors.Is(err, errExtractLimit) {
+		return nil, fmt.Errorf("Failed to extract %s: %w of %d bytes, it can be raised with --max-extracted-size key", archive, err, maxSize)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Failed to extract %s: %w", archive, err)
+	}
+
+	logs, err := findLogs([]string{dir})
+	if err != nil {
+		return nil, fmt.Errorf("Failed to find logs in %s: %w", archive, err)
+	}
+	runs := make([]importRun, 0, len(logs))
+	for _, p := range logs {
+		runs = append(runs, importRun{name: runName(p), logs: []string{p}})
+	}
+	sort.SliceStable(runs, func(i, j int) bool { return runs[i].name < runs[j].name })
+
+	return runs, nil
+}
+
+// collectRuns returns runs to import. Logs provided directly are merged into a single
+// run, while every log found in an archive is a separate run. Logs extracted from
+// each archive may take maxExtracted bytes
+func collectRuns(paths []string, maxExtracted int64) (runs []importRun, cleanup func(), err error) {
+	cleanup = func() {}
+	var plain, archives []string
+	for _, p := range paths {
+		if isArchive(p) {
+			archives = append(archives, p)
+		} else {
+			plain = append(plain, p)
+		}
+	}
+
+	if len(plain) > 0 {
+		logs, err := findLogs(plain)
+		if err != nil {
+			return nil, cleanup, err
+		}
+		runs = append(runs, importRun{name: runName(logs[0]), logs: logs})
+	}
+	if len(archives) == 0 {
+		return runs, cleanup, nil
+	}
+
+	tmpDir, err := ioutil.TempDir("", "g2i-import-")
+	if err != nil {
+		return nil, cleanup, fmt.Errorf("Failed to create a directory for archives extraction: %w", err)
+	}
+	cleanup = func() { os.RemoveAll(tmpDir) }
+	for _, a := range archives {
+		r, err := archiveRuns(a, tmpDir, maxExtracted)
+		if err != nil {
+			return nil, cleanup, err
+		}
+		runs = append(runs, r...)
+	}
+
+	return runs, cleanup, nil
+}
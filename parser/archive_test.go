@@ -0,0 +1,222 @@
+/*
+Copyright © 2020 Anton Kramarev
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+package parser
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// archiveEntry is a file put into a test archive
+type archiveEntry struct {
+	name string
+	data []byte
+}
+
+// resultEntries returns logs of two Gatling results directories, listed out of run
+// order, together with a report file
+func resultEntries(t *testing.T) []archiveEntry {
+	cfg := testConfig(5, 1)
+	first, _ := generateLog(t, cfg)
+	cfg.Start = cfg.Start.Add(time.Hour)
+	second, _ := generateLog(t, cfg)
+
+	return []archiveEntry{
+		{name: "results/shop-20200603164512123/simulation.log", data: second},
+		{name: "results/shop-20200603154512123/simulation.log", data: first},
+		{name: "results/shop-20200603154512123/index.html", data: []byte("<html></html>")},
+	}
+}
+
+func writeZip(t *testing.T, p string, entries []archiveEntry) {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, e := range entries {
+		w, err := zw.Create(e.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write(e.data)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(p, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func writeTarGz(t *testing.T, p string, entries []archiveEntry) {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	for _, e := range entries {
+		h := &tar.Header{Name: e.name, Mode: 0644, Size: int64(len(e.data)), Typeflag: tar.TypeReg}
+		if err := tw.WriteHeader(h); err != nil {
+			t.Fatal(err)
+		}
+		tw.Write(e.data)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	gz.Close()
+	if err := ioutil.WriteFile(p, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCollectRunsFromArchives(t *testing.T) {
+	dir, err := ioutil.TempDir("", "g2i-archive-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	entries := resultEntries(t)
+
+	tests := []struct {
+		name  string
+		write func(*testing.T, string, []archiveEntry)
+	}{
+		{name: "results.zip", write: writeZip},
+		{name: "results.tar.gz", write: writeTarGz},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			archive := filepath.Join(dir, tt.name)
+			tt.write(t, archive, entries)
+
+			runs, cleanup, err := collectRuns([]string{archive}, 1<<30)
+			defer cleanup()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(runs) != 2 {
+				t.Fatalf("Expected 2 runs, got %d: %v", len(runs), runs)
+			}
+			// Runs are ordered by timestamps of results directories
+			want := []struct {
+				name string
+				data []byte
+			}{
+				{name: "20200603154512", data: entries[1].data},
+				{name: "20200603164512", data: entries[0].data},
+			}
+			for i, r := range runs {
+				if r.name != want[i].name {
+					t.Errorf("Run %d: expected name %s, got %s", i, want[i].name, r.name)
+				}
+				if len(r.logs) != 1 {
+					t.Fatalf("Run %d: expected a single log, got %v", i, r.logs)
+				}
+				data, err := ioutil.ReadFile(r.logs[0])
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(data, want[i].data) {
+					t.Errorf("Run %d: extracted log differs from archived one", i)
+				}
+			}
+			cleanup()
+			if _, err := os.Stat(runs[0].logs[0]); !os.IsNotExist(err) {
+				t.Errorf("Expected extracted logs to be removed by cleanup, got %v", err)
+			}
+		})
+	}
+}
+
+func TestCollectRunsLimitsExtractedSize(t *testing.T) {
+	dir, err := ioutil.TempDir("", "g2i-archive-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// Highly compressible log expands far beyond its archived size
+	entries := []archiveEntry{{name: "shop-20200603154512123/simulation.log", data: bytes.Repeat([]byte("a"), 1<<20)}}
+
+	for name, write := range map[string]func(*testing.T, string, []archiveEntry){
+		"results.zip":    writeZip,
+		"results.tar.gz": writeTarGz,
+	} {
+		archive := filepath.Join(dir, name)
+		write(t, archive, entries)
+		if info, _ := os.Stat(archive); info.Size() >= 1<<16 {
+			t.Fatalf("%s: expected archive to be smaller than the limit, got %d bytes", name, info.Size())
+		}
+
+		_, cleanup, err := collectRuns([]string{archive}, 1<<16)
+		cleanup()
+		if !errors.Is(err, errExtractLimit) {
+			t.Errorf("%s: expected extraction to exceed the limit, got %v", name, err)
+		}
+	}
+}
+
+func TestExtractTarget(t *testing.T) {
+	dir := filepath.FromSlash("/tmp/archive")
+	tests := []struct {
+		name string
+		want string
+	}{
+		{name: "shop-20200603154512123/simulation.log", want: "/tmp/archive/shop-20200603154512123/simulation.log"},
+		{name: "simulation.log.zst", want: "/tmp/archive/simulation.log.zst"},
+		// Entries can't point outside of destination directory
+		{name: "../../etc/simulation.log", want: "/tmp/archive/etc/simulation.log"},
+		{name: "/abs/simulation.log", want: "/tmp/archive/abs/simulation.log"},
+		{name: "shop-20200603154512123/index.html"},
+	}
+	for _, tt := range tests {
+		want := tt.want
+		if want != "" {
+			want = filepath.FromSlash(want)
+		}
+		if got := extractTarget(dir, tt.name); got != want {
+			t.Errorf("%s: expected target %q, got %q", tt.name, want, got)
+		}
+	}
+}
+
+func TestRunName(t *testing.T) {
+	tests := []struct {
+		path string
+		want string
+	}{
+		{path: "target/gatling/shop-20200603154512123/simulation.log", want: "20200603154512"},
+		{path: "target/gatling/my-shop-sim-20200603154512123/simulation.log.gz", want: "20200603154512"},
+		{path: "logs/node1/simulation.log", want: "node1"},
+		{path: "logs/shop-2020/simulation.log", want: "shop-2020"},
+	}
+	for _, tt := range tests {
+		if got := runName(filepath.FromSlash(tt.path)); got != tt.want {
+			t.Errorf("%s: expected run name %s, got %s", tt.path, tt.want, got)
+		}
+	}
+}
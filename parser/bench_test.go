@@ -0,0 +1,138 @@
+/*
+Copyright © 2020 Anton Kramarev
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+package parser
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dakaraj/gatling-to-influxdb/influx"
+)
+
+// processLog parses a complete log the same way an imported log is parsed
+// and returns amount of processed lines
+func processLog(tb testing.TB, data []byte) int {
+	wg := &sync.WaitGroup{}
+	iCtx, iCancel := context.WithCancel(context.Background())
+	wg.Add(1)
+	go influx.StartProcessing(iCtx, wg)
+
+	src := &logSource{nodeName: nodeName}
+	lines := newLineAssembler(bytes.NewReader(data))
+	next := func() []byte {
+		lb, err := lines.next()
+		if err == io.EOF || err == errIncompleteLine {
+			return lines.tail()
+		}
+		if err != nil {
+			tb.Fatalf("Failed to read log: %v", err)
+		}
+		return lb
+	}
+
+	var processed int
+	if parseWorkers > 1 {
+		processed = runPipeline(context.Background(), parseWorkers, func() ([]byte, *logSource) {
+			if lb := next(); lb != nil {
+				return lb, src
+			}
+			return nil, nil
+		})
+	} else {
+		for lb := next(); lb != nil; lb = next() {
+			if !src.processLine(lb) {
+				break
+			}
+			processed++
+		}
+	}
+	reportOpenSessions()
+	reportSampling()
+	finishErrorClasses()
+
+	iCancel()
+	wg.Wait()
+
+	return processed
+}
+
+// benchmarkLog measures processing of a generated log including points creation and
+// batching, points are written to a fake server
+func benchmarkLog(b *testing.B, args ...string) {
+	data, res := generateLog(b, testConfig(1000, 5))
+	b.ReportAllocs()
+	b.SetBytes(int64(len(data)))
+
+	var elapsed time.Duration
+	var mallocs uint64
+	var before, after runtime.MemStats
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		setUp(b, args...)
+		runtime.ReadMemStats(&before)
+		start := time.Now()
+		b.StartTimer()
+		if n := processLog(b, data); n != res.Lines {
+			b.Fatalf("Expected %d lines processed, got %d", res.Lines, n)
+		}
+		b.StopTimer()
+		elapsed += time.Since(start)
+		runtime.ReadMemStats(&after)
+		mallocs += after.Mallocs - before.Mallocs
+	}
+	lines := float64(b.N * res.Lines)
+	b.ReportMetric(float64(elapsed.Nanoseconds())/lines, "ns/line")
+	b.ReportMetric(float64(mallocs)/lines, "allocs/line")
+}
+
+func BenchmarkParseLog(b *testing.B) {
+	benchmarkLog(b)
+}
+
+func BenchmarkParseLogWorkers4(b *testing.B) {
+	benchmarkLog(b, "--workers", "4")
+}
+
+func BenchmarkParseLogSampled(b *testing.B) {
+	benchmarkLog(b, "--sample-ok", "10")
+}
+
+// BenchmarkParseRecord measures parsing of lines into records without applying them
+// and building points
+func BenchmarkParseRecord(b *testing.B) {
+	setUp(b)
+	data, _ := generateLog(b, testConfig(100, 5))
+	lines := bytes.SplitAfter(data, []byte("\n"))
+	src := &logSource{nodeName: nodeName}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		src.parseRecord(lines[i%len(lines)], &src.rec)
+	}
+}
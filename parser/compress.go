@@ -0,0 +1,125 @@
+/*
+Copyright © 2020 Anton Kramarev
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+package parser
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+
+	// compressedExts are extensions of compressed logs recognized when searching for them
+	compressedExts = []string{".gz", ".zst"}
+)
+
+// logReader is a reader of a possibly compressed log closing all underlying readers at once
+type logReader struct {
+	*bufio.Reader
+	closers []io.Closer
+}
+
+func (r *logReader) Close() error {
+	var err error
+	for i := len(r.closers) - 1; i >= 0; i-- {
+		if cErr := r.closers[i].Close(); cErr != nil && err == nil {
+			err = cErr
+		}
+	}
+
+	return err
+}
+
+// zstdCloser adapts zstd decoder to io.Closer interface
+type zstdCloser struct {
+	*zstd.Decoder
+}
+
+func (z zstdCloser) Close() error {
+	z.Decoder.Close()
+	return nil
+}
+
+// isLogFileName checks if file is a simulation log, either plain or compressed
+func isLogFileName(name string) bool {
+	return trimCompressedExt(name) == simulationLogFileName
+}
+
+// trimCompressedExt removes extension of a compressed file from its name
+func trimCompressedExt(name string) string {
+	for _, ext := range compressedExts {
+		if strings.HasSuffix(name, ext) {
+			return strings.TrimSuffix(name, ext)
+		}
+	}
+
+	return name
+}
+
+// openLog opens a log file for reading. Compressed logs are detected by magic bytes
+// and decompressed transparently, so their extension is not important
+func openLog(path string) (*logReader, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	r := &logReader{closers: []io.Closer{file}}
+	br := bufio.NewReader(file)
+	magic, _ := br.Peek(len(zstdMagic))
+
+	switch {
+	case bytes.HasPrefix(magic, gzipMagic):
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			r.Close()
+			return nil, fmt.Errorf("Failed to read gzip header of %s: %w", path, err)
+		}
+		r.closers = append(r.closers, gz)
+		r.Reader = bufio.NewReader(gz)
+	case bytes.HasPrefix(magic, zstdMagic):
+		zr, err := zstd.NewReader(br)
+		if err != nil {
+			r.Close()
+			return nil, fmt.Errorf("Failed to read zstd header of %s: %w", path, err)
+		}
+		r.closers = append(r.closers, zstdCloser{zr})
+		r.Reader = bufio.NewReader(zr)
+	default:
+		if trimCompressedExt(path) != path {
+			r.Close()
+			return nil, fmt.Errorf("%s has an extension of a compressed file, but its content is not compressed with gzip or zstd", path)
+		}
+		r.Reader = br
+	}
+
+	return r, nil
+}
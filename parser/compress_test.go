@@ -0,0 +1,156 @@
+/*
+Copyright © 2020 Anton Kramarev
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+package parser
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+func gzipData(tb testing.TB, data []byte) []byte {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(data); err != nil {
+		tb.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		tb.Fatal(err)
+	}
+
+	return buf.Bytes()
+}
+
+func zstdData(tb testing.TB, data []byte) []byte {
+	var buf bytes.Buffer
+	w, err := zstd.NewWriter(&buf)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	if _, err := w.Write(data); err != nil {
+		tb.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		tb.Fatal(err)
+	}
+
+	return buf.Bytes()
+}
+
+func TestOpenLogRoundTrip(t *testing.T) {
+	data, _ := generateLog(t, testConfig(3, 2))
+	dir, err := ioutil.TempDir("", "g2i-compress")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		name    string
+		content []byte
+	}{
+		{name: simulationLogFileName, content: data},
+		{name: "simulation.log.gz", content: gzipData(t, data)},
+		{name: "simulation.log.zst", content: zstdData(t, data)},
+		// Extension does not matter, content is detected by magic bytes
+		{name: "gzip.log", content: gzipData(t, data)},
+		{name: "zstd.log", content: zstdData(t, data)},
+		{name: "zstd.log.gz", content: zstdData(t, data)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(dir, tt.name)
+			if err := ioutil.WriteFile(path, tt.content, 0644); err != nil {
+				t.Fatal(err)
+			}
+			r, err := openLog(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := ioutil.ReadAll(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := r.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, data) {
+				t.Errorf("Expected %d bytes of the original log, got %d", len(data), len(got))
+			}
+		})
+	}
+}
+
+func TestOpenLogErrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "g2i-compress")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		name    string
+		content []byte
+	}{
+		{name: "simulation.log.gz", content: []byte("RUN\tplain\n")},
+		{name: "simulation.log.zst", content: []byte("RUN\tplain\n")},
+		{name: "broken.gz", content: append(append([]byte{}, gzipMagic...), "not a header"...)},
+		{name: "missing.log"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(dir, tt.name)
+			if tt.content != nil {
+				if err := ioutil.WriteFile(path, tt.content, 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if r, err := openLog(path); err == nil {
+				r.Close()
+				t.Error("Expected an error")
+			}
+		})
+	}
+}
+
+func TestIsLogFileName(t *testing.T) {
+	tests := map[string]bool{
+		"simulation.log":     true,
+		"simulation.log.gz":  true,
+		"simulation.log.zst": true,
+		"simulation.gz":      false,
+		"simulation.log.bz2": false,
+		"simulation.log.old": false,
+		"g2i.log":            false,
+	}
+	for name, want := range tests {
+		if got := isLogFileName(name); got != want {
+			t.Errorf("Expected %s to be a log file name %v, got %v", name, want, got)
+		}
+	}
+}
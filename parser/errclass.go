@@ -0,0 +1,186 @@
+/*
+Copyright © 2020 Anton Kramarev
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+package parser
+
+import (
+	"errors"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/dakaraj/gatling-to-influxdb/influx"
+	l "github.com/dakaraj/gatling-to-influxdb/logger"
+	"github.com/spf13/cobra"
+)
+
+const (
+	// maxErrorClasses limits amount of distinct error classes, as they are written as tags
+	maxErrorClasses  = 500
+	maxErrorClassLen = 200
+
+	sourceRequest  = "request"
+	sourceErrorLog = "error"
+)
+
+// fingerprintRules replace variable parts of error messages, order is important
+// as URLs, UUIDs and IP addresses contain numbers
+var fingerprintRules = []replaceRule{
+	{regexp.MustCompile(`[a-zA-Z][a-zA-Z0-9+.-]*://[^\s'",)]+`), "<url>"},
+	{regexp.MustCompile(`[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}`), "<uuid>"},
+	{regexp.MustCompile(`\b(0x[0-9a-fA-F]+|[0-9a-fA-F]{8,})\b`), "<hex>"},
+	{regexp.MustCompile(`\b\d{1,3}(\.\d{1,3}){3}\b`), "<ip>"},
+	{regexp.MustCompile(`\d+(\.\d+)?`), "<n>"},
+	{regexp.MustCompile(`\s+`), " "},
+}
+
+// errorClassKey identifies a series of error class counts, counts of
+// different nodes are kept apart as they are merged during import
+type errorClassKey struct {
+	nodeName string
+	class    string
+	source   string
+}
+
+var (
+	errorClassInterval time.Duration
+	topErrorClasses    int
+
+	errorClassBucket time.Time
+	errorClassCounts = make(map[errorClassKey]int)
+	errorClassTotals = make(map[string]int)
+	errorClassSim    string
+	// fingerprints caches classes of raw messages, as running replace rules is expensive
+	fingerprints = make(map[string]string)
+)
+
+// InitErrorClasses reads settings of error messages classification
+func InitErrorClasses(cmd *cobra.Command) error {
+	interval, _ := cmd.Flags().GetUint("error-classes-interval")
+	top, _ := cmd.Flags().GetUint("top-error-classes")
+	if interval == 0 {
+		return errors.New("Error classes interval must be greater than zero")
+	}
+	errorClassInterval = time.Duration(interval) * time.Second
+	topErrorClasses = int(top)
+
+	return nil
+}
+
+// fingerprint returns a stable error class of a message with variable parts
+// like numbers, identifiers and URLs replaced with placeholders
+func fingerprint(msg string) string {
+	class, found := fingerprints[msg]
+	if !found {
+		class = strings.TrimSpace(msg)
+		for _, r := range fingerprintRules {
+			class = r.re.ReplaceAllString(class, r.repl)
+		}
+		if len(class) > maxErrorClassLen {
+			class = class[:maxErrorClassLen]
+		}
+		if len(fingerprints) < maxCachedNames {
+			fingerprints[msg] = class
+		}
+	}
+	if _, found := errorClassTotals[class]; !found && len(errorClassTotals) >= maxErrorClasses {
+		return otherName
+	}
+
+	return class
+}
+
+// countErrorClass registers an error occurrence. Counts are sent once event time passes
+// the end of current interval
+func (s *logSource) countErrorClass(class, source string, t time.Time) {
+	bucket := t.Truncate(errorClassInterval)
+	if errorClassBucket.IsZero() {
+		errorClassBucket = bucket
+	}
+	if bucket.After(errorClassBucket) {
+		sendErrorClasses()
+		errorClassBucket = bucket
+	}
+	errorClassCounts[errorClassKey{s.nodeName, class, source}]++
+	errorClassTotals[class]++
+	errorClassSim = s.simulationName
+}
+
+// sendErrorClasses sends counts of error classes of current interval
+func sendErrorClasses() {
+	for k, count := range errorClassCounts {
+		point, err := influx.NewPoint(
+			"errorClasses",
+			map[string]string{
+				"errorClass": k.class,
+				"source":     k.source,
+				"simulation": errorClassSim,
+				"testId":     testID,
+				"nodeName":   k.nodeName,
+			},
+			map[string]interface{}{
+				"count": count,
+			},
+			errorClassBucket,
+		)
+		if err != nil {
+			l.Errorf("Error creating new point with error class data: %v\n", err)
+			continue
+		}
+		sendPoint(point)
+	}
+	errorClassCounts = make(map[errorClassKey]int)
+}
+
+// finishErrorClasses sends counts of the last interval and logs most frequent error classes
+func finishErrorClasses() {
+	sendErrorClasses()
+	if topErrorClasses == 0 || len(errorClassTotals) == 0 {
+		return
+	}
+
+	classes := make([]string, 0, len(errorClassTotals))
+	for c := range errorClassTotals {
+		classes = append(classes, c)
+	}
+	sort.Slice(classes, func(i, j int) bool {
+		if errorClassTotals[classes[i]] != errorClassTotals[classes[j]] {
+			return errorClassTotals[classes[i]] > errorClassTotals[classes[j]]
+		}
+		return classes[i] < classes[j]
+	})
+	if len(classes) > topErrorClasses {
+		classes = classes[:topErrorClasses]
+	}
+
+	l.Infof("Top %d of %d error classes:\n", len(classes), len(errorClassTotals))
+	for _, c := range classes {
+		l.Infof("%8d  %s\n", errorClassTotals[c], c)
+	}
+}
+
+func resetErrorClasses() {
+	errorClassBucket = time.Time{}
+	errorClassCounts = make(map[errorClassKey]int)
+	errorClassTotals = make(map[string]int)
+}
@@ -0,0 +1,109 @@
+/*
+Copyright © 2020 Anton Kramarev
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+package parser
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+// groupPathSeparator joins levels of group hierarchy in groupPath and parent tags
+const groupPathSeparator = "/"
+
+// groupDepth is amount of hierarchy levels written as separate tags
+var groupDepth = 3
+
+// groupHierarchy contains tag values derived from a hierarchy of groups
+type groupHierarchy struct {
+	levels []string
+	path   string
+	parent string
+}
+
+var (
+	// hierarchies caches split hierarchies, as the same ones are found on most lines
+	hierarchies = make(map[string]*groupHierarchy)
+	// levelTags are names of per level tags
+	levelTags []string
+)
+
+// InitGroups reads settings of group hierarchy tags
+func InitGroups(cmd *cobra.Command) {
+	depth, _ := cmd.Flags().GetUint("group-depth")
+	groupDepth = int(depth)
+}
+
+// groupHierarchyOf returns values derived from a comma separated hierarchy of groups
+// as it is found in the log, it is nil for requests outside of any group
+func groupHierarchyOf(hierarchy string) *groupHierarchy {
+	if hierarchy == "" {
+		return nil
+	}
+	if h, found := hierarchies[hierarchy]; found {
+		return h
+	}
+	for len(levelTags) < groupDepth {
+		levelTags = append(levelTags, fmt.Sprintf("group_l%d", len(levelTags)+1))
+	}
+	levels := strings.Split(hierarchy, ",")
+	h := &groupHierarchy{
+		levels: levels,
+		path:   strings.Join(levels, groupPathSeparator),
+	}
+	if len(levels) > 1 {
+		h.parent = strings.Join(levels[:len(levels)-1], groupPathSeparator)
+	}
+	if len(hierarchies) < maxCachedNames {
+		hierarchies[hierarchy] = h
+	}
+
+	return h
+}
+
+// groupLevelTags adds tags describing a hierarchy of groups: a tag per level up to
+// the max depth and a full path
+func groupLevelTags(tags map[string]string, h *groupHierarchy) {
+	if h == nil {
+		return
+	}
+	for i := 0; i < len(h.levels) && i < groupDepth; i++ {
+		tags[levelTags[i]] = h.levels[i]
+	}
+	tags["groupPath"] = h.path
+}
+
+// groupParentTags adds hierarchy tags of a group together with a path of its parent,
+// so child groups can be found by parent ones. It returns a depth of the group
+func groupParentTags(tags map[string]string, h *groupHierarchy) int {
+	groupLevelTags(tags, h)
+	if h == nil {
+		return 0
+	}
+	if h.parent != "" {
+		tags["parent"] = h.parent
+	}
+
+	return len(h.levels)
+}
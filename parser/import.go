@@ -0,0 +1,384 @@
+/*
+Copyright © 2020 Anton Kramarev
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+package parser
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dakaraj/gatling-to-influxdb/assertion"
+	"github.com/dakaraj/gatling-to-influxdb/grafana"
+	"github.com/dakaraj/gatling-to-influxdb/influx"
+	l "github.com/dakaraj/gatling-to-influxdb/logger"
+	"github.com/dakaraj/gatling-to-influxdb/stats"
+	"github.com/spf13/cobra"
+)
+
+// importSource is a log file being imported together with its next unprocessed line
+type importSource struct {
+	logSource
+	path   string
+	reader *logReader
+	lines  *lineAssembler
+	line   []byte
+	// ts is a timestamp of the next line (in milliseconds, clock skew compensated)
+	// used to merge lines of all logs in time order
+	ts   int64
+	done bool
+}
+
+// findLogs returns all simulation logs found at provided paths. A path can be
+// either a log file or a directory which is searched recursively for plain,
+// gzip (.gz) or zstd (.zst) compressed logs
+func findLogs(paths []string) ([]string, error) {
+	var logs []string
+	for _, p := range paths {
+		info, err := os.Stat(p)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to access %s: %w", p, err)
+		}
+		if !info.IsDir() {
+			logs = append(logs, p)
+			continue
+		}
+		err = filepath.Walk(p, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if !info.IsDir() && isLogFileName(info.Name()) {
+				logs = append(logs, path)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("Failed to search for logs in %s: %w", p, err)
+		}
+	}
+	if len(logs) == 0 {
+		return nil, fmt.Errorf("No %s files found", simulationLogFileName)
+	}
+
+	return logs, nil
+}
+
+// importNodeNames derives a node name for every log. A single log is tagged with host name
+// as in live mode, otherwise a name of log file or its parent directory is used
+func importNodeNames(logs []string) []string {
+	names := make([]string, len(logs))
+	if len(logs) == 1 {
+		names[0] = nodeName
+		return names
+	}
+
+	seen := make(map[string]int)
+	for i, p := range logs {
+		base := trimCompressedExt(filepath.Base(p))
+		name := strings.TrimSuffix(base, filepath.Ext(base))
+		if base == simulationLogFileName {
+			name = filepath.Base(filepath.Dir(p))
+		}
+		seen[name]++
+		if seen[name] > 1 {
+			name = fmt.Sprintf("%s-%d", name, seen[name])
+		}
+		names[i] = name
+	}
+
+	return names
+}
+
+// lineTimestamp returns a timestamp of an event described by the line
+func (s *logSource) lineTimestamp(lb []byte) int64 {
+	split := s.split(lb)
+	var field []byte
+	switch kind := lineKind(lb); {
+	case kind == requestLine && len(split) >= requestLineLen-1:
+		field = split[5]
+	case kind == groupLine && len(split) >= groupLineLen:
+		field = split[4]
+	case kind == userLine && len(split) >= userLineLen:
+		field = split[5]
+	case kind == errorLine && len(split) >= errorLineLen:
+		field = split[2]
+	case kind == runLine && len(split) >= runLineLen-1:
+		field = split[3]
+	}
+	ts, _ := parseInt(bytes.TrimSpace(field))
+
+	return ts
+}
+
+// next reads the next line of the log. Lines are only returned complete,
+// except the last one that may lack a line break
+func (s *importSource) next() error {
+	b, err := s.lines.next()
+	if err == io.EOF || err == errIncompleteLine {
+		// Log is complete, so a line without a line break can only be the last one
+		b = s.lines.tail()
+		if b == nil {
+			s.done = true
+			return nil
+		}
+	} else if err != nil {
+		s.done = true
+		return fmt.Errorf("Failed to read %s: %w", s.path, err)
+	}
+	s.line = b
+	s.ts = s.lineTimestamp(b) + int64(s.offset/time.Millisecond)
+
+	return nil
+}
+
+func openSources(logs []string) ([]*importSource, error) {
+	names := importNodeNames(logs)
+	sources := make([]*importSource, 0, len(logs))
+	for i, p := range logs {
+		reader, err := openLog(p)
+		if err != nil {
+			closeSources(sources)
+			return nil, fmt.Errorf("Failed to open %s: %w", p, err)
+		}
+		s := &importSource{
+			logSource: logSource{nodeName: names[i]},
+			path:      p,
+			reader:    reader,
+			lines:     newLineAssembler(reader.Reader),
+		}
+		sources = append(sources, s)
+		if err := s.next(); err != nil {
+			closeSources(sources)
+			return nil, err
+		}
+		if s.done || lineKind(s.line) != runLine {
+			closeSources(sources)
+			return nil, fmt.Errorf("%s does not start with a RUN line", p)
+		}
+		l.Infof("Importing %s as node %s\n", p, s.nodeName)
+	}
+
+	return sources, nil
+}
+
+func closeSources(sources []*importSource) {
+	for _, s := range sources {
+		s.reader.Close()
+	}
+}
+
+// alignStarts sets offsets of all sources so their RUN start times match the earliest one.
+// Load generators of a distributed test are started simultaneously, so a difference
+// between start times is considered a clock skew
+func alignStarts(sources []*importSource) {
+	earliest := sources[0].ts
+	for _, s := range sources[1:] {
+		if s.ts < earliest {
+			earliest = s.ts
+		}
+	}
+	for _, s := range sources {
+		s.offset = time.Duration(earliest-s.ts) * time.Millisecond
+		if s.offset != 0 {
+			l.Infof("Shifting timestamps of node %s by %v to compensate clock skew\n", s.nodeName, s.offset)
+		}
+		s.ts += earliest - s.ts
+	}
+}
+
+// mergedLines returns a function returning lines of all logs in time order together
+// with their sources, it returns nil when all logs are read. A line is valid until the next call
+func mergedLines(sources []*importSource) func() ([]byte, *importSource) {
+	var prev *importSource
+	return func() ([]byte, *importSource) {
+		// Previous line is used until the next one is requested, so its source is read only now
+		if prev != nil && !prev.done {
+			if err := prev.next(); err != nil {
+				l.Errorln(err)
+			}
+		}
+
+		var cur *importSource
+		for _, s := range sources {
+			if !s.done && !s.isStopped() && (cur == nil || s.ts < cur.ts) {
+				cur = s
+			}
+		}
+		prev = cur
+		if cur == nil {
+			return nil, nil
+		}
+
+		return cur.line, cur
+	}
+}
+
+// mergeSources processes lines of all logs in time order until all of them are read
+func mergeSources(ctx context.Context, sources []*importSource) {
+	next := mergedLines(sources)
+	if parseWorkers > 1 {
+		processed := runPipeline(ctx, parseWorkers, func() ([]byte, *logSource) {
+			lb, s := next()
+			if lb == nil {
+				return nil, nil
+			}
+			return lb, &s.logSource
+		})
+		if ctx.Err() != nil {
+			l.Infoln("Import received closing signal. Processing stopped")
+		}
+		l.Infof("Import finished, %d lines processed\n", processed)
+		return
+	}
+
+	var processed int
+	for {
+		select {
+		case <-ctx.Done():
+			l.Infoln("Import received closing signal. Processing stopped")
+			return
+		default:
+		}
+
+		lb, cur := next()
+		if lb == nil {
+			l.Infof("Import finished, %d lines processed\n", processed)
+			return
+		}
+		if err := cur.stringProcessor(lb); err != nil {
+			l.Errorf("String processing failed in %s: %v", cur.path, err)
+			if errors.Is(err, errFatal) {
+				l.Errorf("Import of %s stopped because of an error that can't be handled\n", cur.path)
+				cur.stop()
+			}
+		}
+		processed++
+	}
+}
+
+// resetState discards everything collected for a previous test, so several
+// tests can be imported one after another
+func resetState() {
+	stats.Reset()
+	influx.ResetTestInfo()
+	grafana.ResetTestInfo()
+	sessions = make(map[sessionKey]*session)
+	resetSampling()
+	resetNormalization()
+	resetErrorClasses()
+}
+
+// importLogs parses logs of a single test, returned error wraps assertion.ErrFailed
+// if test results did not pass user defined assertions
+func importLogs(ctx context.Context, logs []string, alignStart bool) error {
+	sources, err := openSources(logs)
+	if err != nil {
+		return err
+	}
+	defer closeSources(sources)
+	if alignStart && len(sources) > 1 {
+		alignStarts(sources)
+	}
+
+	wg := &sync.WaitGroup{}
+	iCtx, iCancel := context.WithCancel(context.Background())
+	wg.Add(1)
+	go influx.StartProcessing(iCtx, wg)
+
+	mergeSources(ctx, sources)
+	reportOpenSessions()
+	reportSampling()
+	finishErrorClasses()
+
+	iCancel()
+	wg.Wait()
+
+	node := sources[0].nodeName
+	if len(sources) > 1 {
+		node = influx.AllNodes
+	}
+
+	return checkAssertions(sources[0].simulationName, node)
+}
+
+// RunImport parses complete simulation logs found at provided paths. Logs provided directly
+// are imported as a single test, while each log found in archives is imported as a separate one.
+// Returned error wraps assertion.ErrFailed if test results did not pass user defined assertions
+func RunImport(cmd *cobra.Command, paths []string) error {
+	baseTestID, _ := cmd.Flags().GetString("test-id")
+	alignStart, _ := cmd.Flags().GetBool("align-start")
+	maxExtracted, _ := cmd.Flags().GetUint64("max-extracted-size")
+	rand.Seed(time.Now().UnixNano())
+	nodeName, _ = os.Hostname()
+	defer func() {
+		if err := influx.CloseDBConnection(); err != nil {
+			l.Errorf("Failed to close DB connection: %v", err)
+		}
+	}()
+
+	runs, cleanup, err := collectRuns(paths, int64(maxExtracted))
+	defer cleanup()
+	if err != nil {
+		return err
+	}
+	if len(runs) == 1 {
+		testID = baseTestID
+		return importLogs(cmd.Context(), runs[0].logs, alignStart)
+	}
+
+	var failed []string
+	for i, r := range runs {
+		if cmd.Context().Err() != nil {
+			break
+		}
+		// Runs get distinct test identifiers, so they are not mixed in the database
+		testID = r.name
+		if baseTestID != "" {
+			testID = baseTestID + "-" + r.name
+		}
+		l.Infof("Importing run %d of %d as test %s\n", i+1, len(runs), testID)
+		resetState()
+
+		err := importLogs(cmd.Context(), r.logs, alignStart)
+		if errors.Is(err, assertion.ErrFailed) {
+			l.Errorln(err)
+			failed = append(failed, testID)
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("Failed to import test %s: %w", testID, err)
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("Results of test(s) %s did not pass assertions: %w", strings.Join(failed, ", "), assertion.ErrFailed)
+	}
+
+	return nil
+}
@@ -0,0 +1,129 @@
+/*
+Copyright © 2020 Anton Kramarev
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+package parser
+
+import (
+	"bufio"
+	"errors"
+	"io"
+
+	l "github.com/dakaraj/gatling-to-influxdb/logger"
+)
+
+// errIncompleteLine is returned when a part of a line is read but its line break is not written yet
+var errIncompleteLine = errors.New("Incomplete line")
+
+// lineAssembler reads complete lines from a file that may still be written to.
+// A line is only returned once its line break is read, parts read before are kept
+type lineAssembler struct {
+	r       *bufio.Reader
+	partial []byte
+	line    []byte
+}
+
+func newLineAssembler(r io.Reader) *lineAssembler {
+	br, ok := r.(*bufio.Reader)
+	if !ok {
+		br = bufio.NewReader(r)
+	}
+
+	return &lineAssembler{r: br}
+}
+
+// next returns the next complete line including its line break. It returns io.EOF if
+// nothing new is read and errIncompleteLine if only a part of a line is available yet.
+// Returned line is only valid until the next call, as reading buffers are reused
+func (a *lineAssembler) next() ([]byte, error) {
+	for {
+		b, err := a.r.ReadSlice('\n')
+		if err == nil {
+			if len(a.partial) == 0 {
+				return b, nil
+			}
+			a.line = append(append(a.line[:0], a.partial...), b...)
+			a.partial = a.partial[:0]
+			return a.line, nil
+		}
+		a.partial = append(a.partial, b...)
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err == io.EOF && len(b) > 0 {
+			return nil, errIncompleteLine
+		}
+		return nil, err
+	}
+}
+
+// tail returns a line left without a line break when reading is stopped. Such line is
+// returned only if it looks complete, otherwise it is reported and discarded
+func (a *lineAssembler) tail() []byte {
+	if len(a.partial) == 0 {
+		return nil
+	}
+	t := a.partial
+	a.partial = nil
+	if !lineComplete(t) {
+		l.Errorf("Discarding truncated last line: %q\n", t)
+		return nil
+	}
+	l.Infoln("Last line has no line break but looks complete, processing it")
+
+	return t
+}
+
+func isDigits(b []byte) bool {
+	for _, c := range b {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+
+	return len(b) > 0
+}
+
+// lineComplete checks if a line without a line break has all of its values. Values that end
+// a line can only be checked for lines ending with a timestamp, as its length is known
+func lineComplete(lb []byte) bool {
+	split := splitFields(trimEOL(lb), nil)
+	last := split[len(split)-1]
+	switch lineKind(lb) {
+	case requestLine:
+		return len(split) == requestLineLen
+	case groupLine:
+		if len(split) < groupLineLen {
+			return false
+		}
+		_, _, err := parseGroupStatus(split[6:])
+		return err == nil
+	case userLine:
+		// END timestamp has the same length as START one
+		return len(split) == userLineLen && isDigits(last) && len(last) == len(split[4])
+	case errorLine:
+		return len(split) == errorLineLen && isDigits(last) && len(last) >= len("1000000000000")
+	case runLine:
+		return len(split) == runLineLen
+	}
+
+	return false
+}
@@ -0,0 +1,185 @@
+/*
+Copyright © 2020 Anton Kramarev
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+package parser
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+const (
+	runLineText   = "RUN\tshop.ShopSimulation\tsynthetic\t1790000000000\t \t3.3.1\n"
+	startLineText = "USER\tBrowse\t1\tSTART\t1790000000000\t1790000000000\n"
+	requestText   = "REQUEST\t1\t\tHome\t1790000000100\t1790000000150\tOK\t \n"
+	endLineText   = "USER\tBrowse\t1\tEND\t1790000000000\t1790000001000"
+)
+
+func TestLineAssemblerPartialThenComplete(t *testing.T) {
+	var file bytes.Buffer
+	// A small buffer makes a long line to be read in several parts
+	a := newLineAssembler(bufio.NewReaderSize(&file, 16))
+
+	file.WriteString(requestText[:10])
+	if _, err := a.next(); err != errIncompleteLine {
+		t.Fatalf("Expected incomplete line, got %v", err)
+	}
+	if _, err := a.next(); err != io.EOF {
+		t.Fatalf("Expected EOF while nothing new is written, got %v", err)
+	}
+	file.WriteString(requestText[10:30])
+	if _, err := a.next(); err != errIncompleteLine {
+		t.Fatalf("Expected incomplete line, got %v", err)
+	}
+	file.WriteString(requestText[30:] + startLineText)
+	for _, want := range []string{requestText, startLineText} {
+		got, err := a.next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != want {
+			t.Errorf("Expected line %q, got %q", want, got)
+		}
+	}
+	if _, err := a.next(); err != io.EOF {
+		t.Errorf("Expected EOF, got %v", err)
+	}
+	if tail := a.tail(); tail != nil {
+		t.Errorf("Expected no tail after complete lines, got %q", tail)
+	}
+}
+
+func TestLineAssemblerTail(t *testing.T) {
+	tests := []struct {
+		name string
+		tail string
+		want bool
+	}{
+		{name: "complete request", tail: strings.TrimSuffix(requestText, "\n"), want: true},
+		{name: "complete user", tail: endLineText, want: true},
+		{name: "user with truncated timestamp", tail: endLineText[:len(endLineText)-3]},
+		{name: "request without message", tail: "REQUEST\t1\t\tHome\t1790000000100\t1790000000150\tOK"},
+		{name: "complete group", tail: "GROUP\t1\tVisit\t1790000000000\t1790000000500\t50\tKO", want: true},
+		{name: "truncated group status", tail: "GROUP\t1\tVisit\t1790000000000\t1790000000500\t50\tK"},
+		{name: "unknown line", tail: "REQ"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := newLineAssembler(strings.NewReader(startLineText + tt.tail))
+			if _, err := a.next(); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := a.next(); err != errIncompleteLine {
+				t.Fatalf("Expected incomplete line, got %v", err)
+			}
+			tail := a.tail()
+			if got := tail != nil; got != tt.want {
+				t.Fatalf("Expected tail to be returned %v, got %q", tt.want, tail)
+			}
+			if tail != nil && string(tail) != tt.tail {
+				t.Errorf("Expected tail %q, got %q", tt.tail, tail)
+			}
+			if tail := a.tail(); tail != nil {
+				t.Errorf("Expected tail to be returned once, got %q", tail)
+			}
+		})
+	}
+}
+
+// failingReader returns its data and then an error other than EOF
+type failingReader struct {
+	data string
+}
+
+func (r *failingReader) Read(p []byte) (int, error) {
+	if r.data == "" {
+		return 0, errors.New("Read failed")
+	}
+	n := copy(p, r.data)
+	r.data = r.data[n:]
+
+	return n, nil
+}
+
+// processFile runs fileProcessor until it stops and returns the log it wrote
+func processFile(t *testing.T, r io.Reader) (*collector, string) {
+	logged, done := captureLog(t)
+	defer done()
+	setUp(t)
+	c, restore := collect()
+	defer restore()
+	defer func(w uint) { waitTime = w }(waitTime)
+	waitTime = 0
+
+	go fileProcessor(context.Background(), &logSource{nodeName: nodeName}, r)
+	<-parserStopped
+
+	return c, logged()
+}
+
+func TestFileProcessorTail(t *testing.T) {
+	tests := []struct {
+		name   string
+		r      io.Reader
+		ends   int
+		logged string
+	}{
+		{
+			name:   "complete tail on timeout",
+			r:      strings.NewReader(runLineText + startLineText + endLineText),
+			ends:   1,
+			logged: "looks complete",
+		},
+		{
+			name:   "truncated tail on timeout",
+			r:      strings.NewReader(runLineText + startLineText + endLineText[:len(endLineText)-3]),
+			logged: "Discarding truncated last line",
+		},
+		{
+			name:   "tail after read error",
+			r:      &failingReader{runLineText + startLineText + endLineText},
+			logged: "Unexpected error encountered while reading file",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, logged := processFile(t, tt.r)
+			ends := 0
+			for _, u := range c.users {
+				if u.status == "END" {
+					ends++
+				}
+			}
+			if ends != tt.ends {
+				t.Errorf("Expected %d END events, got %d", tt.ends, ends)
+			}
+			if !strings.Contains(logged, tt.logged) {
+				t.Errorf("Expected log to contain %q, got:\n%s", tt.logged, logged)
+			}
+		})
+	}
+}
@@ -0,0 +1,177 @@
+/*
+Copyright © 2020 Anton Kramarev
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+package parser
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strings"
+
+	l "github.com/dakaraj/gatling-to-influxdb/logger"
+	"github.com/spf13/cobra"
+)
+
+// maxCachedNames limits amount of raw names with cached normalization results,
+// so names with unique IDs in them don't consume all memory
+const maxCachedNames = 100000
+
+type replaceRule struct {
+	re   *regexp.Regexp
+	repl string
+}
+
+// nameNormalizer maps raw names to values written as tags, limiting amount of distinct values
+type nameNormalizer struct {
+	kind   string
+	seen   map[string]struct{}
+	cache  map[string]string
+	warned bool
+}
+
+var (
+	replaceRules []replaceRule
+	allowRules   []*regexp.Regexp
+	maxNames     int
+	otherName    = "other"
+
+	requestNames = newNameNormalizer("request")
+	groupNames   = newNameNormalizer("group")
+	// groupHierarchies caches normalized hierarchies by raw ones
+	groupHierarchies = make(map[string]string)
+)
+
+func newNameNormalizer(kind string) *nameNormalizer {
+	return &nameNormalizer{
+		kind:  kind,
+		seen:  make(map[string]struct{}),
+		cache: make(map[string]string),
+	}
+}
+
+// InitNormalization reads rules of request and group names normalization
+func InitNormalization(cmd *cobra.Command) error {
+	replaces, _ := cmd.Flags().GetStringArray("name-replace")
+	allows, _ := cmd.Flags().GetStringArray("name-allow")
+	max, _ := cmd.Flags().GetUint("max-names")
+	otherName, _ = cmd.Flags().GetString("other-name")
+	maxNames = int(max)
+
+	replaceRules = make([]replaceRule, 0, len(replaces))
+	for _, r := range replaces {
+		parts := strings.SplitN(r, "=>", 2)
+		if len(parts) != 2 {
+			return fmt.Errorf("Invalid replace rule %q, expected regex=>replacement", r)
+		}
+		re, err := regexp.Compile(parts[0])
+		if err != nil {
+			return fmt.Errorf("Invalid regular expression in replace rule %q: %w", r, err)
+		}
+		replaceRules = append(replaceRules, replaceRule{re, parts[1]})
+	}
+	allowRules = make([]*regexp.Regexp, 0, len(allows))
+	for _, a := range allows {
+		re, err := regexp.Compile(a)
+		if err != nil {
+			return fmt.Errorf("Invalid regular expression in allow rule %q: %w", a, err)
+		}
+		allowRules = append(allowRules, re)
+	}
+
+	return nil
+}
+
+func allowed(name string) bool {
+	if len(allowRules) == 0 {
+		return true
+	}
+	for _, re := range allowRules {
+		if re.MatchString(name) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// normalize applies replace rules and allow-list to a name. When amount of distinct
+// names reaches the limit, all new names are replaced with a common one
+func (n *nameNormalizer) normalize(rawBytes []byte) string {
+	// Lookup by converted bytes doesn't allocate a string
+	if v, found := n.cache[string(rawBytes)]; found {
+		return v
+	}
+
+	raw := string(rawBytes)
+	name := raw
+	for _, r := range replaceRules {
+		name = r.re.ReplaceAllString(name, r.repl)
+	}
+	if !allowed(name) {
+		name = otherName
+	}
+	if _, found := n.seen[name]; !found && name != otherName && maxNames > 0 {
+		if len(n.seen) >= maxNames {
+			if !n.warned {
+				l.Errorf("Limit of %d distinct %s names is reached, new names are written as '%s'. First one is '%s'\n", maxNames, n.kind, otherName, raw)
+				n.warned = true
+			}
+			name = otherName
+		} else {
+			n.seen[name] = struct{}{}
+		}
+	}
+
+	if len(n.cache) < maxCachedNames {
+		n.cache[raw] = name
+	}
+
+	return name
+}
+
+// normalizeGroups normalizes every group in a comma separated hierarchy of groups
+func normalizeGroups(hierarchy []byte) string {
+	if len(hierarchy) == 0 {
+		return ""
+	}
+	if v, found := groupHierarchies[string(hierarchy)]; found {
+		return v
+	}
+	groups := bytes.Split(hierarchy, []byte(","))
+	names := make([]string, len(groups))
+	for i, g := range groups {
+		names[i] = groupNames.normalize(g)
+	}
+	v := strings.Join(names, ",")
+	if len(groupHierarchies) < maxCachedNames {
+		groupHierarchies[string(hierarchy)] = v
+	}
+
+	return v
+}
+
+func resetNormalization() {
+	requestNames = newNameNormalizer("request")
+	groupNames = newNameNormalizer("group")
+	groupHierarchies = make(map[string]string)
+}
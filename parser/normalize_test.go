@@ -0,0 +1,150 @@
+/*
+Copyright © 2020 Anton Kramarev
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+package parser
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestNormalize(t *testing.T) {
+	tests := []struct {
+		name  string
+		args  []string
+		names []string
+		want  []string
+	}{
+		{
+			name:  "no rules",
+			names: []string{"/items/1", "Home"},
+			want:  []string{"/items/1", "Home"},
+		},
+		{
+			name:  "replace",
+			args:  []string{"--name-replace", `/items/\d+=>/items/{id}`},
+			names: []string{"/items/1", "/items/22/reviews", "/cart"},
+			want:  []string{"/items/{id}", "/items/{id}/reviews", "/cart"},
+		},
+		{
+			name:  "replace rules applied in order",
+			args:  []string{"--name-replace", `\d+=>N`, "--name-replace", `N=>{id}`},
+			names: []string{"/users/7/orders/8"},
+			want:  []string{"/users/{id}/orders/{id}"},
+		},
+		{
+			name:  "replace with submatch",
+			args:  []string{"--name-replace", `^(GET|POST) .*=>$1 request`},
+			names: []string{"GET /a", "POST /b"},
+			want:  []string{"GET request", "POST request"},
+		},
+		{
+			name:  "allow-list",
+			args:  []string{"--name-allow", "^Home$", "--name-allow", "^Item"},
+			names: []string{"Home", "Item 1", "Pay", "Homepage"},
+			want:  []string{"Home", "Item 1", "other", "other"},
+		},
+		{
+			name:  "allow-list checks replaced names",
+			args:  []string{"--name-replace", `\d+=>{id}`, "--name-allow", `^/items/\{id\}$`},
+			names: []string{"/items/5", "/users/5"},
+			want:  []string{"/items/{id}", "other"},
+		},
+		{
+			name:  "max names",
+			args:  []string{"--max-names", "2"},
+			names: []string{"a", "b", "c", "a", "b", "d"},
+			want:  []string{"a", "b", "other", "a", "b", "other"},
+		},
+		{
+			name:  "other name does not count to max names",
+			args:  []string{"--max-names", "1", "--name-allow", "^a", "--other-name", "rest"},
+			names: []string{"x", "a", "y", "ab"},
+			want:  []string{"rest", "a", "rest", "rest"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setUp(t, tt.args...)
+			got := make([]string, len(tt.names))
+			for i, name := range tt.names {
+				got[i] = requestNames.normalize([]byte(name))
+			}
+			if strings.Join(got, "|") != strings.Join(tt.want, "|") {
+				t.Errorf("Expected names %q, got %q", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestNormalizeWarnsOnceAboutCardinality(t *testing.T) {
+	logged, done := captureLog(t)
+	defer done()
+	setUp(t, "--max-names", "2")
+
+	for _, name := range []string{"a", "b", "c", "d", "a"} {
+		requestNames.normalize([]byte(name))
+	}
+	// Groups have own limit
+	if got := normalizeGroups([]byte("a,x")); got != "a,x" {
+		t.Errorf("Expected group names within their limit, got %q", got)
+	}
+
+	out := logged()
+	if n := strings.Count(out, "Limit of 2 distinct request names is reached"); n != 1 {
+		t.Errorf("Expected a single cardinality warning, got %d in:\n%s", n, out)
+	}
+	if !strings.Contains(out, "First one is 'c'") {
+		t.Errorf("Expected the first name over the limit to be reported, got:\n%s", out)
+	}
+	if strings.Contains(out, "distinct group names") {
+		t.Errorf("Expected no warning about group names, got:\n%s", out)
+	}
+}
+
+func TestNormalizeGroups(t *testing.T) {
+	setUp(t, "--name-replace", `\d+=>N`)
+
+	tests := map[string]string{
+		"":                  "",
+		"Visit":             "Visit",
+		"Visit 1,Page 2":    "Visit N,Page N",
+		"Visit 3,Page 4,Ok": "Visit N,Page N,Ok",
+	}
+	for raw, want := range tests {
+		if got := normalizeGroups([]byte(raw)); got != want {
+			t.Errorf("Expected %q to be normalized to %q, got %q", raw, want, got)
+		}
+	}
+}
+
+func TestInitNormalizationRejectsInvalidRules(t *testing.T) {
+	for _, args := range [][]string{
+		{"--name-replace", "no separator"},
+		{"--name-replace", "([=>x"},
+		{"--name-allow", "(["},
+	} {
+		if err := InitNormalization(newTestCommand(t, args...)); err == nil {
+			t.Errorf("Expected an error for %q", args)
+		}
+	}
+}
@@ -23,7 +23,6 @@ THE SOFTWARE.
 package parser
 
 import (
-	"bufio"
 	"bytes"
 	"context"
 	"errors"
@@ -34,12 +33,15 @@ import (
 	"path/filepath"
 	"regexp"
 	"runtime"
-	"strconv"
 	"sync"
 	"time"
 
+	"github.com/dakaraj/gatling-to-influxdb/alert"
+	"github.com/dakaraj/gatling-to-influxdb/assertion"
+	"github.com/dakaraj/gatling-to-influxdb/grafana"
 	"github.com/dakaraj/gatling-to-influxdb/influx"
 	l "github.com/dakaraj/gatling-to-influxdb/logger"
+	"github.com/dakaraj/gatling-to-influxdb/stats"
 
 	// infc "github.com/influxdata/influxdb1-client/v2"
 	"github.com/spf13/cobra"
@@ -66,21 +68,36 @@ var (
 	errFatal         = errors.New("Fatal error")
 	logDir           string
 	testID           string
-	simulationName   string
 	waitTime         uint
 
 	tabSep = []byte{9}
 
-	// regular expression patterns for matching log strings
-	userLine    = regexp.MustCompile(`^USER\s`)
-	requestLine = regexp.MustCompile(`^REQUEST\s`)
-	groupLine   = regexp.MustCompile(`GROUP\s`)
-	runLine     = regexp.MustCompile(`^RUN\s`)
-	errorLine   = regexp.MustCompile(`^ERROR\s`)
-
 	parserStopped = make(chan struct{})
 )
 
+// Points and user events are passed to InfluxDB consumers with these functions,
+// so tests can collect them instead
+var (
+	sendPoint    = influx.SendPoint
+	sendUserLine = influx.SendUserLineData
+)
+
+// logSource contains state of a single simulation.log being parsed
+type logSource struct {
+	nodeName       string
+	simulationName string
+	// offset is added to all log timestamps to compensate clock skew between load generators
+	offset time.Duration
+
+	// Buffers reused between lines, so parsing a line doesn't allocate memory
+	fields  [][]byte
+	strings map[string]string
+	rec     record
+	builder pointBuilder
+	// stopped is set when lines of the source can't be processed anymore
+	stopped int32
+}
+
 func lookupTargetDir(ctx context.Context, dir string) error {
 	const loopTimeout = 5 * time.Second
 
@@ -198,7 +215,7 @@ func waitForLog(ctx context.Context) error {
 }
 
 func timeFromUnixBytes(ub []byte) (time.Time, error) {
-	timeStamp, err := strconv.ParseInt(string(ub), 10, 64)
+	timeStamp, err := parseInt(ub)
 	if err != nil {
 		return time.Time{}, fmt.Errorf("Failed to parse timestamp as integer: %w", err)
 	}
@@ -207,150 +224,368 @@ func timeFromUnixBytes(ub []byte) (time.Time, error) {
 	return time.Unix(0, timeStamp*oneMillisecond+rand.Int63n(oneMillisecond)), nil
 }
 
-func userLineProcess(lb []byte) error {
-	split := bytes.Split(lb, tabSep)
+func (s *logSource) timeFromUnixBytes(ub []byte) (time.Time, error) {
+	t, err := timeFromUnixBytes(ub)
+	if err != nil {
+		return t, err
+	}
+
+	return t.Add(s.offset), nil
+}
+
+// record is a log line split into values. Values reference bytes of the line, so a record
+// is only valid while the line is. Parsing doesn't depend on the state of the parser and
+// can be done concurrently, while parsed records are applied to the state in log order
+type record struct {
+	kind      lineType
+	err       error
+	fields    [][]byte
+	userID    int64
+	start     int64
+	end       int64
+	timestamp time.Time
+	// rawDuration and message are only set for groups
+	rawDuration int64
+	message     string
+
+	// Values resolved when a record is applied, they are used to build a point
+	point      bool
+	name       string
+	groups     string
+	hierarchy  *groupHierarchy
+	result     string
+	simulation string
+	errorText  string
+	errorClass string
+	koCount    int
+	weight     float64
+}
+
+// parseRecord splits the line and parses its values. It only reads source settings,
+// so several lines of the same source can be parsed at the same time
+func (s *logSource) parseRecord(lb []byte, r *record) error {
+	r.kind = lineKind(lb)
+	r.fields = splitFields(lb, r.fields)
+	r.point = false
+	switch r.kind {
+	case userLine:
+		return s.parseUser(r)
+	case requestLine:
+		return s.parseRequest(r)
+	case groupLine:
+		return s.parseGroup(r)
+	case errorLine:
+		return s.parseError(r)
+	case runLine:
+		// RUN line is parsed when applied, as it sets up the source
+		return nil
+	default:
+		return fmt.Errorf("Unknown line type encountered")
+	}
+}
+
+func (s *logSource) parseUser(r *record) error {
+	split := r.fields
 	if len(split) != userLineLen {
 		return errors.New("USER line contains unexpected amount of values")
 	}
-	scenario := string(split[1])
-	// Using the second of the two timestamps
-	// A user life duration may come in handy later
-	timestamp, err := timeFromUnixBytes(bytes.TrimSpace(split[5]))
+	var err error
+	r.userID, err = parseInt(split[2])
+	if err != nil {
+		return fmt.Errorf("Failed to parse userID in line as integer: %w", err)
+	}
+	// Using the second of the two timestamps for user activity,
+	// while both are used to calculate a session duration
+	r.timestamp, err = s.timeFromUnixBytes(split[5])
 	if err != nil {
 		return err
 	}
-
-	influx.SendUserLineData(timestamp, scenario, string(split[3]))
+	if string(split[3]) != "END" {
+		return nil
+	}
+	r.start, err = parseInt(split[4])
+	if err != nil {
+		return fmt.Errorf("Failed to parse user start time in line as integer: %w", err)
+	}
+	r.end, err = parseInt(split[5])
+	if err != nil {
+		return fmt.Errorf("Failed to parse user end time in line as integer: %w", err)
+	}
 
 	return nil
 }
 
-func requestLineProcess(lb []byte) error {
-	split := bytes.Split(lb, tabSep)
+func (s *logSource) parseRequest(r *record) error {
+	split := r.fields
 	if len(split) != requestLineLen {
 		return errors.New("REQUEST line contains unexpected amount of values")
 	}
 
-	userID, err := strconv.ParseInt(string(split[1]), 10, 32)
+	var err error
+	r.userID, err = parseInt(split[1])
 	if err != nil {
 		return fmt.Errorf("Failed to parse userID in line as integer: %w", err)
 	}
-	start, err := strconv.ParseInt(string(split[4]), 10, 64)
+	r.start, err = parseInt(split[4])
 	if err != nil {
 		return fmt.Errorf("Failed to parse request start time in line as integer: %w", err)
 	}
-	end, err := strconv.ParseInt(string(split[5]), 10, 64)
+	r.end, err = parseInt(split[5])
 	if err != nil {
 		return fmt.Errorf("Failed to parse request end time in line as integer: %w", err)
 	}
-	timestamp, err := timeFromUnixBytes(split[5])
-	if err != nil {
-		return err
-	}
+	r.timestamp, err = s.timeFromUnixBytes(split[5])
 
-	point, err := influx.NewPoint(
-		"requests",
-		map[string]string{
-			"name":       string(split[3]),
-			"groups":     string(split[2]),
-			"result":     string(split[6]),
-			"simulation": simulationName,
-			"testId":     testID,
-			"nodeName":   nodeName,
-		},
-		map[string]interface{}{
-			"userId":       int(userID),
-			"duration":     int(end - start),
-			"errorMessage": string(bytes.TrimSpace(split[7])),
-		},
-		timestamp,
-	)
-	if err != nil {
-		return fmt.Errorf("Error creating new point with request data: %w", err)
-	}
-
-	influx.SendPoint(point)
+	return err
+}
 
-	return nil
+// parseGroupStatus returns group status and a message following it if any.
+// Status is the first word of the status field, the rest of the line is a message
+func parseGroupStatus(fields [][]byte) (string, string, error) {
+	var rest []byte
+	if len(fields) == 1 {
+		rest = bytes.TrimSpace(fields[0])
+	} else {
+		rest = bytes.TrimSpace(bytes.Join(fields, tabSep))
+	}
+	status := rest
+	var message []byte
+	if i := bytes.IndexAny(rest, " \t"); i >= 0 {
+		status, message = rest[:i], bytes.TrimSpace(rest[i+1:])
+	}
+	switch string(status) {
+	case "OK":
+		return "OK", string(message), nil
+	case "KO":
+		return "KO", string(message), nil
+	default:
+		return "", "", fmt.Errorf("Unexpected group status %q", status)
+	}
 }
 
-func groupLineProcess(lb []byte) error {
-	split := bytes.Split(lb, tabSep)
-	if len(split) != groupLineLen {
+func (s *logSource) parseGroup(r *record) error {
+	split := r.fields
+	// Some Gatling versions write a message after group status
+	if len(split) < groupLineLen {
 		return errors.New("GROUP line contains unexpected amount of values")
 	}
 
-	userID, err := strconv.ParseInt(string(split[1]), 10, 32)
+	var err error
+	r.userID, err = parseInt(split[1])
 	if err != nil {
 		return fmt.Errorf("Failed to parse userID in line as integer: %w", err)
 	}
-	start, err := strconv.ParseInt(string(split[3]), 10, 64)
+	r.start, err = parseInt(split[3])
 	if err != nil {
 		return fmt.Errorf("Failed to parse group start time in line as integer: %w", err)
 	}
-	end, err := strconv.ParseInt(string(split[4]), 10, 64)
+	r.end, err = parseInt(split[4])
 	if err != nil {
 		return fmt.Errorf("Failed to parse group end time in line as integer: %w", err)
 	}
-	rawDuration, err := strconv.ParseInt(string(split[5]), 10, 32)
+	r.rawDuration, err = parseInt(split[5])
 	if err != nil {
 		return fmt.Errorf("Failed to parse group raw duration in line as integer: %w", err)
 	}
-	timestamp, err := timeFromUnixBytes(split[4])
+	r.timestamp, err = s.timeFromUnixBytes(split[4])
 	if err != nil {
 		return err
 	}
+	r.result, r.message, err = parseGroupStatus(split[6:])
 
-	point, err := influx.NewPoint(
-		"groups",
-		map[string]string{
-			"name":       string(split[2]),
-			"result":     string(split[6][:2]),
-			"simulation": simulationName,
-			"testId":     testID,
-			"nodeName":   nodeName,
-		},
-		map[string]interface{}{
-			"userId":        int(userID),
-			"totalDuration": int(end - start),
-			"rawDuration":   int(rawDuration),
-		},
-		timestamp,
-	)
-	if err != nil {
-		return fmt.Errorf("Error creating new point with group data: %w", err)
+	return err
+}
+
+func (s *logSource) parseError(r *record) error {
+	split := r.fields
+	if len(split) != errorLineLen {
+		return errors.New("ERROR line contains unexpected amount of values")
+	}
+	var err error
+	r.timestamp, err = s.timeFromUnixBytes(bytes.TrimSpace(split[2]))
+
+	return err
+}
+
+// applyRecord updates parser state with a parsed record and resolves values of a point
+// to be built. Records have to be applied one by one in log order
+func (s *logSource) applyRecord(r *record) error {
+	switch r.kind {
+	case userLine:
+		return s.applyUser(r)
+	case requestLine:
+		s.applyRequest(r)
+	case groupLine:
+		s.applyGroup(r)
+	case errorLine:
+		s.applyError(r)
+	case runLine:
+		return s.runLineProcess(r.fields)
 	}
 
-	influx.SendPoint(point)
+	return nil
+}
+
+func (s *logSource) applyUser(r *record) error {
+	scenario := s.intern(r.fields[1])
+	status := s.intern(r.fields[3])
+	stats.AddUser(status, r.timestamp)
+	sendUserLine(r.timestamp, s.nodeName, scenario, status)
+
+	switch status {
+	case "START":
+		s.sessionStart(r.userID, scenario)
+	case "END":
+		return s.sessionEnd(r.userID, scenario, r.end-r.start, r.timestamp)
+	}
+
+	return nil
+}
+
+func (s *logSource) applyRequest(r *record) {
+	split := r.fields
+	r.name = requestNames.normalize(split[3])
+	r.groups = normalizeGroups(split[2])
+	r.result = s.intern(split[6])
+	duration := int(r.end - r.start)
+	ok := r.result == "OK"
+	stats.AddRequest(r.name, duration, ok, r.timestamp)
+	alert.AddRequest(r.name, duration, ok, r.timestamp)
+	s.sessionRequest(r.userID, ok, r.groups)
+	r.errorText = string(bytes.TrimSpace(split[7]))
+	r.errorClass = ""
+	if !ok && r.errorText != "" {
+		r.errorClass = fingerprint(r.errorText)
+		s.countErrorClass(r.errorClass, sourceRequest, r.timestamp)
+	}
+	r.weight = requestWeight(duration, ok)
+	r.point = r.weight > 0
+	r.hierarchy = groupHierarchyOf(r.groups)
+	r.simulation = s.simulationName
+}
+
+func (s *logSource) applyGroup(r *record) {
+	r.name = normalizeGroups(r.fields[2])
+	duration := int(r.end - r.start)
+	stats.AddGroup(r.name, duration, r.result == "OK", r.timestamp)
+	alert.AddGroup(r.name, duration, r.result == "OK", r.timestamp)
+	r.koCount = s.sessionGroup(r.userID, r.name)
+	r.hierarchy = groupHierarchyOf(r.name)
+	r.simulation = s.simulationName
+	r.point = true
+}
+
+func (s *logSource) applyError(r *record) {
+	r.errorText = string(r.fields[1])
+	grafana.AddError(r.timestamp, r.errorText)
+	r.errorClass = fingerprint(r.errorText)
+	s.countErrorClass(r.errorClass, sourceErrorLog, r.timestamp)
+	r.simulation = s.simulationName
+	r.point = true
+}
+
+// pointBuilder keeps tags and fields maps reused between points, as their content
+// is copied when a point is created
+type pointBuilder struct {
+	tags   map[string]string
+	values map[string]interface{}
+}
+
+// maps returns tags and fields maps emptied for a new point
+func (b *pointBuilder) maps() (map[string]string, map[string]interface{}) {
+	if b.tags == nil {
+		b.tags = make(map[string]string, 12)
+		b.values = make(map[string]interface{}, 8)
+	}
+	for k := range b.tags {
+		delete(b.tags, k)
+	}
+	for k := range b.values {
+		delete(b.values, k)
+	}
+
+	return b.tags, b.values
+}
+
+// buildPoint creates a point of an applied record and sends it to the database. It only
+// uses values resolved for the record, so points can be built concurrently
+func (s *logSource) buildPoint(r *record, b *pointBuilder) error {
+	if !r.point {
+		return nil
+	}
+	tags, fields := b.maps()
+	tags["simulation"] = r.simulation
+	tags["testId"] = testID
+	tags["nodeName"] = s.nodeName
+
+	var measurement string
+	switch r.kind {
+	case requestLine:
+		measurement = "requests"
+		tags["name"] = r.name
+		tags["groups"] = r.groups
+		tags["result"] = r.result
+		if r.errorClass != "" {
+			tags["errorClass"] = r.errorClass
+		}
+		groupLevelTags(tags, r.hierarchy)
+		fields["userId"] = int(r.userID)
+		fields["duration"] = int(r.end - r.start)
+		fields["errorMessage"] = r.errorText
+		fields["weight"] = r.weight
+	case groupLine:
+		measurement = "groups"
+		tags["name"] = r.name
+		tags["result"] = r.result
+		fields["userId"] = int(r.userID)
+		fields["totalDuration"] = int(r.end - r.start)
+		fields["rawDuration"] = int(r.rawDuration)
+		fields["depth"] = groupParentTags(tags, r.hierarchy)
+		fields["koCount"] = r.koCount
+		fields["message"] = r.message
+	case errorLine:
+		measurement = "errors"
+		tags["errorClass"] = r.errorClass
+		fields["errorMessage"] = r.errorText
+	default:
+		return nil
+	}
+
+	point, err := influx.NewPoint(measurement, tags, fields, r.timestamp)
+	if err != nil {
+		return fmt.Errorf("Error creating new point with %s data: %w", r.kind, err)
+	}
+	sendPoint(point)
 
 	return nil
 }
 
 // This method should be called first when parsing started as it is based
 // on information from the header row
-func runLineProcess(lb []byte) error {
-	split := bytes.Split(lb, tabSep)
+func (s *logSource) runLineProcess(split [][]byte) error {
 	if len(split) != runLineLen {
 		return errors.New("RUN line contains unexpected amount of values")
 	}
 
-	simulationName = string(split[1])
+	s.simulationName = s.intern(split[1])
 	description := string(split[4])
-	testStartTime, err := timeFromUnixBytes(split[3])
+	testStartTime, err := s.timeFromUnixBytes(split[3])
 	if err != nil {
 		return err
 	}
 
 	// This will initialize required data for influx client
-	influx.InitTestInfo(testID, simulationName, description, nodeName, testStartTime)
+	influx.InitTestInfo(testID, s.simulationName, description, s.nodeName, testStartTime)
+	alert.SetTestInfo(testID, s.simulationName, s.nodeName)
+	grafana.AnnotateTestStart(testID, s.simulationName, description, s.nodeName, testStartTime)
 
 	point, err := influx.NewPoint(
 		"tests",
 		map[string]string{
 			"action":     "start",
-			"simulation": simulationName,
+			"simulation": s.simulationName,
 			"testId":     testID,
-			"nodeName":   nodeName,
+			"nodeName":   s.nodeName,
 		},
 		map[string]interface{}{
 			"description": description,
@@ -361,68 +596,55 @@ func runLineProcess(lb []byte) error {
 		return fmt.Errorf("Error creating new point with test start data: %w", err)
 	}
 
-	influx.SendPoint(point)
+	sendPoint(point)
 
 	return nil
 }
 
-func errorLineProcess(lb []byte) error {
-	split := bytes.Split(lb, tabSep)
-	if len(split) != errorLineLen {
-		return errors.New("ERROR line contains unexpected amount of values")
+// stringProcessor parses a line, applies it and builds its point right away
+func (s *logSource) stringProcessor(lineBuffer []byte) error {
+	r := &s.rec
+	err := s.parseRecord(lineBuffer, r)
+	if err == nil {
+		err = s.applyRecord(r)
 	}
-	timestamp, err := timeFromUnixBytes(bytes.TrimSpace(split[2]))
-	if err != nil {
-		return err
+	if err == nil {
+		err = s.buildPoint(r, &s.builder)
 	}
 
-	point, err := influx.NewPoint(
-		"errors",
-		map[string]string{
-			"testId":     testID,
-			"nodeName":   nodeName,
-			"simulation": simulationName,
-		},
-		map[string]interface{}{
-			"errorMessage": string(split[1]),
-		},
-		timestamp,
-	)
-	if err != nil {
-		return fmt.Errorf("Error creating new point with error data: %w", err)
-	}
+	return s.wrapFatal(r, err)
+}
 
-	influx.SendPoint(point)
+// wrapFatal marks errors of RUN line as fatal, because further processing is futile
+func (s *logSource) wrapFatal(r *record, err error) error {
+	if err != nil && r.kind == runLine {
+		return fmt.Errorf("%v: %w", err, errFatal)
+	}
 
-	return nil
+	return err
 }
 
-func stringProcessor(lineBuffer []byte) error {
-	switch {
-	case requestLine.Match(lineBuffer):
-		return requestLineProcess(lineBuffer)
-	case groupLine.Match(lineBuffer):
-		return groupLineProcess(lineBuffer)
-	case userLine.Match(lineBuffer):
-		return userLineProcess(lineBuffer)
-	case errorLine.Match(lineBuffer):
-		return errorLineProcess(lineBuffer)
-	case runLine.Match(lineBuffer):
-		err := runLineProcess(lineBuffer)
-		if err != nil {
-			// Wrapping in a fatal error because further processing is futile
-			err = fmt.Errorf("%v: %w", err, errFatal)
+// processLine parses a single line and reports if parsing can be continued
+func (s *logSource) processLine(lb []byte) bool {
+	err := s.stringProcessor(lb)
+	if err != nil {
+		l.Errorf("String processing failed: %v", err)
+		if errors.Is(err, errFatal) {
+			l.Errorln("Log parser caught an error that can't be handled. Stopping application...")
+			return false
 		}
-		return err
-	default:
-		return fmt.Errorf("Unknown line type encountered")
 	}
+
+	return true
 }
 
-func fileProcessor(ctx context.Context, file *os.File) {
-	r := bufio.NewReader(file)
-	buf := new(bytes.Buffer)
+// fileProcessor processes lines of a live log one by one as they are written. Unlike import
+// it doesn't use a parallel pipeline, as Gatling writes lines slower than they are parsed
+func fileProcessor(ctx context.Context, src *logSource, file io.Reader) {
+	lines := newLineAssembler(file)
 	startWait := time.Now()
+	// stopped is set when reading stops on timeout or user signal rather than an error
+	stopped := true
 ParseLoop:
 	for {
 		// This block checks if stop signal is received from user
@@ -434,40 +656,46 @@ ParseLoop:
 		default:
 		}
 
-		b, err := r.ReadBytes('\n')
-		if err == io.EOF {
+		lb, err := lines.next()
+		if err == io.EOF || err == errIncompleteLine {
+			// A part of a line is a progress as well, the rest of it is expected soon
+			if err == errIncompleteLine {
+				startWait = time.Now()
+			}
 			// If no new lines read for more than value provided by 'stop-timeout' key then processing is stopped
 			if time.Now().After(startWait.Add(time.Duration(waitTime) * time.Second)) {
 				l.Infof("No new lines found for %d seconds. Stopping application...", waitTime)
 				break ParseLoop
 			}
-			// All new data is stored in buffer until next loop
-			buf.Write(b)
 			time.Sleep(time.Second)
 			continue
 		}
 		if err != nil {
-			l.Errorf("Unexpected error encountered while parsing file: %v", err)
+			l.Errorf("Unexpected error encountered while reading file: %v", err)
+			stopped = false
+			break ParseLoop
 		}
 
-		buf.Write(b)
-		err = stringProcessor(buf.Bytes())
-		if err != nil {
-			l.Errorf("String processing failed: %v", err)
-			if errors.Is(err, errFatal) {
-				l.Errorln("Log parser caught an error that can't be handled. Stopping application...")
-				break ParseLoop
-			}
+		if !src.processLine(lb) {
+			stopped = false
+			break ParseLoop
 		}
-		// Clean buffer after processing preparing for a new loop
-		buf.Reset()
 		// Reset a timeout timer
 		startWait = time.Now()
 	}
+	// Nothing is parsed after an error, the rest of a line is only expected if writing continued
+	if stopped {
+		if tail := lines.tail(); tail != nil {
+			src.processLine(tail)
+		}
+	}
+	reportOpenSessions()
+	reportSampling()
+	finishErrorClasses()
 	parserStopped <- struct{}{}
 }
 
-func parseStart(ctx context.Context, wg *sync.WaitGroup) {
+func parseStart(ctx context.Context, wg *sync.WaitGroup, src *logSource) {
 	defer wg.Done()
 
 	l.Infoln("Starting log file parser...")
@@ -477,11 +705,39 @@ func parseStart(ctx context.Context, wg *sync.WaitGroup) {
 	}
 	defer file.Close()
 
-	fileProcessor(ctx, file)
+	fileProcessor(ctx, src, file)
 }
 
-// RunMain performs main application logic
-func RunMain(cmd *cobra.Command, dir string) {
+// checkAssertions evaluates user defined assertions against collected statistics,
+// writes results to the database and returns an error if any of them failed
+func checkAssertions(simulationName, nodeName string) error {
+	if !assertion.Enabled() {
+		return nil
+	}
+
+	snap := stats.TakeSnapshot()
+	results := assertion.Evaluate(snap)
+	points, err := assertion.Points(
+		results,
+		map[string]string{
+			"simulation": simulationName,
+			"testId":     testID,
+			"nodeName":   nodeName,
+		},
+		snap.End,
+	)
+	if err != nil {
+		l.Errorf("Failed to prepare assertion points: %v\n", err)
+	} else {
+		influx.WritePoints(points)
+	}
+
+	return assertion.Report(results)
+}
+
+// RunMain performs main application logic. Returned error wraps assertion.ErrFailed
+// if test results did not pass user defined assertions
+func RunMain(cmd *cobra.Command, dir string) error {
 	testID, _ = cmd.Flags().GetString("test-id")
 	waitTime, _ = cmd.Flags().GetUint("stop-timeout")
 	rand.Seed(time.Now().UnixNano())
@@ -495,7 +751,7 @@ func RunMain(cmd *cobra.Command, dir string) {
 
 	if err := lookupTargetDir(cmd.Context(), abs); err != nil {
 		if err == errStoppedByUser {
-			return
+			return nil
 		}
 		l.Errorf("Target directory lookup failed with error: %v\n", err)
 		os.Exit(1)
@@ -503,7 +759,7 @@ func RunMain(cmd *cobra.Command, dir string) {
 
 	if err := lookupResultsDir(cmd.Context(), abs); err != nil {
 		if err == errStoppedByUser {
-			return
+			return nil
 		}
 		l.Errorf("Error happened while searching for results directory: %v\n", err)
 		os.Exit(1)
@@ -511,7 +767,7 @@ func RunMain(cmd *cobra.Command, dir string) {
 
 	if err := waitForLog(cmd.Context()); err != nil {
 		if err == errStoppedByUser {
-			return
+			return nil
 		}
 		l.Errorf("Failed waiting for %s with error: %v\n", simulationLogFileName, err)
 		os.Exit(1)
@@ -520,10 +776,13 @@ func RunMain(cmd *cobra.Command, dir string) {
 	wg := &sync.WaitGroup{}
 	pCtx, pCancel := context.WithCancel(context.Background())
 	iCtx, iCancel := context.WithCancel(context.Background())
+	aCtx, aCancel := context.WithCancel(context.Background())
 
-	wg.Add(2)
-	go parseStart(pCtx, wg)
+	src := &logSource{nodeName: nodeName}
+	wg.Add(3)
+	go parseStart(pCtx, wg, src)
 	go influx.StartProcessing(iCtx, wg)
+	go alert.Start(aCtx, wg)
 
 FinisherLoop:
 	for {
@@ -533,6 +792,7 @@ FinisherLoop:
 			pCancel()
 		// Then wait for parser to stop and stop client processing
 		case <-parserStopped:
+			aCancel()
 			iCancel()
 			// In case parser finished processing on its own, we cancel its context
 			pCancel()
@@ -540,4 +800,17 @@ FinisherLoop:
 		}
 	}
 	wg.Wait()
+
+	return finish(src.simulationName, src.nodeName)
+}
+
+// finish is called after all points are processed, it checks assertions and closes
+// database connection
+func finish(simulationName, nodeName string) error {
+	assertErr := checkAssertions(simulationName, nodeName)
+	if err := influx.CloseDBConnection(); err != nil {
+		l.Errorf("Failed to close DB connection: %v", err)
+	}
+
+	return assertErr
 }
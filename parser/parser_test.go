@@ -0,0 +1,462 @@
+/*
+Copyright © 2020 Anton Kramarev
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+package parser
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dakaraj/gatling-to-influxdb/flags"
+	"github.com/dakaraj/gatling-to-influxdb/generator"
+	"github.com/dakaraj/gatling-to-influxdb/influx"
+	"github.com/dakaraj/gatling-to-influxdb/influx/influxtest"
+	l "github.com/dakaraj/gatling-to-influxdb/logger"
+	infc "github.com/influxdata/influxdb1-client/v2"
+	"github.com/spf13/cobra"
+)
+
+// testServer is a fake InfluxDB all tests of the package write to
+var testServer *influxtest.Server
+
+// connected is set once a test connected to testServer, so the connection is closed before a new one
+var connected bool
+
+func TestMain(m *testing.M) {
+	testServer = influxtest.NewServer("gatling")
+	code := m.Run()
+	testServer.Close()
+	os.Exit(code)
+}
+
+// newTestCommand returns a command with flags of the application parsed from args.
+// Points are written to testServer by a single worker unless args set otherwise
+func newTestCommand(tb testing.TB, args ...string) *cobra.Command {
+	cmd := &cobra.Command{Use: "test"}
+	flags.AddConnection(cmd.Flags())
+	flags.AddProcessing(cmd.Flags())
+	flags.AddImport(cmd.Flags())
+	defaults := []string{"--address", testServer.URL, "--test-id", "test", "--workers", "1"}
+	if err := cmd.ParseFlags(append(defaults, args...)); err != nil {
+		tb.Fatalf("Failed to parse flags: %v", err)
+	}
+
+	return cmd
+}
+
+// setUp applies processing settings parsed from args and connects to testServer.
+// State collected by previous tests is discarded
+func setUp(tb testing.TB, args ...string) {
+	cmd := newTestCommand(tb, args...)
+	for _, init := range []func(*cobra.Command) error{InitSampling, InitNormalization, InitErrorClasses, InitWorkers, influx.InitProcessing} {
+		if err := init(cmd); err != nil {
+			tb.Fatal(err)
+		}
+	}
+	InitGroups(cmd)
+	if connected {
+		influx.CloseDBConnection()
+	}
+	if err := influx.InitInfluxConnection(cmd); err != nil {
+		tb.Fatalf("Failed to connect: %v", err)
+	}
+	connected = true
+	testID, _ = cmd.Flags().GetString("test-id")
+	nodeName = "node1"
+	resetState()
+}
+
+// captureLog makes logger write to a temporary file as well. Returned functions read
+// everything logged so far and remove the file
+func captureLog(tb testing.TB) (func() string, func()) {
+	dir, err := ioutil.TempDir("", "g2i-log")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	logFile := filepath.Join(dir, "g2i.log")
+	if err := l.InitLogger(logFile); err != nil {
+		tb.Fatal(err)
+	}
+
+	read := func() string {
+		b, err := ioutil.ReadFile(logFile)
+		if err != nil {
+			tb.Fatal(err)
+		}
+		return string(b)
+	}
+
+	return read, func() { os.RemoveAll(dir) }
+}
+
+// testConfig returns a configuration of a generated log with a fixed start time
+func testConfig(users, iterations int) generator.Config {
+	cfg := generator.DefaultConfig()
+	cfg.Users = users
+	cfg.SetIterations(iterations)
+	cfg.Start = time.Unix(1790000000, 0)
+
+	return cfg
+}
+
+// generateLog writes a synthetic log described by the configuration
+func generateLog(tb testing.TB, cfg generator.Config) ([]byte, generator.Result) {
+	var buf bytes.Buffer
+	res, err := generator.Write(context.Background(), &buf, cfg)
+	if err != nil {
+		tb.Fatalf("Failed to generate log: %v", err)
+	}
+
+	return buf.Bytes(), res
+}
+
+// shopConfig describes a log with several scenarios, nested groups, randomly picked
+// requests, failures and ERROR lines
+func shopConfig(users int) generator.Config {
+	ms := func(n int) generator.Duration {
+		return generator.Duration{Duration: time.Duration(n) * time.Millisecond}
+	}
+	cfg := testConfig(users, 1)
+	cfg.Simulation = "shop.ShopSimulation"
+	cfg.Ramp = generator.Ramp{Profile: generator.RampRandom, Duration: generator.Duration{Duration: 20 * time.Second}}
+	cfg.Scenarios = []generator.Scenario{
+		{
+			Name:                 "Browse",
+			Weight:               3,
+			Iterations:           3,
+			RequestsPerIteration: 4,
+			Requests: []generator.Request{
+				{Name: "Home", Weight: 5, MinResponseTime: ms(10), MaxResponseTime: ms(50), KORate: 0.1},
+				{Name: "Item", MinResponseTime: ms(20), MaxResponseTime: ms(80), KORate: 0.3, ErrorMessages: []string{"404 Not Found"}},
+			},
+			Groups: []string{"Visit", "Catalog", "Page"},
+			Pause:  ms(500),
+		},
+		{
+			Name:       "Buy",
+			Weight:     1,
+			Iterations: 2,
+			Requests: []generator.Request{
+				{Name: "Cart", MinResponseTime: ms(10), MaxResponseTime: ms(100), KORate: 0.2},
+				{Name: "Pay", MinResponseTime: ms(100), MaxResponseTime: ms(300), KORate: 0.2},
+			},
+			Pause: ms(1000),
+		},
+	}
+	cfg.ErrorLineRate = 0.5
+
+	return cfg
+}
+
+// userEvent is a USER line passed to users consumer
+type userEvent struct {
+	timestamp time.Time
+	nodeName  string
+	scenario  string
+	status    string
+}
+
+// collector keeps points and user events instead of passing them to InfluxDB consumers
+type collector struct {
+	mu     sync.Mutex
+	points []*infc.Point
+	users  []userEvent
+}
+
+// collect replaces sending of points and user events, returned function restores it
+func collect() (*collector, func()) {
+	c := &collector{}
+	sendPoint = func(p *infc.Point) {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		c.points = append(c.points, p)
+	}
+	sendUserLine = func(timestamp time.Time, nodeName, scenario, status string) {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		c.users = append(c.users, userEvent{timestamp, nodeName, scenario, status})
+	}
+
+	return c, func() {
+		sendPoint = influx.SendPoint
+		sendUserLine = influx.SendUserLineData
+	}
+}
+
+// byMeasurement groups collected points by measurement
+func (c *collector) byMeasurement() map[string][]*infc.Point {
+	m := make(map[string][]*infc.Point)
+	for _, p := range c.points {
+		m[p.Name()] = append(m[p.Name()], p)
+	}
+
+	return m
+}
+
+// applyLog parses, applies and builds points of every line of the log one after another
+func applyLog(t *testing.T, data []byte) {
+	src := &logSource{nodeName: nodeName}
+	var r record
+	var b pointBuilder
+	for _, lb := range bytes.SplitAfter(data, []byte("\n")) {
+		if len(lb) == 0 {
+			continue
+		}
+		if err := src.parseRecord(lb, &r); err != nil {
+			t.Fatalf("Failed to parse %q: %v", lb, err)
+		}
+		if err := src.applyRecord(&r); err != nil {
+			t.Fatalf("Failed to apply %q: %v", lb, err)
+		}
+		if err := src.buildPoint(&r, &b); err != nil {
+			t.Fatalf("Failed to build point of %q: %v", lb, err)
+		}
+	}
+	reportOpenSessions()
+	finishErrorClasses()
+}
+
+func TestGeneratedLogRoundTrip(t *testing.T) {
+	setUp(t)
+	c, restore := collect()
+	defer restore()
+
+	cfg := shopConfig(40)
+	data, res := generateLog(t, cfg)
+	applyLog(t, data)
+
+	points := c.byMeasurement()
+	for measurement, expected := range map[string]int{
+		"tests":    1,
+		"requests": res.Requests,
+		"groups":   res.Groups,
+		"errors":   res.Errors,
+		"sessions": res.Users,
+	} {
+		if n := len(points[measurement]); n != expected {
+			t.Errorf("Expected %d %s points, got %d", expected, measurement, n)
+		}
+	}
+	if len(points["errorClasses"]) == 0 {
+		t.Error("Expected errorClasses points")
+	}
+	if res.Errors == 0 || res.Groups == 0 {
+		t.Fatalf("Generated log has no errors or groups: %+v", res)
+	}
+
+	statuses := make(map[string]int)
+	for _, u := range c.users {
+		statuses[u.status]++
+		if u.nodeName != "node1" || (u.scenario != "Browse" && u.scenario != "Buy") {
+			t.Errorf("Unexpected user event %+v", u)
+		}
+	}
+	if statuses["START"] != res.Users || statuses["END"] != res.Users {
+		t.Errorf("Expected %d started and finished users, got %v", res.Users, statuses)
+	}
+
+	for _, measurement := range []string{"tests", "requests", "groups", "errors", "sessions", "errorClasses"} {
+		for _, p := range points[measurement] {
+			tags := p.Tags()
+			if tags["testId"] != "test" || tags["nodeName"] != "node1" {
+				t.Errorf("Point %s has testId %q and nodeName %q", p.Name(), tags["testId"], tags["nodeName"])
+			}
+		}
+	}
+
+	failed := bytes.Count(data, []byte("\tKO\t"))
+	ko := 0
+	for _, p := range points["requests"] {
+		tags := p.Tags()
+		fields, _ := p.Fields()
+		if tags["simulation"] != cfg.Simulation {
+			t.Errorf("Request has simulation %q", tags["simulation"])
+		}
+		if tags["result"] == "KO" {
+			ko++
+		}
+		switch tags["name"] {
+		case "Home", "Item":
+			if tags["groupPath"] != "Visit/Catalog/Page" || tags["group_l1"] != "Visit" || tags["group_l3"] != "Page" {
+				t.Errorf("Request %s has group tags %v", tags["name"], tags)
+			}
+		case "Cart", "Pay":
+			if _, found := tags["groupPath"]; found {
+				t.Errorf("Request %s outside of groups has groupPath %q", tags["name"], tags["groupPath"])
+			}
+		default:
+			t.Errorf("Unexpected request name %q", tags["name"])
+		}
+		if id, _ := fields["userId"].(int64); id < 1 || id > int64(cfg.Users) {
+			t.Errorf("Request has userId %v", fields["userId"])
+		}
+		if w, _ := fields["weight"].(float64); w != 1 {
+			t.Errorf("Request written without sampling has weight %v", fields["weight"])
+		}
+	}
+	if ko != failed {
+		t.Errorf("Expected %d failed requests, got %d", failed, ko)
+	}
+
+	for _, p := range points["groups"] {
+		tags := p.Tags()
+		fields, _ := p.Fields()
+		depth, _ := fields["depth"].(int64)
+		koCount, _ := fields["koCount"].(int64)
+		switch tags["groupPath"] {
+		case "Visit":
+			if _, found := tags["parent"]; found || depth != 1 {
+				t.Errorf("Top level group has parent %q and depth %d", tags["parent"], depth)
+			}
+		case "Visit/Catalog/Page":
+			if tags["parent"] != "Visit/Catalog" || depth != 3 {
+				t.Errorf("Innermost group has parent %q and depth %d", tags["parent"], depth)
+			}
+		}
+		if (koCount > 0) != (tags["result"] == "KO") {
+			t.Errorf("Group %s with result %s has koCount %d", tags["groupPath"], tags["result"], koCount)
+		}
+	}
+}
+
+func TestInitSamplingValidatesPercentage(t *testing.T) {
+	tests := map[string]bool{
+		"100": true,
+		"1":   true,
+		"0.5": false,
+		"0":   false,
+		"-5":  false,
+		"101": false,
+	}
+	defer func(v float64) { sampleOK = v }(sampleOK)
+	for value, valid := range tests {
+		err := InitSampling(newTestCommand(t, "--sample-ok", value))
+		if (err == nil) != valid {
+			t.Errorf("Expected sample-ok %s to be valid %v, got error %v", value, valid, err)
+		}
+	}
+}
+
+func TestSampledRequestsWeights(t *testing.T) {
+	setUp(t, "--sample-ok", "25", "--sample-slower-than", "150")
+	c, restore := collect()
+	defer restore()
+
+	data, res := generateLog(t, shopConfig(40))
+	applyLog(t, data)
+
+	requests := c.byMeasurement()["requests"]
+	if len(requests) >= res.Requests {
+		t.Fatalf("Expected some of %d requests to be sampled out, got %d points", res.Requests, len(requests))
+	}
+	var weights float64
+	ko := 0
+	for _, p := range requests {
+		tags := p.Tags()
+		fields, _ := p.Fields()
+		w, _ := fields["weight"].(float64)
+		duration, _ := fields["duration"].(int64)
+		weights += w
+		switch {
+		case tags["result"] == "KO":
+			ko++
+			if w != 1 {
+				t.Errorf("KO request has weight %v", w)
+			}
+		case duration >= 150:
+			if w != 1 {
+				t.Errorf("Slow request of %d ms has weight %v", duration, w)
+			}
+		case w != 4:
+			t.Errorf("Sampled OK request of %d ms has weight %v", duration, w)
+		}
+	}
+	if failed := bytes.Count(data, []byte("\tKO\t")); ko != failed {
+		t.Errorf("Expected all %d failed requests to be written, got %d", failed, ko)
+	}
+	// Sum of weights estimates amount of requests
+	if d := math.Abs(weights-float64(res.Requests)) / float64(res.Requests); d > 0.2 {
+		t.Errorf("Sum of weights %.0f is too far from %d requests", weights, res.Requests)
+	}
+}
+
+func TestErrorClassesPerNode(t *testing.T) {
+	setUp(t)
+	c, restore := collect()
+	defer restore()
+
+	ts := time.Unix(1790000000, 0)
+	for _, node := range []string{"a", "b", "a"} {
+		src := &logSource{nodeName: node, simulationName: "shop"}
+		src.countErrorClass(fingerprint("timeout after 100 ms"), sourceRequest, ts)
+	}
+	finishErrorClasses()
+
+	counts := make(map[string]int64)
+	for _, p := range c.byMeasurement()["errorClasses"] {
+		fields, _ := p.Fields()
+		count, _ := fields["count"].(int64)
+		counts[p.Tags()["nodeName"]] += count
+		if !p.Time().Equal(ts) || p.Tags()["errorClass"] != "timeout after <n> ms" {
+			t.Errorf("Unexpected error class point %s", p)
+		}
+	}
+	if len(counts) != 2 || counts["a"] != 2 || counts["b"] != 1 {
+		t.Errorf("Expected error class counts of both nodes, got %v", counts)
+	}
+}
+
+func TestParseGroupStatus(t *testing.T) {
+	tests := []struct {
+		name    string
+		fields  [][]byte
+		status  string
+		message string
+		wantErr bool
+	}{
+		{name: "OK", fields: [][]byte{[]byte("OK\n")}, status: "OK"},
+		{name: "KO", fields: [][]byte{[]byte("KO")}, status: "KO"},
+		{name: "message after space", fields: [][]byte{[]byte("KO Check failed \n")}, status: "KO", message: "Check failed"},
+		{name: "message in next value", fields: [][]byte{[]byte("KO"), []byte("Check failed\n")}, status: "KO", message: "Check failed"},
+		{name: "truncated status", fields: [][]byte{[]byte("K")}, wantErr: true},
+		{name: "empty status", fields: [][]byte{[]byte("\n")}, wantErr: true},
+		{name: "unknown status", fields: [][]byte{[]byte("OKAY")}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status, message, err := parseGroupStatus(tt.fields)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Expected error %v, got %v", tt.wantErr, err)
+			}
+			if status != tt.status || message != tt.message {
+				t.Errorf("Expected status %q and message %q, got %q and %q", tt.status, tt.message, status, message)
+			}
+		})
+	}
+}
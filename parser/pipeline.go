@@ -0,0 +1,204 @@
+/*
+Copyright © 2020 Anton Kramarev
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+package parser
+
+import (
+	"context"
+	"errors"
+	"runtime"
+	"sync"
+	"sync/atomic"
+
+	l "github.com/dakaraj/gatling-to-influxdb/logger"
+	"github.com/spf13/cobra"
+)
+
+// chunkLines is amount of lines handed to a worker at once
+const chunkLines = 512
+
+// parseWorkers is amount of goroutines parsing lines and building points of complete logs
+var parseWorkers = 1
+
+// InitWorkers reads amount of workers used to process complete logs. Zero means
+// a worker per CPU available to the application
+func InitWorkers(cmd *cobra.Command) error {
+	workers, _ := cmd.Flags().GetInt("workers")
+	if workers < 0 {
+		return errors.New("Amount of workers must not be negative")
+	}
+	if workers == 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	parseWorkers = workers
+
+	return nil
+}
+
+// chunk is a sequence of lines copied from logs together with their records
+type chunk struct {
+	buf     []byte
+	ends    []int
+	sources []*logSource
+	records []record
+	// parsed receives a value once all records of the chunk are parsed
+	parsed chan struct{}
+}
+
+var chunks = sync.Pool{
+	New: func() interface{} {
+		return &chunk{
+			ends:    make([]int, 0, chunkLines),
+			sources: make([]*logSource, 0, chunkLines),
+			records: make([]record, chunkLines),
+			parsed:  make(chan struct{}, 1),
+		}
+	},
+}
+
+func (c *chunk) reset() {
+	c.buf = c.buf[:0]
+	c.ends = c.ends[:0]
+	c.sources = c.sources[:0]
+}
+
+// add copies a line to the chunk, so reading buffers can be reused for next lines
+func (c *chunk) add(lb []byte, src *logSource) {
+	c.buf = append(c.buf, lb...)
+	c.ends = append(c.ends, len(c.buf))
+	c.sources = append(c.sources, src)
+}
+
+func (c *chunk) line(i int) []byte {
+	start := 0
+	if i > 0 {
+		start = c.ends[i-1]
+	}
+
+	return c.buf[start:c.ends[i]]
+}
+
+// stop makes source lines to be skipped after an error that can't be handled
+func (s *logSource) stop() {
+	atomic.StoreInt32(&s.stopped, 1)
+}
+
+func (s *logSource) isStopped() bool {
+	return atomic.LoadInt32(&s.stopped) == 1
+}
+
+// reportError logs a line processing error and stops the source if the error is fatal
+func (s *logSource) reportError(err error) {
+	l.Errorf("String processing failed on node %s: %v", s.nodeName, err)
+	if errors.Is(err, errFatal) {
+		l.Errorf("Processing of node %s stopped because of an error that can't be handled\n", s.nodeName)
+		s.stop()
+	}
+}
+
+// runPipeline processes lines returned by next until it returns nil and returns amount
+// of processed lines. Lines are read by a single goroutine, chunks of them are parsed and
+// turned into points by workers, while parsed records are applied to parser state by
+// a single goroutine in log order, so users activity and sessions are kept consistent
+func runPipeline(ctx context.Context, workers int, next func() ([]byte, *logSource)) int {
+	parseQueue := make(chan *chunk, workers*2)
+	buildQueue := make(chan *chunk, workers*2)
+	// ordered keeps chunks in the order they were read in
+	ordered := make(chan *chunk, workers*4)
+
+	go func() {
+		defer close(ordered)
+		defer close(parseQueue)
+		for ctx.Err() == nil {
+			c := chunks.Get().(*chunk)
+			c.reset()
+			for len(c.ends) < chunkLines {
+				lb, src := next()
+				if lb == nil {
+					break
+				}
+				c.add(lb, src)
+			}
+			if len(c.ends) == 0 {
+				chunks.Put(c)
+				return
+			}
+			parseQueue <- c
+			ordered <- c
+		}
+	}()
+
+	for i := 0; i < workers; i++ {
+		go func() {
+			for c := range parseQueue {
+				for j, src := range c.sources {
+					r := &c.records[j]
+					r.err = src.parseRecord(c.line(j), r)
+				}
+				c.parsed <- struct{}{}
+			}
+		}()
+	}
+
+	bwg := &sync.WaitGroup{}
+	bwg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer bwg.Done()
+			var b pointBuilder
+			for c := range buildQueue {
+				for j, src := range c.sources {
+					if err := src.buildPoint(&c.records[j], &b); err != nil {
+						l.Errorf("String processing failed on node %s: %v", src.nodeName, err)
+					}
+				}
+				chunks.Put(c)
+			}
+		}()
+	}
+
+	var processed int
+	for c := range ordered {
+		<-c.parsed
+		for j, src := range c.sources {
+			r := &c.records[j]
+			if src.isStopped() {
+				r.point = false
+				continue
+			}
+			err := r.err
+			if err == nil {
+				err = src.applyRecord(r)
+			}
+			if err = src.wrapFatal(r, err); err != nil {
+				r.point = false
+				src.reportError(err)
+			}
+			processed++
+		}
+		buildQueue <- c
+	}
+	close(buildQueue)
+	bwg.Wait()
+
+	return processed
+}
@@ -0,0 +1,190 @@
+/*
+Copyright © 2020 Anton Kramarev
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+package parser
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"sort"
+	"testing"
+	"time"
+)
+
+// result is everything sent to InfluxDB consumers while a log is processed. Points are
+// built by several workers, so they are sorted, while user events must keep log order.
+// Timestamps are truncated to milliseconds, as random nanoseconds are added when parsed
+type result struct {
+	users  []userEvent
+	points []string
+}
+
+func (c *collector) result() result {
+	users := make([]userEvent, len(c.users))
+	for i, u := range c.users {
+		u.timestamp = u.timestamp.Truncate(time.Millisecond)
+		users[i] = u
+	}
+	points := make([]string, len(c.points))
+	for i, p := range c.points {
+		fields, _ := p.Fields()
+		points[i] = fmt.Sprintf("%s %v %v %d", p.Name(), p.Tags(), fields, p.Time().UnixNano()/int64(time.Millisecond))
+	}
+	sort.Strings(points)
+
+	return result{users, points}
+}
+
+// lineReader returns lines of a log one by one as pipeline reads them
+func lineReader(data []byte, src *logSource) func() ([]byte, *logSource) {
+	lines := bytes.SplitAfter(data, []byte("\n"))
+	return func() ([]byte, *logSource) {
+		for len(lines) > 0 {
+			lb := lines[0]
+			lines = lines[1:]
+			if len(lb) > 0 {
+				return lb, src
+			}
+		}
+		return nil, nil
+	}
+}
+
+// sequentialResult processes the log line by line, which is a reference for the pipeline
+func sequentialResult(t *testing.T, data []byte) result {
+	setUp(t)
+	c, restore := collect()
+	defer restore()
+	applyLog(t, data)
+
+	return c.result()
+}
+
+func pipelineResult(t *testing.T, workers int, next func() ([]byte, *logSource)) (result, int) {
+	c, restore := collect()
+	defer restore()
+	processed := runPipeline(context.Background(), workers, next)
+	reportOpenSessions()
+	finishErrorClasses()
+
+	return c.result(), processed
+}
+
+// useCPUs lets workers actually run in parallel and returns a function restoring the setting
+func useCPUs(n int) func() {
+	prev := runtime.GOMAXPROCS(n)
+	return func() { runtime.GOMAXPROCS(prev) }
+}
+
+func compareResults(t *testing.T, workers int, want, got result) {
+	if len(got.users) != len(want.users) {
+		t.Fatalf("%d workers applied %d user events, expected %d", workers, len(got.users), len(want.users))
+	}
+	for i := range want.users {
+		if got.users[i] != want.users[i] {
+			t.Fatalf("%d workers applied user event %d out of order: got %+v, expected %+v", workers, i, got.users[i], want.users[i])
+		}
+	}
+	if !reflect.DeepEqual(got.points, want.points) {
+		t.Errorf("%d workers built %d points different from %d points of sequential processing", workers, len(got.points), len(want.points))
+	}
+}
+
+func TestPipelineKeepsLogOrder(t *testing.T) {
+	defer useCPUs(4)()
+	data, res := generateLog(t, shopConfig(150))
+	if res.Lines < 4*chunkLines {
+		t.Fatalf("Generated log of %d lines is too short to be split into several chunks", res.Lines)
+	}
+	want := sequentialResult(t, data)
+	if len(want.users) != 2*res.Users {
+		t.Fatalf("Expected %d user events, got %d", 2*res.Users, len(want.users))
+	}
+
+	for _, workers := range []int{1, 4} {
+		setUp(t)
+		got, processed := pipelineResult(t, workers, lineReader(data, &logSource{nodeName: nodeName}))
+		if processed != res.Lines {
+			t.Errorf("%d workers processed %d lines, expected %d", workers, processed, res.Lines)
+		}
+		compareResults(t, workers, want, got)
+	}
+}
+
+func TestPipelineKeepsOrderOfMergedLogs(t *testing.T) {
+	defer useCPUs(4)()
+	dir, err := ioutil.TempDir("", "g2i-pipeline")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	var logs []string
+	for i, name := range []string{"a.log", "b.log"} {
+		cfg := shopConfig(80)
+		cfg.Seed = int64(i + 1)
+		data, _ := generateLog(t, cfg)
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		logs = append(logs, path)
+	}
+
+	var results []result
+	for _, workers := range []int{1, 4} {
+		setUp(t)
+		sources, err := openSources(logs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		next := mergedLines(sources)
+		got, _ := pipelineResult(t, workers, func() ([]byte, *logSource) {
+			lb, s := next()
+			if lb == nil {
+				return nil, nil
+			}
+			return lb, &s.logSource
+		})
+		closeSources(sources)
+		results = append(results, got)
+	}
+
+	nodes := make(map[string]int)
+	for _, u := range results[0].users {
+		nodes[u.nodeName]++
+	}
+	if len(nodes) != 2 || nodes["a"] == 0 || nodes["b"] == 0 {
+		t.Fatalf("Expected user events of nodes a and b, got %v", nodes)
+	}
+	for i := 1; i < len(results[0].users); i++ {
+		if results[0].users[i].timestamp.Before(results[0].users[i-1].timestamp) {
+			t.Fatalf("User event %d of merged logs is older than the previous one", i)
+		}
+	}
+	compareResults(t, 4, results[0], results[1])
+}
@@ -0,0 +1,87 @@
+/*
+Copyright © 2020 Anton Kramarev
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+package parser
+
+import (
+	"fmt"
+	"math/rand"
+
+	l "github.com/dakaraj/gatling-to-influxdb/logger"
+	"github.com/spf13/cobra"
+)
+
+var (
+	// sampleOK is a percentage of OK requests written to the database
+	sampleOK float64 = 100
+	// sampleSlowerThan is a duration (ms) starting from which OK requests are always written
+	sampleSlowerThan int
+
+	sampledOut   int
+	sampledTotal int
+)
+
+// InitSampling reads settings of raw request points sampling. Sampling only affects
+// points written to the database, while assertions, alerts and sessions get all requests
+func InitSampling(cmd *cobra.Command) error {
+	sampleOK, _ = cmd.Flags().GetFloat64("sample-ok")
+	threshold, _ := cmd.Flags().GetUint("sample-slower-than")
+	// Without any sampled OK requests their weights can't stand for the skipped ones
+	if sampleOK < 1 || sampleOK > 100 {
+		return fmt.Errorf("Percentage of sampled OK requests must be between 1 and 100, got %v", sampleOK)
+	}
+	sampleSlowerThan = int(threshold)
+
+	return nil
+}
+
+// requestWeight decides if a request point is written to the database and returns its weight,
+// which is an amount of requests the point stands for, or 0 if the point is skipped.
+// KO and slow requests are always kept with weight of 1, so counts and error rates
+// are calculated as a sum of weights stay correct with sampling
+func requestWeight(duration int, ok bool) float64 {
+	sampledTotal++
+	if !ok || sampleOK >= 100 {
+		return 1
+	}
+	if sampleSlowerThan > 0 && duration >= sampleSlowerThan {
+		return 1
+	}
+	if rand.Float64()*100 < sampleOK {
+		return 100 / sampleOK
+	}
+	sampledOut++
+
+	return 0
+}
+
+// reportSampling logs amount of request points skipped by sampling
+func reportSampling() {
+	if sampledOut > 0 {
+		l.Infof("%d of %d request points were not written because of sampling\n", sampledOut, sampledTotal)
+	}
+}
+
+func resetSampling() {
+	sampledOut = 0
+	sampledTotal = 0
+}
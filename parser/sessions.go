@@ -0,0 +1,142 @@
+/*
+Copyright © 2020 Anton Kramarev
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+package parser
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/dakaraj/gatling-to-influxdb/influx"
+	l "github.com/dakaraj/gatling-to-influxdb/logger"
+)
+
+// session contains activity of a single virtual user between its START and END
+type session struct {
+	scenario string
+	requests int
+	ko       int
+	groups   map[string]struct{}
+	// groupKO counts KO requests inside groups that are not finished yet by group hierarchy
+	groupKO map[string]int
+}
+
+// sessionKey identifies a user. Gatling user IDs are unique within a run, so REQUEST
+// and GROUP lines can be attributed to a session by ID and load generator only
+type sessionKey struct {
+	nodeName string
+	userID   int64
+}
+
+// sessions keeps all users that are currently active
+var sessions = make(map[sessionKey]*session)
+
+func (src *logSource) getSession(userID int64) *session {
+	key := sessionKey{src.nodeName, userID}
+	s, found := sessions[key]
+	if !found {
+		s = &session{groups: make(map[string]struct{}), groupKO: make(map[string]int)}
+		sessions[key] = s
+	}
+
+	return s
+}
+
+func (src *logSource) sessionStart(userID int64, scenario string) {
+	src.getSession(userID).scenario = scenario
+}
+
+func (src *logSource) sessionRequest(userID int64, ok bool, groups string) {
+	s := src.getSession(userID)
+	s.requests++
+	if ok {
+		return
+	}
+	s.ko++
+	// A failed request fails all groups it is nested in
+	for i := 0; i < len(groups); i++ {
+		if groups[i] == ',' {
+			s.groupKO[groups[:i]]++
+		}
+	}
+	if groups != "" {
+		s.groupKO[groups]++
+	}
+}
+
+// sessionGroup registers a finished group and returns amount of KO requests inside it
+func (src *logSource) sessionGroup(userID int64, name string) int {
+	s := src.getSession(userID)
+	s.groups[name] = struct{}{}
+	ko := s.groupKO[name]
+	delete(s.groupKO, name)
+
+	return ko
+}
+
+// sessionEnd sends a point with a summary of finished user session.
+// Duration is taken from END line which contains both user start and end times
+func (src *logSource) sessionEnd(userID int64, scenario string, duration int64, timestamp time.Time) error {
+	s := src.getSession(userID)
+	delete(sessions, sessionKey{src.nodeName, userID})
+
+	groups := make([]string, 0, len(s.groups))
+	for g := range s.groups {
+		groups = append(groups, g)
+	}
+	sort.Strings(groups)
+
+	point, err := influx.NewPoint(
+		"sessions",
+		map[string]string{
+			"scenario":   scenario,
+			"simulation": src.simulationName,
+			"testId":     testID,
+			"nodeName":   src.nodeName,
+		},
+		map[string]interface{}{
+			"userId":     int(userID),
+			"duration":   int(duration),
+			"requests":   s.requests,
+			"koCount":    s.ko,
+			"groups":     len(groups),
+			"groupNames": strings.Join(groups, "|"),
+		},
+		timestamp,
+	)
+	if err != nil {
+		return fmt.Errorf("Error creating new point with session data: %w", err)
+	}
+
+	sendPoint(point)
+
+	return nil
+}
+
+// reportOpenSessions logs amount of users that did not finish before parsing stopped
+func reportOpenSessions() {
+	if len(sessions) > 0 {
+		l.Infof("%d user sessions were not finished when parsing stopped\n", len(sessions))
+	}
+}
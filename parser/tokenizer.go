@@ -0,0 +1,168 @@
+/*
+Copyright © 2020 Anton Kramarev
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+package parser
+
+import (
+	"bytes"
+	"strconv"
+)
+
+// maxInterned limits amount of distinct strings kept by a source for reuse
+const maxInterned = 10000
+
+// lineType is a kind of log line defined by its first field
+type lineType int
+
+const (
+	unknownLine lineType = iota
+	runLine
+	requestLine
+	groupLine
+	userLine
+	errorLine
+)
+
+var (
+	runPrefix     = []byte("RUN")
+	requestPrefix = []byte("REQUEST")
+	groupPrefix   = []byte("GROUP")
+	userPrefix    = []byte("USER")
+	errorPrefix   = []byte("ERROR")
+)
+
+func (t lineType) String() string {
+	switch t {
+	case runLine:
+		return "test start"
+	case requestLine:
+		return "request"
+	case groupLine:
+		return "group"
+	case userLine:
+		return "user"
+	case errorLine:
+		return "error"
+	}
+
+	return "unknown"
+}
+
+// lineKind returns a type of the line by comparing its first field with known ones
+func lineKind(lb []byte) lineType {
+	i := bytes.IndexByte(lb, '\t')
+	if i < 0 {
+		return unknownLine
+	}
+	first := lb[:i]
+	switch {
+	case bytes.Equal(first, requestPrefix):
+		return requestLine
+	case bytes.Equal(first, userPrefix):
+		return userLine
+	case bytes.Equal(first, groupPrefix):
+		return groupLine
+	case bytes.Equal(first, errorPrefix):
+		return errorLine
+	case bytes.Equal(first, runPrefix):
+		return runLine
+	}
+
+	return unknownLine
+}
+
+// trimEOL removes a line break from the end of the line
+func trimEOL(lb []byte) []byte {
+	for len(lb) > 0 && (lb[len(lb)-1] == '\n' || lb[len(lb)-1] == '\r') {
+		lb = lb[:len(lb)-1]
+	}
+
+	return lb
+}
+
+// splitFields splits a line into tab separated fields. Fields are appended to dst,
+// so a slice kept between lines is reused and no memory is allocated
+func splitFields(lb []byte, dst [][]byte) [][]byte {
+	lb = trimEOL(lb)
+	dst = dst[:0]
+	for {
+		i := bytes.IndexByte(lb, '\t')
+		if i < 0 {
+			return append(dst, lb)
+		}
+		dst = append(dst, lb[:i])
+		lb = lb[i+1:]
+	}
+}
+
+// split splits the line into fields reusing the source buffer. Fields are only
+// valid until the next line is split
+func (s *logSource) split(lb []byte) [][]byte {
+	s.fields = splitFields(lb, s.fields)
+
+	return s.fields
+}
+
+// parseInt parses a decimal integer without converting bytes to a string. Values
+// it can't handle are passed to strconv, so errors are reported the same way
+func parseInt(b []byte) (int64, error) {
+	// 18 digits always fit into int64
+	if len(b) == 0 || len(b) > 18 {
+		return strconv.ParseInt(string(b), 10, 64)
+	}
+	digits := b
+	if b[0] == '-' {
+		digits = b[1:]
+	}
+	var n int64
+	for _, c := range digits {
+		if c < '0' || c > '9' {
+			return strconv.ParseInt(string(b), 10, 64)
+		}
+		n = n*10 + int64(c-'0')
+	}
+	if len(digits) == 0 {
+		return strconv.ParseInt(string(b), 10, 64)
+	}
+	if b[0] == '-' {
+		n = -n
+	}
+
+	return n, nil
+}
+
+// intern returns a string equal to the bytes, strings seen before are reused
+// instead of being allocated for every line
+func (s *logSource) intern(b []byte) string {
+	if v, found := s.strings[string(b)]; found {
+		return v
+	}
+	v := string(b)
+	if s.strings == nil {
+		s.strings = make(map[string]string)
+	}
+	if len(s.strings) < maxInterned {
+		s.strings[v] = v
+	}
+
+	return v
+}
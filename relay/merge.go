@@ -0,0 +1,343 @@
+/*
+Copyright © 2020 Anton Kramarev
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+package relay
+
+import (
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/dakaraj/gatling-to-influxdb/influx"
+	l "github.com/dakaraj/gatling-to-influxdb/logger"
+	"github.com/dakaraj/gatling-to-influxdb/stats"
+	"github.com/influxdata/influxdb1-client/models"
+	infc "github.com/influxdata/influxdb1-client/v2"
+)
+
+// allScenarios and allRequests are tag values of series combining all scenarios or requests
+const (
+	allScenarios = "allUsers"
+	allRequests  = "allRequests"
+)
+
+// nodeUsers is the latest users snapshot received from a single agent for a single scenario
+type nodeUsers struct {
+	active        int64
+	totalStarted  int64
+	totalFinished int64
+}
+
+// testState keeps everything relay knows about a single test reported by one or more agents
+type testState struct {
+	simulation string
+	// users holds latest snapshots by scenario and node name
+	users map[string]map[string]*nodeUsers
+	// started and finished are amounts of users started and finished by scenario since last flush
+	started    map[string]int64
+	finished   map[string]int64
+	usersTime  time.Time
+	usersDirty bool
+
+	requests map[string]*stats.Summary
+	// requestsFrom and requestsTime are the earliest and the latest request timestamps
+	// since last flush, requestsPrev is the latest one of the previous flush
+	requestsFrom time.Time
+	requestsTime time.Time
+	requestsPrev time.Time
+
+	nodes map[string]bool
+	ended map[string]bool
+}
+
+var (
+	mu    sync.Mutex
+	tests = make(map[string]*testState)
+)
+
+func getTest(testID string) *testState {
+	t, ok := tests[testID]
+	if !ok {
+		t = &testState{
+			users:    make(map[string]map[string]*nodeUsers),
+			started:  make(map[string]int64),
+			finished: make(map[string]int64),
+			requests: make(map[string]*stats.Summary),
+			nodes:    make(map[string]bool),
+			ended:    make(map[string]bool),
+		}
+		tests[testID] = t
+	}
+
+	return t
+}
+
+func intField(fields models.Fields, key string) int64 {
+	switch v := fields[key].(type) {
+	case int64:
+		return v
+	case float64:
+		return int64(v)
+	}
+
+	return 0
+}
+
+// pointWeight returns an amount of requests a point stands for. Weights of sampled
+// points are rounded, points written without sampling or by older agents count once
+func pointWeight(fields models.Fields) uint64 {
+	w, ok := fields["weight"].(float64)
+	if !ok || w < 1 {
+		return 1
+	}
+
+	return uint64(math.Round(w))
+}
+
+// observe registers a point received from an agent in aggregated data
+func observe(p models.Point) {
+	tags := p.Tags()
+	testID := tags.GetString("testId")
+	node := tags.GetString("nodeName")
+	name := string(p.Name())
+
+	switch name {
+	case influx.Measurement("users"):
+		scenario := tags.GetString("scenario")
+		// Series combined by agents themselves are skipped to avoid counting users twice
+		if scenario == allScenarios || node == influx.AllNodes {
+			return
+		}
+		fields, err := p.Fields()
+		if err != nil {
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		t := getTest(testID)
+		t.nodes[node] = true
+		if t.users[scenario] == nil {
+			t.users[scenario] = make(map[string]*nodeUsers)
+		}
+		t.users[scenario][node] = &nodeUsers{
+			active:        intField(fields, "active"),
+			totalStarted:  intField(fields, "totalStarted"),
+			totalFinished: intField(fields, "totalFinished"),
+		}
+		t.started[scenario] += intField(fields, "started")
+		t.finished[scenario] += intField(fields, "finished")
+		if p.Time().After(t.usersTime) {
+			t.usersTime = p.Time()
+		}
+		t.usersDirty = true
+	case influx.Measurement("requests"):
+		fields, err := p.Fields()
+		if err != nil {
+			return
+		}
+		duration := int(intField(fields, "duration"))
+		ok := tags.GetString("result") == "OK"
+		weight := pointWeight(fields)
+		mu.Lock()
+		defer mu.Unlock()
+		t := getTest(testID)
+		t.nodes[node] = true
+		t.simulation = tags.GetString("simulation")
+		for _, n := range []string{tags.GetString("name"), allRequests} {
+			s, exists := t.requests[n]
+			if !exists {
+				s = stats.NewSummary()
+				t.requests[n] = s
+			}
+			s.AddN(duration, ok, weight)
+		}
+		if p.Time().After(t.requestsTime) {
+			t.requestsTime = p.Time()
+		}
+		if t.requestsFrom.IsZero() || p.Time().Before(t.requestsFrom) {
+			t.requestsFrom = p.Time()
+		}
+	case influx.Measurement("tests"):
+		mu.Lock()
+		defer mu.Unlock()
+		t := getTest(testID)
+		t.nodes[node] = true
+		if tags.GetString("action") == "end" {
+			t.ended[node] = true
+		}
+	}
+}
+
+// usersPoints returns users series combining all agents. Nothing is returned while
+// only a single agent reports the test, because its own series already describe it
+func (t *testState) usersPoints(testID string) []*infc.Point {
+	if !t.usersDirty || len(t.nodes) < 2 {
+		return nil
+	}
+
+	scenarios := make([]string, 0, len(t.users))
+	for s := range t.users {
+		scenarios = append(scenarios, s)
+	}
+	sort.Strings(scenarios)
+
+	var total map[string]interface{}
+	points := make([]*infc.Point, 0, len(scenarios)+1)
+	for _, s := range append(scenarios, allScenarios) {
+		var fields map[string]interface{}
+		if s == allScenarios {
+			fields = total
+		} else {
+			var sum nodeUsers
+			for _, n := range t.users[s] {
+				sum.active += n.active
+				sum.totalStarted += n.totalStarted
+				sum.totalFinished += n.totalFinished
+			}
+			fields = map[string]interface{}{
+				"active":        sum.active,
+				"started":       t.started[s],
+				"finished":      t.finished[s],
+				"totalStarted":  sum.totalStarted,
+				"totalFinished": sum.totalFinished,
+			}
+			if total == nil {
+				total = make(map[string]interface{}, len(fields))
+				for k := range fields {
+					total[k] = int64(0)
+				}
+			}
+			for k, v := range fields {
+				total[k] = total[k].(int64) + v.(int64)
+			}
+		}
+		if fields == nil {
+			continue
+		}
+		p, err := influx.NewPoint(
+			"users",
+			map[string]string{
+				"testId":   testID,
+				"nodeName": influx.AllNodes,
+				"scenario": s,
+			},
+			fields,
+			t.usersTime,
+		)
+		if err != nil {
+			l.Errorf("Error creating new point with merged users data: %v\n", err)
+			continue
+		}
+		points = append(points, p)
+	}
+
+	t.started = make(map[string]int64)
+	t.finished = make(map[string]int64)
+	t.usersDirty = false
+
+	return points
+}
+
+// requestsSpan returns event time span of requests received since last flush. It continues
+// the span of the previous flush, unless late points of lagging agents are older
+func (t *testState) requestsSpan() time.Duration {
+	from := t.requestsFrom
+	if !t.requestsPrev.IsZero() && t.requestsPrev.Before(from) {
+		from = t.requestsPrev
+	}
+	span := t.requestsTime.Sub(from)
+	// Too short spans, e.g. of a single point, would give unreasonable throughput
+	if span < time.Second {
+		span = time.Second
+	}
+
+	return span
+}
+
+// aggregatesPoints returns statistics of requests received from all agents since last flush.
+// Throughput is calculated over event time span of requests rather than flush interval,
+// so it is not distorted when agents send points in batches or lag behind
+func (t *testState) aggregatesPoints(testID string) []*infc.Point {
+	if len(t.requests) == 0 {
+		return nil
+	}
+	span := t.requestsSpan()
+	points := make([]*infc.Point, 0, len(t.requests))
+	for name, s := range t.requests {
+		p, err := influx.NewPoint(
+			"aggregates",
+			map[string]string{
+				"testId":     testID,
+				"simulation": t.simulation,
+				"name":       name,
+			},
+			map[string]interface{}{
+				"count":     int64(s.Count()),
+				"ok":        int64(s.OK()),
+				"ko":        int64(s.KO()),
+				"errorRate": s.ErrorRate(),
+				"rps":       float64(s.Count()) / span.Seconds(),
+				"min":       s.Min(),
+				"mean":      s.Mean(),
+				"p50":       s.Percentile(50),
+				"p90":       s.Percentile(90),
+				"p95":       s.Percentile(95),
+				"p99":       s.Percentile(99),
+				"max":       s.Max(),
+				"nodes":     len(t.nodes),
+			},
+			t.requestsTime,
+		)
+		if err != nil {
+			l.Errorf("Error creating new point with aggregated requests data: %v\n", err)
+			continue
+		}
+		points = append(points, p)
+	}
+	t.requests = make(map[string]*stats.Summary)
+	t.requestsPrev = t.requestsTime
+	t.requestsFrom = time.Time{}
+	t.requestsTime = time.Time{}
+
+	return points
+}
+
+// flush sends merged users and aggregated requests of all tests, tests finished
+// by all of their agents are forgotten afterwards
+func flush() {
+	mu.Lock()
+	var points []*infc.Point
+	for id, t := range tests {
+		points = append(points, t.usersPoints(id)...)
+		points = append(points, t.aggregatesPoints(id)...)
+		if len(t.ended) > 0 && len(t.ended) == len(t.nodes) {
+			l.Infof("All %d agent(s) finished test %s\n", len(t.nodes), id)
+			delete(tests, id)
+		}
+	}
+	mu.Unlock()
+
+	for _, p := range points {
+		influx.SendPoint(p)
+	}
+}
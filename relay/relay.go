@@ -0,0 +1,237 @@
+/*
+Copyright © 2020 Anton Kramarev
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+package relay
+
+import (
+	"compress/gzip"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dakaraj/gatling-to-influxdb/influx"
+	l "github.com/dakaraj/gatling-to-influxdb/logger"
+	"github.com/influxdata/influxdb1-client/models"
+	infc "github.com/influxdata/influxdb1-client/v2"
+	"github.com/spf13/cobra"
+)
+
+var (
+	listen        string
+	agentUsername string
+	agentPassword string
+	interval      time.Duration
+	// maxBodySize limits size of write requests, both compressed and decompressed
+	maxBodySize int64
+)
+
+// Init reads relay settings. Database settings are the same as of any other command
+// and are used for writing points. Agents must always authenticate, as relay writes
+// with database credentials on their behalf
+func Init(cmd *cobra.Command) error {
+	listen, _ = cmd.Flags().GetString("listen")
+	agentUsername, _ = cmd.Flags().GetString("agent-username")
+	agentPassword, _ = cmd.Flags().GetString("agent-password")
+	if agentUsername == "" || agentPassword == "" {
+		return errors.New("Agent username and password are required")
+	}
+	i, _ := cmd.Flags().GetUint("aggregation-interval")
+	if i == 0 {
+		return errors.New("Aggregation interval must be greater than zero")
+	}
+	interval = time.Duration(i) * time.Second
+	size, _ := cmd.Flags().GetUint("max-body-size")
+	if size == 0 {
+		return errors.New("Max body size must be greater than zero")
+	}
+	maxBodySize = int64(size)
+
+	return nil
+}
+
+// authorized checks agent credentials passed either with basic authentication
+// or with query parameters, in the same way InfluxDB does
+func authorized(r *http.Request) bool {
+	u, p, ok := r.BasicAuth()
+	if !ok {
+		u, p = r.URL.Query().Get("u"), r.URL.Query().Get("p")
+	}
+
+	return subtle.ConstantTimeCompare([]byte(u), []byte(agentUsername)) == 1 &&
+		subtle.ConstantTimeCompare([]byte(p), []byte(agentPassword)) == 1
+}
+
+// writeError responds with an error in InfluxDB format, so it is understood by agents
+func writeError(w http.ResponseWriter, code int, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+}
+
+func handlePing(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("X-Influxdb-Version", "g2i-relay")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func handleWrite(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, errors.New("Only POST method is supported"))
+		return
+	}
+	if !authorized(r) {
+		writeError(w, http.StatusUnauthorized, errors.New("Authorization failed"))
+		return
+	}
+	rp, consistency := r.URL.Query().Get("rp"), r.URL.Query().Get("consistency")
+	switch consistency {
+	case "", "any", "one", "quorum", "all":
+	default:
+		writeError(w, http.StatusBadRequest, fmt.Errorf("Unknown write consistency %q", consistency))
+		return
+	}
+
+	if r.ContentLength > maxBodySize {
+		writeError(w, http.StatusRequestEntityTooLarge, fmt.Errorf("Request body exceeds %d bytes", maxBodySize))
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, maxBodySize)
+
+	var body io.Reader = r.Body
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		gz, err := gzip.NewReader(r.Body)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("Failed to read gzip body: %w", err))
+			return
+		}
+		defer gz.Close()
+		body = gz
+	}
+	// Decompressed body is limited too, as a small gzip body may expand a lot
+	b, err := ioutil.ReadAll(io.LimitReader(body, maxBodySize+1))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("Failed to read request body: %w", err))
+		return
+	}
+	if int64(len(b)) > maxBodySize {
+		writeError(w, http.StatusRequestEntityTooLarge, fmt.Errorf("Request body exceeds %d bytes", maxBodySize))
+		return
+	}
+
+	// Valid points are forwarded even if some lines failed to parse, as InfluxDB does.
+	// Retention policy chosen by agent is kept, database requested by agent is ignored
+	parsed, parseErr := models.ParsePointsWithPrecision(b, time.Now().UTC(), r.URL.Query().Get("precision"))
+	points := make([]*infc.Point, 0, len(parsed))
+	for _, p := range parsed {
+		observe(p)
+		points = append(points, infc.NewPointFrom(p))
+	}
+	influx.ForwardPoints(points, rp, consistency)
+	if parseErr != nil {
+		l.Errorf("Agent %s sent malformed points: %v\n", r.RemoteAddr, parseErr)
+		writeError(w, http.StatusBadRequest, fmt.Errorf("partial write: %w", parseErr))
+		return
+	}
+	l.Debugf("Received %d points from %s\n", len(points), r.RemoteAddr)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleQuery answers queries agents send to check connection. Queries are never
+// passed to the database, as they would run with relay credentials. No database is
+// listed, so agents check write access with an empty write like for a write-only user
+func handleQuery(w http.ResponseWriter, r *http.Request) {
+	if !authorized(r) {
+		writeError(w, http.StatusUnauthorized, errors.New("Authorization failed"))
+		return
+	}
+	q := strings.TrimSpace(r.FormValue("q"))
+	if !strings.EqualFold(strings.Join(strings.Fields(strings.TrimSuffix(q, ";")), " "), "SHOW DATABASES") {
+		writeError(w, http.StatusForbidden, errors.New("Only SHOW DATABASES query is supported by relay"))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Influxdb-Version", "g2i-relay")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"results": []map[string]interface{}{{"statement_id": 0}},
+	})
+}
+
+// Run starts accepting points from agents until context is cancelled,
+// then sends all remaining data to InfluxDB
+func Run(ctx context.Context) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ping", handlePing)
+	mux.HandleFunc("/write", handleWrite)
+	mux.HandleFunc("/query", handleQuery)
+	srv := &http.Server{Addr: listen, Handler: mux}
+
+	wg := &sync.WaitGroup{}
+	fCtx, fCancel := context.WithCancel(context.Background())
+	wg.Add(1)
+	go influx.StartForwarding(fCtx, wg)
+
+	errc := make(chan error, 1)
+	go func() {
+		errc <- srv.ListenAndServe()
+	}()
+	l.Infof("Relay is listening on %s\n", listen)
+
+	var err error
+	ticker := time.NewTicker(interval)
+RelayLoop:
+	for {
+		select {
+		case <-ticker.C:
+			flush()
+		case err = <-errc:
+			break RelayLoop
+		case <-ctx.Done():
+			// Shutdown waits for requests being handled, so no received points are lost
+			sCtx, sCancel := context.WithTimeout(context.Background(), 10*time.Second)
+			if err := srv.Shutdown(sCtx); err != nil {
+				l.Errorf("Failed to stop relay server gracefully: %v\n", err)
+			}
+			sCancel()
+			break RelayLoop
+		}
+	}
+	ticker.Stop()
+
+	flush()
+	fCancel()
+	wg.Wait()
+	if err != nil {
+		return fmt.Errorf("Relay server failed: %w", err)
+	}
+	l.Infoln("Relay stopped")
+
+	return nil
+}
@@ -0,0 +1,324 @@
+/*
+Copyright © 2020 Anton Kramarev
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+package relay
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dakaraj/gatling-to-influxdb/flags"
+	"github.com/dakaraj/gatling-to-influxdb/influx"
+	"github.com/dakaraj/gatling-to-influxdb/influx/influxtest"
+	"github.com/influxdata/influxdb1-client/models"
+	infc "github.com/influxdata/influxdb1-client/v2"
+	"github.com/spf13/cobra"
+)
+
+// setUp connects to a fake database with connection flags parsed from args and limits
+// body size. Returned function closes connection, restores defaults and forgets received tests
+func setUp(t *testing.T, limit int64, args ...string) (*influxtest.Server, func()) {
+	srv := influxtest.NewServer("gatling")
+	cmd := &cobra.Command{Use: "test"}
+	flags.AddConnection(cmd.Flags())
+	if err := cmd.ParseFlags(append([]string{"--address", srv.URL}, args...)); err != nil {
+		t.Fatalf("Failed to parse flags: %v", err)
+	}
+	if err := influx.InitInfluxConnection(cmd); err != nil {
+		srv.Close()
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	agentUsername, agentPassword = "agent", "secret"
+	maxBodySize = limit
+	tests = make(map[string]*testState)
+
+	return srv, func() {
+		influx.CloseDBConnection()
+		srv.Close()
+		agentUsername, agentPassword = "", ""
+		maxBodySize = 0
+		tests = make(map[string]*testState)
+	}
+}
+
+// requestLines returns line protocol of n requests of test t1 starting at from with a step between them
+func requestLines(n int, from time.Time, step time.Duration) string {
+	var b strings.Builder
+	for i := 0; i < n; i++ {
+		fmt.Fprintf(&b, "requests,testId=t1,nodeName=node1,name=Home,result=OK,simulation=shop duration=10i,weight=1 %d\n",
+			from.Add(time.Duration(i)*step).UnixNano())
+	}
+
+	return b.String()
+}
+
+// write sends a body to the relay with agent credentials, query parameters are added to the URL
+func write(body []byte, gzipped bool, params ...string) *httptest.ResponseRecorder {
+	target := "/write?db=gatling"
+	for i := 0; i+1 < len(params); i += 2 {
+		target += "&" + params[i] + "=" + params[i+1]
+	}
+	req := httptest.NewRequest(http.MethodPost, target, bytes.NewReader(body))
+	req.SetBasicAuth("agent", "secret")
+	if gzipped {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+	rec := httptest.NewRecorder()
+	handleWrite(rec, req)
+
+	return rec
+}
+
+func observed() uint64 {
+	t, found := tests["t1"]
+	if !found || t.requests[allRequests] == nil {
+		return 0
+	}
+
+	return t.requests[allRequests].Count()
+}
+
+func TestHandleWriteAcceptsPoints(t *testing.T) {
+	srv, restore := setUp(t, 10000)
+	defer restore()
+
+	rec := write([]byte(requestLines(3, time.Unix(1790000000, 0), time.Second)), false)
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("Expected %d status, got %d: %s", http.StatusNoContent, rec.Code, rec.Body)
+	}
+	if n := observed(); n != 3 {
+		t.Errorf("Expected 3 observed requests, got %d", n)
+	}
+	if n := len(srv.Lines()); n != 3 {
+		t.Errorf("Expected 3 points forwarded, got %d", n)
+	}
+}
+
+func TestHandleWriteRequiresAuthentication(t *testing.T) {
+	srv, restore := setUp(t, 10000)
+	defer restore()
+	body := requestLines(3, time.Unix(1790000000, 0), time.Second)
+
+	for name, auth := range map[string]func(*http.Request){
+		"no credentials":    func(r *http.Request) {},
+		"wrong password":    func(r *http.Request) { r.SetBasicAuth("agent", "wrong") },
+		"query credentials": func(r *http.Request) { r.URL.RawQuery += "&u=agent&p=wrong" },
+	} {
+		req := httptest.NewRequest(http.MethodPost, "/write?db=gatling", strings.NewReader(body))
+		auth(req)
+		rec := httptest.NewRecorder()
+		handleWrite(rec, req)
+		if rec.Code != http.StatusUnauthorized {
+			t.Errorf("%s: expected %d status, got %d", name, http.StatusUnauthorized, rec.Code)
+		}
+	}
+	if n := len(srv.Lines()); n != 0 || observed() != 0 {
+		t.Errorf("Expected nothing forwarded or observed without authentication, got %d points", n)
+	}
+}
+
+func TestHandleWriteKeepsAgentRetentionPolicy(t *testing.T) {
+	srv, restore := setUp(t, 10000, "--retention-policy-route", "requests=month", "--write-consistency", "all")
+	defer restore()
+	lines := []byte(requestLines(2, time.Unix(1790000000, 0), time.Second))
+
+	cases := []struct {
+		params      []string
+		rp          string
+		consistency string
+	}{
+		// Agent routing is kept
+		{params: []string{"rp", "week", "consistency", "one"}, rp: "week", consistency: "one"},
+		// Relay routing and consistency apply to points sent without them
+		{rp: "month", consistency: "all"},
+	}
+	for i, tt := range cases {
+		if rec := write(lines, false, tt.params...); rec.Code != http.StatusNoContent {
+			t.Fatalf("Write %d: expected %d status, got %d: %s", i, http.StatusNoContent, rec.Code, rec.Body)
+		}
+		writes := srv.Writes()
+		got := writes[len(writes)-1]
+		if got.RetentionPolicy != tt.rp || got.Consistency != tt.consistency || len(got.Lines) != 2 {
+			t.Errorf("Write %d: expected 2 points to %q with consistency %q, got %d to %q with %q",
+				i, tt.rp, tt.consistency, len(got.Lines), got.RetentionPolicy, got.Consistency)
+		}
+	}
+
+	if rec := write(lines, false, "consistency", "most"); rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected %d status for unknown consistency, got %d", http.StatusBadRequest, rec.Code)
+	}
+}
+
+func TestHandleQueryAnswersLocally(t *testing.T) {
+	srv, restore := setUp(t, 10000)
+	defer restore()
+	sent := len(srv.Queries())
+
+	cases := []struct {
+		query  string
+		auth   bool
+		status int
+	}{
+		{query: "SHOW DATABASES", auth: true, status: http.StatusOK},
+		{query: "show  databases;", auth: true, status: http.StatusOK},
+		{query: "SHOW DATABASES", status: http.StatusUnauthorized},
+		{query: "DROP DATABASE gatling", auth: true, status: http.StatusForbidden},
+		{query: "SHOW DATABASES; DROP DATABASE gatling", auth: true, status: http.StatusForbidden},
+		{query: `SELECT * FROM "requests"`, auth: true, status: http.StatusForbidden},
+	}
+	for _, tt := range cases {
+		req := httptest.NewRequest(http.MethodGet, "/query?q="+url.QueryEscape(tt.query), nil)
+		if tt.auth {
+			req.SetBasicAuth("agent", "secret")
+		}
+		rec := httptest.NewRecorder()
+		handleQuery(rec, req)
+		if rec.Code != tt.status {
+			t.Errorf("%q: expected %d status, got %d: %s", tt.query, tt.status, rec.Code, rec.Body)
+			continue
+		}
+		if tt.status == http.StatusOK && strings.TrimSpace(rec.Body.String()) != `{"results":[{"statement_id":0}]}` {
+			t.Errorf("%q: expected no databases listed, got %s", tt.query, rec.Body)
+		}
+	}
+	if n := len(srv.Queries()) - sent; n != 0 {
+		t.Errorf("Expected no queries passed to the database, got %d", n)
+	}
+}
+
+func TestInitRequiresAgentCredentials(t *testing.T) {
+	for _, args := range [][]string{
+		nil,
+		{"--agent-username", "agent"},
+		{"--agent-password", "secret"},
+	} {
+		cmd := &cobra.Command{Use: "test"}
+		flags.AddRelay(cmd.Flags())
+		if err := cmd.ParseFlags(args); err != nil {
+			t.Fatal(err)
+		}
+		if err := Init(cmd); err == nil {
+			t.Errorf("Expected an error without agent credentials, args %v", args)
+		}
+	}
+}
+
+func TestHandleWriteRejectsLargeBody(t *testing.T) {
+	_, restore := setUp(t, 1000)
+	defer restore()
+	body := []byte(requestLines(20, time.Unix(1790000000, 0), time.Second))
+
+	rec := write(body, false)
+	if rec.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("Expected %d status, got %d: %s", http.StatusRequestEntityTooLarge, rec.Code, rec.Body)
+	}
+
+	// Body of unknown length is cut when the limit is reached
+	req := httptest.NewRequest(http.MethodPost, "/write?db=gatling", bytes.NewReader(body))
+	req.ContentLength = -1
+	rec = httptest.NewRecorder()
+	handleWrite(rec, req)
+	if rec.Code == http.StatusNoContent {
+		t.Error("Expected body of unknown length exceeding the limit to be rejected")
+	}
+	if n := observed(); n != 0 {
+		t.Errorf("Expected no requests from rejected bodies, got %d", n)
+	}
+}
+
+func TestHandleWriteLimitsDecompressedBody(t *testing.T) {
+	_, restore := setUp(t, 1000)
+	defer restore()
+	var b bytes.Buffer
+	gz := gzip.NewWriter(&b)
+	gz.Write([]byte(requestLines(200, time.Unix(1790000000, 0), time.Second)))
+	gz.Close()
+	if b.Len() >= 1000 {
+		t.Fatalf("Compressed body of %d bytes is expected to be under the limit", b.Len())
+	}
+
+	rec := write(b.Bytes(), true)
+	if rec.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("Expected %d status, got %d: %s", http.StatusRequestEntityTooLarge, rec.Code, rec.Body)
+	}
+	if n := observed(); n != 0 {
+		t.Errorf("Expected no requests from rejected body, got %d", n)
+	}
+}
+
+func rpsOf(t *testing.T, points []*infc.Point) float64 {
+	for _, p := range points {
+		if p.Tags()["name"] == allRequests {
+			fields, _ := p.Fields()
+			return fields["rps"].(float64)
+		}
+	}
+	t.Fatalf("No %s aggregates point", allRequests)
+
+	return 0
+}
+
+func observeLines(t *testing.T, lines string) {
+	points, err := models.ParsePointsString(lines)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range points {
+		observe(p)
+	}
+}
+
+func TestAggregatesThroughputUsesEventTime(t *testing.T) {
+	_, restore := setUp(t, 0)
+	defer restore()
+	start := time.Unix(1790000000, 0)
+
+	// 20 requests per second over 10 seconds received at once, e.g. sent in a single batch
+	observeLines(t, requestLines(200, start, 50*time.Millisecond))
+	if rps := rpsOf(t, tests["t1"].aggregatesPoints("t1")); math.Abs(rps-20) > 0.5 {
+		t.Errorf("Expected about 20 rps of the first flush, got %.2f", rps)
+	}
+
+	// Next 5 seconds continue the span of the previous flush
+	observeLines(t, requestLines(100, start.Add(10*time.Second), 50*time.Millisecond))
+	if rps := rpsOf(t, tests["t1"].aggregatesPoints("t1")); math.Abs(rps-20) > 0.5 {
+		t.Errorf("Expected about 20 rps of the second flush, got %.2f", rps)
+	}
+
+	// Lagging agent sends older requests, its span is used
+	observeLines(t, requestLines(40, start.Add(5*time.Second), 100*time.Millisecond))
+	if rps := rpsOf(t, tests["t1"].aggregatesPoints("t1")); math.Abs(rps-10) > 0.5 {
+		t.Errorf("Expected about 10 rps of lagging requests, got %.2f", rps)
+	}
+
+	if points := tests["t1"].aggregatesPoints("t1"); len(points) != 0 {
+		t.Errorf("Expected no aggregates without new requests, got %d", len(points))
+	}
+}
@@ -0,0 +1,299 @@
+/*
+Copyright © 2020 Anton Kramarev
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+package stats
+
+import (
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Summary accumulates durations and results of requests or groups sharing the same name.
+// Durations are stored in a sparse millisecond histogram, so exact percentiles are
+// available without keeping every single value in memory
+type Summary struct {
+	hist  map[int]uint64
+	count uint64
+	ko    uint64
+	sum   int64
+	min   int
+	max   int
+}
+
+// NewSummary returns an empty summary ready for use
+func NewSummary() *Summary {
+	return &Summary{hist: make(map[int]uint64)}
+}
+
+// Add registers a single duration (in milliseconds) with its result
+func (s *Summary) Add(duration int, ok bool) {
+	s.AddN(duration, ok, 1)
+}
+
+// AddN registers the same duration (in milliseconds) with its result n times,
+// e.g. for a sampled point standing for several requests
+func (s *Summary) AddN(duration int, ok bool, n uint64) {
+	if n == 0 {
+		return
+	}
+	if s.count == 0 || duration < s.min {
+		s.min = duration
+	}
+	if s.count == 0 || duration > s.max {
+		s.max = duration
+	}
+	s.hist[duration] += n
+	s.count += n
+	s.sum += int64(duration) * int64(n)
+	if !ok {
+		s.ko += n
+	}
+}
+
+// Merge adds all values from another summary to this one
+func (s *Summary) Merge(o *Summary) {
+	if o == nil || o.count == 0 {
+		return
+	}
+	if s.count == 0 || o.min < s.min {
+		s.min = o.min
+	}
+	if s.count == 0 || o.max > s.max {
+		s.max = o.max
+	}
+	for d, c := range o.hist {
+		s.hist[d] += c
+	}
+	s.count += o.count
+	s.ko += o.ko
+	s.sum += o.sum
+}
+
+// Count returns total amount of registered values
+func (s *Summary) Count() uint64 {
+	return s.count
+}
+
+// KO returns amount of failed values
+func (s *Summary) KO() uint64 {
+	return s.ko
+}
+
+// OK returns amount of successful values
+func (s *Summary) OK() uint64 {
+	return s.count - s.ko
+}
+
+// ErrorRate returns percentage of failed values, from 0 to 100
+func (s *Summary) ErrorRate() float64 {
+	if s.count == 0 {
+		return 0
+	}
+	return float64(s.ko) / float64(s.count) * 100
+}
+
+// Min returns the lowest registered duration
+func (s *Summary) Min() int {
+	return s.min
+}
+
+// Max returns the highest registered duration
+func (s *Summary) Max() int {
+	return s.max
+}
+
+// Mean returns an average duration
+func (s *Summary) Mean() float64 {
+	if s.count == 0 {
+		return 0
+	}
+	return float64(s.sum) / float64(s.count)
+}
+
+// Percentile returns a duration for the given percentile (0-100) using nearest-rank method
+func (s *Summary) Percentile(p float64) int {
+	if s.count == 0 {
+		return 0
+	}
+	keys := make([]int, 0, len(s.hist))
+	for d := range s.hist {
+		keys = append(keys, d)
+	}
+	sort.Ints(keys)
+
+	rank := uint64(math.Ceil(p / 100 * float64(s.count)))
+	if rank == 0 {
+		rank = 1
+	}
+	var seen uint64
+	for _, d := range keys {
+		seen += s.hist[d]
+		if seen >= rank {
+			return d
+		}
+	}
+
+	return s.max
+}
+
+// Users contains aggregated virtual users activity
+type Users struct {
+	Active  int
+	Max     int
+	Started int
+	Ended   int
+}
+
+// Snapshot is a point-in-time copy of all collected statistics
+type Snapshot struct {
+	Global   *Summary
+	Requests map[string]*Summary
+	Groups   map[string]*Summary
+	Users    Users
+	Start    time.Time
+	End      time.Time
+}
+
+// Duration returns a time span covered by collected data
+func (s Snapshot) Duration() time.Duration {
+	if s.End.Before(s.Start) {
+		return 0
+	}
+	return s.End.Sub(s.Start)
+}
+
+// RPS returns an average throughput of the given summary over the snapshot duration
+func (s Snapshot) RPS(sum *Summary) float64 {
+	d := s.Duration().Seconds()
+	if d < 1 {
+		d = 1
+	}
+	return float64(sum.Count()) / d
+}
+
+var (
+	mu       sync.Mutex
+	global   = NewSummary()
+	requests = make(map[string]*Summary)
+	groups   = make(map[string]*Summary)
+	users    Users
+	start    time.Time
+	end      time.Time
+)
+
+// Reset discards all collected statistics, so another test can be processed
+func Reset() {
+	mu.Lock()
+	defer mu.Unlock()
+
+	global = NewSummary()
+	requests = make(map[string]*Summary)
+	groups = make(map[string]*Summary)
+	users = Users{}
+	start = time.Time{}
+	end = time.Time{}
+}
+
+func observeTime(t time.Time) {
+	if start.IsZero() || t.Before(start) {
+		start = t
+	}
+	if t.After(end) {
+		end = t
+	}
+}
+
+// AddRequest registers data from a single REQUEST line
+func AddRequest(name string, duration int, ok bool, t time.Time) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	s, found := requests[name]
+	if !found {
+		s = NewSummary()
+		requests[name] = s
+	}
+	s.Add(duration, ok)
+	global.Add(duration, ok)
+	observeTime(t)
+}
+
+// AddGroup registers data from a single GROUP line
+func AddGroup(name string, duration int, ok bool, t time.Time) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	s, found := groups[name]
+	if !found {
+		s = NewSummary()
+		groups[name] = s
+	}
+	s.Add(duration, ok)
+	observeTime(t)
+}
+
+// AddUser registers a single START or END user event
+func AddUser(status string, t time.Time) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	switch status {
+	case "START":
+		users.Started++
+		users.Active++
+		if users.Active > users.Max {
+			users.Max = users.Active
+		}
+	case "END":
+		users.Ended++
+		users.Active--
+	}
+	observeTime(t)
+}
+
+// TakeSnapshot returns a copy of all statistics collected so far
+func TakeSnapshot() Snapshot {
+	mu.Lock()
+	defer mu.Unlock()
+
+	s := Snapshot{
+		Global:   NewSummary(),
+		Requests: make(map[string]*Summary, len(requests)),
+		Groups:   make(map[string]*Summary, len(groups)),
+		Users:    users,
+		Start:    start,
+		End:      end,
+	}
+	s.Global.Merge(global)
+	for k, v := range requests {
+		s.Requests[k] = NewSummary()
+		s.Requests[k].Merge(v)
+	}
+	for k, v := range groups {
+		s.Groups[k] = NewSummary()
+		s.Groups[k].Merge(v)
+	}
+
+	return s
+}
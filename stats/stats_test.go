@@ -0,0 +1,192 @@
+/*
+Copyright © 2020 Anton Kramarev
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+package stats
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+// summaryOf returns a summary of OK durations
+func summaryOf(durations ...int) *Summary {
+	s := NewSummary()
+	for _, d := range durations {
+		s.Add(d, true)
+	}
+
+	return s
+}
+
+func TestPercentileNearestRank(t *testing.T) {
+	oneToTen := summaryOf(1, 2, 3, 4, 5, 6, 7, 8, 9, 10)
+	// Weighted values: 9 requests of 10ms stand for sampled points
+	weighted := summaryOf(1000)
+	weighted.AddN(10, true, 9)
+
+	tests := []struct {
+		name string
+		s    *Summary
+		p    float64
+		want int
+	}{
+		{name: "zero percentile is the lowest value", s: oneToTen, p: 0, want: 1},
+		{name: "exact rank", s: oneToTen, p: 10, want: 1},
+		{name: "rank is rounded up", s: oneToTen, p: 11, want: 2},
+		{name: "median", s: oneToTen, p: 50, want: 5},
+		{name: "p90", s: oneToTen, p: 90, want: 9},
+		{name: "p95", s: oneToTen, p: 95, want: 10},
+		{name: "p99.9", s: oneToTen, p: 99.9, want: 10},
+		{name: "maximum", s: oneToTen, p: 100, want: 10},
+		{name: "single value", s: summaryOf(42), p: 50, want: 42},
+		{name: "weighted value below rank", s: weighted, p: 90, want: 10},
+		{name: "weighted value above rank", s: weighted, p: 91, want: 1000},
+		{name: "no values", s: NewSummary(), p: 50, want: 0},
+	}
+	for _, tt := range tests {
+		if got := tt.s.Percentile(tt.p); got != tt.want {
+			t.Errorf("%s: expected p%v = %d, got %d", tt.name, tt.p, tt.want, got)
+		}
+	}
+}
+
+func TestSummaryAggregates(t *testing.T) {
+	s := NewSummary()
+	s.Add(100, true)
+	s.Add(300, false)
+	s.AddN(200, true, 2)
+	// Zero weight is ignored, even for min and max
+	s.AddN(1, false, 0)
+
+	if s.Count() != 4 || s.OK() != 3 || s.KO() != 1 {
+		t.Errorf("Expected 4 values with 3 OK and 1 KO, got %d, %d and %d", s.Count(), s.OK(), s.KO())
+	}
+	if s.Min() != 100 || s.Max() != 300 {
+		t.Errorf("Expected min 100 and max 300, got %d and %d", s.Min(), s.Max())
+	}
+	if s.Mean() != 200 {
+		t.Errorf("Expected mean 200, got %v", s.Mean())
+	}
+	if s.ErrorRate() != 25 {
+		t.Errorf("Expected error rate 25%%, got %v", s.ErrorRate())
+	}
+}
+
+func TestEmptySummary(t *testing.T) {
+	s := NewSummary()
+	if s.Count() != 0 || s.OK() != 0 || s.KO() != 0 || s.Min() != 0 || s.Max() != 0 {
+		t.Errorf("Expected zero counts and durations, got %+v", s)
+	}
+	if s.Mean() != 0 || s.ErrorRate() != 0 || s.Percentile(99) != 0 {
+		t.Errorf("Expected zero mean, error rate and percentile, got %v, %v and %d", s.Mean(), s.ErrorRate(), s.Percentile(99))
+	}
+}
+
+func TestMerge(t *testing.T) {
+	a := summaryOf(50, 100)
+	b := NewSummary()
+	b.Add(10, false)
+	b.Add(500, true)
+
+	a.Merge(b)
+	if a.Count() != 4 || a.KO() != 1 || a.Min() != 10 || a.Max() != 500 || a.Mean() != 165 {
+		t.Errorf("Expected 4 values, 1 KO, min 10, max 500 and mean 165, got %d, %d, %d, %d and %v",
+			a.Count(), a.KO(), a.Min(), a.Max(), a.Mean())
+	}
+	if p := a.Percentile(50); p != 50 {
+		t.Errorf("Expected merged median 50, got %d", p)
+	}
+	if b.Count() != 2 {
+		t.Errorf("Expected merged summary to stay intact, got %d values", b.Count())
+	}
+
+	// Merging nothing changes nothing
+	a.Merge(nil)
+	a.Merge(NewSummary())
+	if a.Count() != 4 || a.Min() != 10 {
+		t.Errorf("Expected empty merges to be ignored, got %d values with min %d", a.Count(), a.Min())
+	}
+
+	// Min and max of an empty summary are taken from merged one, not from zero values
+	empty := NewSummary()
+	empty.Merge(summaryOf(70, 80))
+	if empty.Min() != 70 || empty.Max() != 80 {
+		t.Errorf("Expected min 70 and max 80, got %d and %d", empty.Min(), empty.Max())
+	}
+}
+
+func TestSnapshotRPS(t *testing.T) {
+	start := time.Unix(1790000000, 0)
+	hundred := NewSummary()
+	hundred.AddN(10, true, 100)
+
+	tests := []struct {
+		name string
+		snap Snapshot
+		s    *Summary
+		want float64
+	}{
+		{name: "over duration", snap: Snapshot{Start: start, End: start.Add(10 * time.Second)}, s: hundred, want: 10},
+		{name: "short test counts as one second", snap: Snapshot{Start: start, End: start.Add(100 * time.Millisecond)}, s: hundred, want: 100},
+		{name: "no time span", snap: Snapshot{}, s: hundred, want: 100},
+		{name: "end before start", snap: Snapshot{Start: start, End: start.Add(-time.Minute)}, s: hundred, want: 100},
+		{name: "no requests", snap: Snapshot{Start: start, End: start.Add(10 * time.Second)}, s: NewSummary(), want: 0},
+	}
+	for _, tt := range tests {
+		if got := tt.snap.RPS(tt.s); math.Abs(got-tt.want) > 1e-9 {
+			t.Errorf("%s: expected %v rps, got %v", tt.name, tt.want, got)
+		}
+	}
+}
+
+func TestTakeSnapshotCopiesState(t *testing.T) {
+	Reset()
+	defer Reset()
+	start := time.Unix(1790000000, 0)
+
+	AddUser("START", start)
+	AddUser("START", start.Add(time.Second))
+	AddUser("END", start.Add(2*time.Second))
+	AddRequest("Home", 100, true, start.Add(time.Second))
+	AddRequest("Home", 200, false, start.Add(5*time.Second))
+	AddGroup("Visit", 300, true, start.Add(6*time.Second))
+
+	snap := TakeSnapshot()
+	AddRequest("Home", 300, true, start.Add(10*time.Second))
+
+	if snap.Global.Count() != 2 || snap.Requests["Home"].Count() != 2 || snap.Groups["Visit"].Count() != 1 {
+		t.Errorf("Expected snapshot not to change with new data, got %d global, %d Home and %d Visit values",
+			snap.Global.Count(), snap.Requests["Home"].Count(), snap.Groups["Visit"].Count())
+	}
+	if snap.Users != (Users{Active: 1, Max: 2, Started: 2, Ended: 1}) {
+		t.Errorf("Unexpected users %+v", snap.Users)
+	}
+	if snap.Duration() != 6*time.Second {
+		t.Errorf("Expected snapshot duration 6s, got %v", snap.Duration())
+	}
+
+	Reset()
+	if snap := TakeSnapshot(); snap.Global.Count() != 0 || len(snap.Requests) != 0 || snap.Users != (Users{}) {
+		t.Error("Expected reset to discard all statistics")
+	}
+}